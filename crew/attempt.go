@@ -0,0 +1,104 @@
+package crew
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MaxAttemptResponseLength is the number of bytes of a worker's response that are kept in an attempt's history.
+const MaxAttemptResponseLength = 4096
+
+// Attempt error types tell apart why an attempt failed.
+const (
+	// AttemptErrorWorker means the worker responded with an error.
+	AttemptErrorWorker = "worker"
+	// AttemptErrorTimeout means the worker didn't respond within the task's timeout.
+	AttemptErrorTimeout = "timeout"
+	// AttemptErrorRateLimit means the worker asked crew to back off.
+	AttemptErrorRateLimit = "rateLimit"
+	// AttemptErrorCanceled means the task was canceled while the worker was working on it.
+	AttemptErrorCanceled = "canceled"
+	// AttemptErrorLeaseExpired means the crew instance executing the task went away.
+	AttemptErrorLeaseExpired = "leaseExpired"
+	// AttemptErrorConnection means the worker couldn't be reached (or its response couldn't be read).
+	AttemptErrorConnection = "connection"
+)
+
+// An Attempt records a single execution of a task by a worker.
+type Attempt struct {
+	Id         string    `json:"id"`
+	TaskId     string    `json:"taskId"`
+	Number     int       `json:"number"`
+	StartedAt  time.Time `json:"startedAt"`
+	EndedAt    time.Time `json:"endedAt"`
+	DurationMs int64     `json:"durationMs"`
+	WorkerUrl  string    `json:"workerUrl"`
+	StatusCode int       `json:"statusCode"`
+	Error      string    `json:"error"`
+	ErrorType  string    `json:"errorType"`
+	Response   string    `json:"response"`
+}
+
+// NewAttempt creates a new Attempt that starts now.
+func NewAttempt(task *Task, number int) *Attempt {
+	attempt := Attempt{
+		Id:        uuid.New().String(),
+		TaskId:    task.Id,
+		Number:    number,
+		StartedAt: time.Now(),
+	}
+	return &attempt
+}
+
+// Finish records the outcome of an attempt.
+func (attempt *Attempt) Finish(response WorkerResponse, err error) {
+	attempt.EndedAt = time.Now()
+	attempt.DurationMs = attempt.EndedAt.Sub(attempt.StartedAt).Milliseconds()
+	attempt.WorkerUrl = response.WorkerUrl
+	attempt.StatusCode = response.StatusCode
+	if workerErr, ok := err.(*WorkerError); ok && attempt.StatusCode == 0 {
+		attempt.StatusCode = workerErr.StatusCode
+	}
+
+	if err != nil {
+		attempt.Error = fmt.Sprintf("%v", err)
+		attempt.ErrorType = attemptErrorType(err)
+	} else if response.Error != nil {
+		attempt.Error = fmt.Sprintf("%v", response.Error)
+		attempt.ErrorType = AttemptErrorWorker
+	}
+
+	body := response.RawBody
+	if body == "" && err == nil {
+		// Clients that don't expose a raw body get the parsed response instead
+		responseJson, jsonErr := json.Marshal(response)
+		if jsonErr == nil {
+			body = string(responseJson)
+		}
+	}
+	if len(body) > MaxAttemptResponseLength {
+		body = body[:MaxAttemptResponseLength]
+	}
+	attempt.Response = body
+}
+
+// attemptErrorType classifies an error returned by a task client.
+func attemptErrorType(err error) string {
+	var timeoutErr *TimeoutError
+	var rateLimitErr *RateLimitError
+	var workerErr *WorkerError
+	switch {
+	case errors.As(err, &timeoutErr):
+		return AttemptErrorTimeout
+	case errors.As(err, &rateLimitErr):
+		return AttemptErrorRateLimit
+	case errors.As(err, &workerErr):
+		return AttemptErrorWorker
+	default:
+		return AttemptErrorConnection
+	}
+}
@@ -0,0 +1,87 @@
+package crew
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttemptFinish(t *testing.T) {
+	task := NewTask()
+	task.Id = "task61"
+	attempt := NewAttempt(task, 1)
+
+	attempt.Finish(WorkerResponse{
+		Output:     "done",
+		WorkerUrl:  "http://localhost/worker-a",
+		StatusCode: 200,
+		RawBody:    strings.Repeat("a", MaxAttemptResponseLength+100),
+	}, nil)
+
+	if attempt.TaskId != "task61" {
+		t.Fatalf("Expected task61, got %v", attempt.TaskId)
+	}
+	if attempt.EndedAt.Before(attempt.StartedAt) {
+		t.Fatal("Expected attempt to end after it started")
+	}
+	if attempt.WorkerUrl != "http://localhost/worker-a" || attempt.StatusCode != 200 {
+		t.Fatalf("Unexpected call info %v %v", attempt.WorkerUrl, attempt.StatusCode)
+	}
+	if len(attempt.Response) != MaxAttemptResponseLength {
+		t.Fatalf("Expected response to be truncated to %v, got %v", MaxAttemptResponseLength, len(attempt.Response))
+	}
+	if attempt.Error != "" {
+		t.Fatalf("Expected no error, got %v", attempt.Error)
+	}
+}
+
+func TestAttemptErrorTypes(t *testing.T) {
+	task := NewTask()
+	task.Id = "task134"
+
+	for _, testCase := range []struct {
+		response  WorkerResponse
+		err       error
+		errorType string
+	}{
+		{WorkerResponse{}, &TimeoutError{Timeout: time.Minute}, AttemptErrorTimeout},
+		{WorkerResponse{}, &RateLimitError{Message: "slow down", RetryAfter: time.Minute}, AttemptErrorRateLimit},
+		{WorkerResponse{}, &WorkerError{Message: "bad request", StatusCode: 400}, AttemptErrorWorker},
+		{WorkerResponse{Error: "oops"}, nil, AttemptErrorWorker},
+		{WorkerResponse{}, errors.New("connection refused"), AttemptErrorConnection},
+		{WorkerResponse{Output: "done"}, nil, ""},
+	} {
+		attempt := NewAttempt(task, 1)
+		attempt.Finish(testCase.response, testCase.err)
+		if attempt.ErrorType != testCase.errorType {
+			t.Fatalf("Expected error type %q for %v, got %q", testCase.errorType, testCase.err, attempt.ErrorType)
+		}
+	}
+}
+
+func TestAttemptFinishWithError(t *testing.T) {
+	task := NewTask()
+	task.Id = "task62"
+	attempt := NewAttempt(task, 2)
+
+	attempt.Finish(WorkerResponse{}, &WorkerError{Message: "bad request", StatusCode: 400})
+	if attempt.StatusCode != 400 {
+		t.Fatalf("Expected 400, got %v", attempt.StatusCode)
+	}
+	if attempt.Error != "bad request" {
+		t.Fatalf("Expected bad request, got %v", attempt.Error)
+	}
+
+	attempt = NewAttempt(task, 3)
+	attempt.Finish(WorkerResponse{}, errors.New("connection refused"))
+	if attempt.Error != "connection refused" || attempt.Response != "" {
+		t.Fatalf("Unexpected attempt %v %v", attempt.Error, attempt.Response)
+	}
+
+	attempt = NewAttempt(task, 4)
+	attempt.Finish(WorkerResponse{Error: "oops"}, nil)
+	if attempt.Error != "oops" {
+		t.Fatalf("Expected oops, got %v", attempt.Error)
+	}
+}
@@ -18,6 +18,8 @@ export interface Task {
   runAfter: string
   isSeed: boolean
   errorDelayInSeconds: number
+  priority: number
+  timeoutInSeconds: number
   // eslint-disable-next-line @typescript-eslint/no-explicit-any
   input: any
   // eslint-disable-next-line @typescript-eslint/no-explicit-any
@@ -27,13 +29,34 @@ export interface Task {
   createdAt: string
   parentIds: Array<string>
   busyExecuting: boolean
+  status: string
+  leaseOwner: string
+  leaseExpiresAt: string
+  awaitingCompletion: boolean
+  progress: number
+  progressMessage: string
   pauseWait: boolean
   resumeWait: boolean
   retryWait: boolean
   resetWait: boolean
+  cancelWait: boolean
   node: NodeObject
 }
 
+export interface Attempt {
+  id: string
+  taskId: string
+  number: number
+  startedAt: string
+  endedAt: string
+  durationMs: number
+  workerUrl: string
+  statusCode: number
+  error: string
+  errorType: string
+  response: string
+}
+
 export interface ModifyTask {
   id?: string
   name: string
@@ -46,6 +69,8 @@ export interface ModifyTask {
   runAfter?: string
   isSeed?: boolean
   errorDelayInSeconds?: number
+  priority?: number
+  timeoutInSeconds?: number
   // eslint-disable-next-line @typescript-eslint/no-explicit-any
   input?: any
   parentIds?: Array<string>
@@ -58,13 +83,14 @@ export interface PaginatedTasks {
 
 export const useTaskStore = defineStore('task', {
   actions: {
-    async getTasks (taskGroupId: string, page = 1, pageSize = 20, search = '', skipCompleted = false) : Promise<PaginatedTasks> {
+    async getTasks (taskGroupId: string, page = 1, pageSize = 20, search = '', skipCompleted = false, status = '') : Promise<PaginatedTasks> {
       const result = await api.get(`api/v1/task_group/${taskGroupId}/tasks`, {
         params: {
           page,
           pageSize,
           search,
-          skipCompleted
+          skipCompleted,
+          status
         },
         headers: {
           Authorization: `Bearer ${authStore.token}`
@@ -80,6 +106,14 @@ export const useTaskStore = defineStore('task', {
       })
       return result.data
     },
+    async getTaskAttempts (taskId: string) : Promise<Array<Attempt>> {
+      const result = await api.get(`api/v1/task/${taskId}/attempts`, {
+        headers: {
+          Authorization: `Bearer ${authStore.token}`
+        }
+      })
+      return result.data.attempts
+    },
     async updateTask (taskGroupId: string, taskId: string, payload: {name: string}) : Promise<Task> {
       const result = await api.put(`api/v1/task_group/${taskGroupId}/task/${taskId}`, payload, {
         headers: {
@@ -119,6 +153,14 @@ export const useTaskStore = defineStore('task', {
       })
       return result.data
     },
+    async cancelTask (taskGroupId: string, taskId: string) : Promise<Task> {
+      const result = await api.post(`api/v1/task_group/${taskGroupId}/task/${taskId}/cancel`, {}, {
+        headers: {
+          Authorization: `Bearer ${authStore.token}`
+        }
+      })
+      return result.data
+    },
     async resetTask (taskGroupId: string, taskId: string, remainingAttempts = 5) {
       const result = await api.post(`api/v1/task_group/${taskGroupId}/task/${taskId}/reset`, { remainingAttempts }, {
         headers: {
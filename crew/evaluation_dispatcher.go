@@ -0,0 +1,54 @@
+package crew
+
+import "sync"
+
+// EvaluationDispatcher delivers task evaluation requests to a crew instance.
+// The default LocalEvaluationDispatcher evaluates tasks in the process that asked for them.
+// Distributed dispatchers (see RedisEvaluationDispatcher) allow any instance to pick up the work.
+type EvaluationDispatcher interface {
+	// Dispatch requests an evaluation of a task.
+	Dispatch(taskId string) (err error)
+	// Start begins delivering dispatched task ids to handler.
+	Start(handler func(taskId string)) (err error)
+	// Stop stops delivering task ids.
+	Stop() (err error)
+}
+
+// LocalEvaluationDispatcher evaluates each dispatched task in a goroutine (single host systems).
+type LocalEvaluationDispatcher struct {
+	handler func(taskId string)
+	mutex   sync.RWMutex
+}
+
+// NewLocalEvaluationDispatcher creates a new LocalEvaluationDispatcher.
+func NewLocalEvaluationDispatcher() *LocalEvaluationDispatcher {
+	return &LocalEvaluationDispatcher{}
+}
+
+// Dispatch evaluates a task in a new goroutine, requests made while stopped are dropped.
+func (dispatcher *LocalEvaluationDispatcher) Dispatch(taskId string) (err error) {
+	dispatcher.mutex.RLock()
+	handler := dispatcher.handler
+	dispatcher.mutex.RUnlock()
+
+	if handler != nil {
+		go handler(taskId)
+	}
+	return nil
+}
+
+// Start sets the function that evaluates dispatched tasks.
+func (dispatcher *LocalEvaluationDispatcher) Start(handler func(taskId string)) (err error) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	dispatcher.handler = handler
+	return nil
+}
+
+// Stop stops evaluating dispatched tasks.
+func (dispatcher *LocalEvaluationDispatcher) Stop() (err error) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	dispatcher.handler = nil
+	return nil
+}
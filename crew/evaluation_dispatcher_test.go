@@ -0,0 +1,88 @@
+package crew
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingDispatcher remembers dispatched task ids instead of evaluating them.
+type recordingDispatcher struct {
+	dispatched []string
+	handler    func(taskId string)
+	mutex      sync.Mutex
+}
+
+func (dispatcher *recordingDispatcher) Dispatch(taskId string) (err error) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	dispatcher.dispatched = append(dispatcher.dispatched, taskId)
+	return nil
+}
+
+func (dispatcher *recordingDispatcher) Start(handler func(taskId string)) (err error) {
+	dispatcher.handler = handler
+	return nil
+}
+
+func (dispatcher *recordingDispatcher) Stop() (err error) {
+	dispatcher.handler = nil
+	return nil
+}
+
+func TestLocalEvaluationDispatcher(t *testing.T) {
+	dispatcher := NewLocalEvaluationDispatcher()
+	evaluated := make(chan string, 1)
+	dispatcher.Start(func(taskId string) {
+		evaluated <- taskId
+	})
+
+	dispatcher.Dispatch("task71")
+	select {
+	case taskId := <-evaluated:
+		if taskId != "task71" {
+			t.Fatalf("Expected task71, got %v", taskId)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected task to be evaluated")
+	}
+
+	dispatcher.Stop()
+	dispatcher.Dispatch("task72")
+	select {
+	case taskId := <-evaluated:
+		t.Fatalf("Expected no evaluation after stop, got %v", taskId)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestControllerUsesDispatcher(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	controller := NewTaskController(storage, &stubTaskClient{}, nil)
+	controller.Feed = nil
+	dispatcher := &recordingDispatcher{}
+	controller.Dispatcher = dispatcher
+
+	task := NewTask()
+	task.Id = "task73"
+	task.TaskGroupId = "group9"
+	task.Name = "task73"
+	task.Worker = "worker-a"
+	controller.CreateTask(task)
+
+	if len(dispatcher.dispatched) != 1 || dispatcher.dispatched[0] != "task73" {
+		t.Fatalf("Expected task73 to be dispatched, got %v", dispatcher.dispatched)
+	}
+
+	err := controller.Startup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dispatcher.handler == nil {
+		t.Fatal("Expected startup to start the dispatcher")
+	}
+	controller.Shutdown()
+	if dispatcher.handler != nil {
+		t.Fatal("Expected shutdown to stop the dispatcher")
+	}
+}
@@ -0,0 +1,189 @@
+package crew
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// MaxExecStderrLength is the number of bytes of a command's stderr that are kept in the task's error.
+const MaxExecStderrLength = 4096
+
+// ExecTaskClient executes tasks by running a command for each worker (cli tools, python scripts, etc).
+// The WorkerPayload json is written to the command's stdin and a WorkerResponse json is read from its stdout
+// (empty stdout is an empty response).  A non-zero exit status fails the attempt with the command's stderr,
+// the stdout json can include "retryable": false to fail the task without retrying it.
+// The command and any processes it started are killed when the task times out or is canceled.
+type ExecTaskClient struct {
+	// Commands maps worker names to a program and its arguments.
+	Commands map[string][]string
+	// Dir is the working directory of commands, the current directory when empty.
+	Dir string
+	// Env is added to crew's environment for commands.
+	Env []string
+	// Fallback executes tasks for workers that have no command, those tasks fail when it is nil.
+	Fallback TaskClient
+	mutex    sync.RWMutex
+}
+
+// NewExecTaskClient creates a new ExecTaskClient, fallback may be nil.
+func NewExecTaskClient(commands map[string][]string, fallback TaskClient) *ExecTaskClient {
+	client := ExecTaskClient{
+		Commands: commands,
+		Fallback: fallback,
+	}
+	if client.Commands == nil {
+		client.Commands = make(map[string][]string)
+	}
+	return &client
+}
+
+// Register sets the command that executes a worker's tasks.
+func (client *ExecTaskClient) Register(worker string, command ...string) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.Commands[worker] = command
+}
+
+func (client *ExecTaskClient) find(worker string) (command []string, found bool) {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	command, found = client.Commands[worker]
+	return command, found && len(command) > 0
+}
+
+// Post runs the command for the task's worker (or calls the fallback client).
+func (client *ExecTaskClient) Post(ctx context.Context, task *Task, parents []*Task) (response WorkerResponse, err error) {
+	command, found := client.find(task.Worker)
+	if !found {
+		if client.Fallback != nil {
+			return client.Fallback.Post(ctx, task, parents)
+		}
+		return WorkerResponse{}, &WorkerError{
+			Message:   "No command registered for worker: " + task.Worker,
+			Retryable: false,
+		}
+	}
+
+	payloadJson, err := json.Marshal(newWorkerPayload(task, parents))
+	if err != nil {
+		return WorkerResponse{}, err
+	}
+
+	callInfo := WorkerResponse{WorkerUrl: "exec://" + strings.Join(command, " ")}
+	stdout := bytes.Buffer{}
+	stderr := bytes.Buffer{}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = client.Dir
+	cmd.Env = append(os.Environ(), client.Env...)
+	cmd.Stdin = bytes.NewReader(payloadJson)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Commands get their own process group so that anything they start is killed with them
+	setProcessGroup(cmd)
+
+	err = cmd.Start()
+	if err != nil {
+		return callInfo, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		log.Println("Killing command", task.Id, callInfo.WorkerUrl)
+		if killErr := killProcessGroup(cmd); killErr != nil {
+			log.Println("Error killing command", task.Id, killErr)
+		}
+		<-done
+		return callInfo, ctx.Err()
+	}
+
+	callInfo.RawBody = stdout.String()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return callInfo, err
+		}
+		stderrText := stderr.String()
+		if len(stderrText) > MaxExecStderrLength {
+			stderrText = stderrText[:MaxExecStderrLength]
+		}
+		workerErr := &WorkerError{
+			Message:   fmt.Sprintf("Command exited with status %d, stderr: %v", exitErr.ExitCode(), strings.TrimSpace(stderrText)),
+			Retryable: true,
+		}
+		// Commands can ask not to be retried with "retryable" in their output
+		errorResp := WorkerResponse{}
+		if json.Unmarshal(stdout.Bytes(), &errorResp) == nil && errorResp.Retryable != nil {
+			workerErr.Retryable = *errorResp.Retryable
+		}
+		return callInfo, workerErr
+	}
+
+	workerResp := WorkerResponse{}
+	if len(bytes.TrimSpace(stdout.Bytes())) > 0 {
+		jsonErr := json.Unmarshal(stdout.Bytes(), &workerResp)
+		if jsonErr != nil {
+			return callInfo, jsonErr
+		}
+	}
+	workerResp.WorkerUrl = callInfo.WorkerUrl
+	workerResp.RawBody = callInfo.RawBody
+	return workerResp, nil
+}
+
+// Cancel passes cancels for workers without a command on to the fallback client.
+// Commands are killed when their ctx is canceled.
+func (client *ExecTaskClient) Cancel(ctx context.Context, task *Task) (err error) {
+	if _, found := client.find(task.Worker); found {
+		return nil
+	}
+	if canceler, ok := client.Fallback.(TaskCanceler); ok {
+		return canceler.Cancel(ctx, task)
+	}
+	return nil
+}
+
+// ParseExecCommands parses worker commands in the form "resize=python3 resize.py;transcode=./transcode --fast".
+// Arguments are split on whitespace (no quoting).
+func ParseExecCommands(value string) (commands map[string][]string, err error) {
+	commands = make(map[string][]string)
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, errors.New("invalid worker command: " + entry)
+		}
+		command := strings.Fields(parts[1])
+		if len(command) == 0 {
+			return nil, errors.New("invalid worker command: " + entry)
+		}
+		commands[strings.TrimSpace(parts[0])] = command
+	}
+	return commands, nil
+}
+
+// ExecCommandsFromEnv parses the worker commands in an env var (see ParseExecCommands).
+// Invalid values are logged and ignored.
+func ExecCommandsFromEnv(name string) map[string][]string {
+	commands, err := ParseExecCommands(os.Getenv(name))
+	if err != nil {
+		log.Println("Ignoring "+name, err)
+		return make(map[string][]string)
+	}
+	return commands
+}
@@ -0,0 +1,90 @@
+//go:build !windows
+
+package crew
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecTaskClient(t *testing.T) {
+	client := NewExecTaskClient(map[string][]string{
+		"echo":  {"sh", "-c", `read -r payload; echo "{\"output\": $payload}"`},
+		"fail":  {"sh", "-c", `echo "out of disk" >&2; exit 3`},
+		"bad":   {"sh", "-c", `echo '{"error": "bad input", "retryable": false}'; exit 1`},
+		"quiet": {"true"},
+	}, nil)
+
+	task := NewTask()
+	task.Id = "task150"
+	task.Worker = "echo"
+	task.Input = "hello"
+	response, err := client.Post(context.Background(), task, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, ok := response.Output.(map[string]interface{})
+	if !ok || output["taskId"] != "task150" || output["input"] != "hello" {
+		t.Fatalf("Expected payload to be echoed, got %v", response.Output)
+	}
+
+	task.Worker = "fail"
+	_, err = client.Post(context.Background(), task, nil)
+	if err == nil || !IsRetryableError(err) || !strings.Contains(err.Error(), "status 3") || !strings.Contains(err.Error(), "out of disk") {
+		t.Fatalf("Expected a retryable error with stderr, got %v", err)
+	}
+
+	task.Worker = "bad"
+	_, err = client.Post(context.Background(), task, nil)
+	if err == nil || IsRetryableError(err) {
+		t.Fatalf("Expected a permanent error, got %v", err)
+	}
+
+	task.Worker = "quiet"
+	response, err = client.Post(context.Background(), task, nil)
+	if err != nil || response.Output != nil {
+		t.Fatalf("Expected an empty response, got %+v %v", response, err)
+	}
+
+	task.Worker = "missing"
+	_, err = client.Post(context.Background(), task, nil)
+	if err == nil || IsRetryableError(err) {
+		t.Fatalf("Expected unregistered worker to fail permanently, got %v", err)
+	}
+}
+
+func TestExecTaskClientKillsProcessGroup(t *testing.T) {
+	client := NewExecTaskClient(nil, nil)
+	// The background sleep holds stdout open, so the call only returns early if it is killed too
+	client.Register("slow", "sh", "-c", "sleep 30 & sleep 30; wait")
+
+	task := NewTask()
+	task.Id = "task151"
+	task.Worker = "slow"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	_, err := client.Post(ctx, task, nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if time.Since(started) > 5*time.Second {
+		t.Fatalf("Expected command to be killed, took %v", time.Since(started))
+	}
+}
+
+func TestParseExecCommands(t *testing.T) {
+	commands, err := ParseExecCommands("resize=python3 resize.py ; transcode=./transcode --fast;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 2 || strings.Join(commands["resize"], " ") != "python3 resize.py" || strings.Join(commands["transcode"], " ") != "./transcode --fast" {
+		t.Fatalf("Unexpected commands %v", commands)
+	}
+	if _, err = ParseExecCommands("resize="); err == nil {
+		t.Fatal("Expected empty command to be rejected")
+	}
+}
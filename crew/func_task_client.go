@@ -0,0 +1,88 @@
+package crew
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+// TaskFunc executes a task in-process, it is called just like TaskClient.Post.
+type TaskFunc func(ctx context.Context, task *Task, parents []*Task) (response WorkerResponse, err error)
+
+// FuncTaskClient executes tasks by calling Go functions registered for each worker, for workers that are embedded
+// in the same process as crew.  A panic in a function fails the attempt (it is retried like any other error).
+type FuncTaskClient struct {
+	// Fallback executes tasks for workers that have no registered function, those tasks fail when it is nil.
+	Fallback TaskClient
+	funcs    map[string]TaskFunc
+	mutex    sync.RWMutex
+}
+
+// NewFuncTaskClient creates a new FuncTaskClient, fallback may be nil.
+func NewFuncTaskClient(fallback TaskClient) *FuncTaskClient {
+	client := FuncTaskClient{
+		Fallback: fallback,
+		funcs:    make(map[string]TaskFunc),
+	}
+	return &client
+}
+
+// Register sets the function that executes a worker's tasks.
+func (client *FuncTaskClient) Register(worker string, fn TaskFunc) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.funcs[worker] = fn
+}
+
+func (client *FuncTaskClient) find(worker string) (fn TaskFunc, found bool) {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	fn, found = client.funcs[worker]
+	return fn, found
+}
+
+// Post calls the function registered for the task's worker (or the fallback client).
+func (client *FuncTaskClient) Post(ctx context.Context, task *Task, parents []*Task) (response WorkerResponse, err error) {
+	fn, found := client.find(task.Worker)
+	if !found {
+		if client.Fallback != nil {
+			return client.Fallback.Post(ctx, task, parents)
+		}
+		return WorkerResponse{}, &WorkerError{
+			Message:   "No function registered for worker: " + task.Worker,
+			Retryable: false,
+		}
+	}
+
+	workerUrl := "func://" + task.Worker
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Println("Worker function panicked", task.Id, recovered, string(debug.Stack()))
+			response = WorkerResponse{WorkerUrl: workerUrl}
+			err = &WorkerError{
+				Message:   fmt.Sprintf("Worker function panicked: %v", recovered),
+				Retryable: true,
+			}
+		}
+	}()
+
+	response, err = fn(ctx, task, parents)
+	if response.WorkerUrl == "" {
+		response.WorkerUrl = workerUrl
+	}
+	return response, err
+}
+
+// Cancel passes cancels for workers without a registered function on to the fallback client.
+// Registered functions see cancels through their ctx.
+func (client *FuncTaskClient) Cancel(ctx context.Context, task *Task) (err error) {
+	if _, found := client.find(task.Worker); found {
+		return nil
+	}
+	if canceler, ok := client.Fallback.(TaskCanceler); ok {
+		return canceler.Cancel(ctx, task)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package crew
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFuncTaskClient(t *testing.T) {
+	fallback := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		return WorkerResponse{Output: "fallback"}, nil
+	}}
+	client := NewFuncTaskClient(fallback)
+	client.Register("worker-a", func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		return WorkerResponse{Output: task.Input}, nil
+	})
+	client.Register("worker-b", func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		var input map[string]interface{}
+		// Nil map write
+		input["oops"] = true
+		return WorkerResponse{}, nil
+	})
+
+	task := NewTask()
+	task.Id = "task148"
+	task.Worker = "worker-a"
+	task.Input = "hello"
+	response, err := client.Post(context.Background(), task, nil)
+	if err != nil || response.Output != "hello" || response.WorkerUrl != "func://worker-a" {
+		t.Fatalf("Unexpected response %+v %v", response, err)
+	}
+
+	task.Worker = "worker-b"
+	_, err = client.Post(context.Background(), task, nil)
+	var workerErr *WorkerError
+	if !errors.As(err, &workerErr) || !workerErr.Retryable {
+		t.Fatalf("Expected panic to become a retryable error, got %v", err)
+	}
+
+	task.Worker = "worker-c"
+	response, err = client.Post(context.Background(), task, nil)
+	if err != nil || response.Output != "fallback" {
+		t.Fatalf("Expected fallback response, got %+v %v", response, err)
+	}
+
+	client.Fallback = nil
+	_, err = client.Post(context.Background(), task, nil)
+	if err == nil || IsRetryableError(err) {
+		t.Fatalf("Expected unregistered worker to fail permanently, got %v", err)
+	}
+}
+
+func TestExecuteFuncTaskPanic(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	client := NewFuncTaskClient(nil)
+	client.Register("worker-a", func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		panic("boom")
+	})
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+	// Keep the retry from being executed while the test waits on Pending
+	controller.Dispatcher = &recordingDispatcher{}
+
+	task := NewTask()
+	task.Id = "task149"
+	task.TaskGroupId = "group19"
+	task.Name = "task149"
+	task.Worker = "worker-a"
+	task.RemainingAttempts = 2
+	storage.SaveTask(task, true)
+
+	controller.Execute(context.Background(), task)
+	controller.Pending.Wait()
+
+	found, _ := storage.FindTask("task149")
+	if found.Status != TaskStatusScheduled || found.RemainingAttempts != 1 {
+		t.Fatalf("Expected task to be rescheduled, got %v %v", found.Status, found.RemainingAttempts)
+	}
+	if len(found.Errors) != 1 || found.Errors[0] != "Worker function panicked: boom" {
+		t.Fatalf("Expected panic to be recorded as an error, got %v", found.Errors)
+	}
+}
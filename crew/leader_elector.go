@@ -0,0 +1,27 @@
+package crew
+
+// LeaderElector decides which crew instance runs cluster wide jobs such as the abandoned task scan.
+type LeaderElector interface {
+	// TryAcquireLeadership returns true if this instance is the leader, leaders should call it periodically to keep their lease.
+	TryAcquireLeadership() (isLeader bool, err error)
+	// ReleaseLeadership gives up leadership so that another instance can take over right away.
+	ReleaseLeadership() (err error)
+}
+
+// LocalLeaderElector is always the leader (single host systems).
+type LocalLeaderElector struct{}
+
+// NewLocalLeaderElector creates a new LocalLeaderElector.
+func NewLocalLeaderElector() *LocalLeaderElector {
+	return &LocalLeaderElector{}
+}
+
+// TryAcquireLeadership always returns true.
+func (elector *LocalLeaderElector) TryAcquireLeadership() (isLeader bool, err error) {
+	return true, nil
+}
+
+// ReleaseLeadership does nothing for a local elector.
+func (elector *LocalLeaderElector) ReleaseLeadership() (err error) {
+	return nil
+}
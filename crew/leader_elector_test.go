@@ -0,0 +1,73 @@
+package crew
+
+import (
+	"testing"
+)
+
+// stubLeaderElector reports a fixed leadership state and counts how often it was asked.
+type stubLeaderElector struct {
+	isLeader bool
+	asked    int
+	released bool
+}
+
+func (elector *stubLeaderElector) TryAcquireLeadership() (isLeader bool, err error) {
+	elector.asked++
+	return elector.isLeader, nil
+}
+
+func (elector *stubLeaderElector) ReleaseLeadership() (err error) {
+	elector.released = true
+	return nil
+}
+
+func TestLocalLeaderElector(t *testing.T) {
+	elector := NewLocalLeaderElector()
+	isLeader, err := elector.TryAcquireLeadership()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isLeader {
+		t.Fatal("Expected local elector to always be the leader")
+	}
+}
+
+func TestAbandonedScanRequiresLeadership(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	controller := NewTaskController(storage, &stubTaskClient{}, nil)
+	controller.Feed = nil
+	controller.AbandonedCheckTaskPause = 0
+	controller.AbandonedCheckGroupPause = 0
+	dispatcher := &recordingDispatcher{}
+	controller.Dispatcher = dispatcher
+	elector := &stubLeaderElector{isLeader: false}
+	controller.LeaderElector = elector
+
+	group := NewTaskGroup("group10", "group10")
+	storage.SaveTaskGroup(group, true)
+	task := NewTask()
+	task.Id = "task74"
+	task.TaskGroupId = "group10"
+	task.Name = "task74"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+
+	controller.ScanForAbandonedTasks()
+	if elector.asked != 1 {
+		t.Fatalf("Expected leadership to be checked once, got %v", elector.asked)
+	}
+	if len(dispatcher.dispatched) != 0 {
+		t.Fatalf("Expected no evaluations from a follower, got %v", dispatcher.dispatched)
+	}
+
+	elector.isLeader = true
+	controller.ScanForAbandonedTasks()
+	if elector.asked != 3 {
+		t.Fatalf("Expected leadership to be renewed after each group, got %v checks", elector.asked)
+	}
+
+	controller.Shutdown()
+	if !elector.released {
+		t.Fatal("Expected leadership to be released on shutdown")
+	}
+}
@@ -0,0 +1,22 @@
+package crew
+
+import (
+	"context"
+)
+
+// PullTaskClient leaves tasks for their workers to lease with POST /api/v1/lease, for workers that crew can't call
+// (behind NAT, batch clusters, etc).  Leased tasks are treated like tasks accepted by an async worker, workers report
+// the result to POST /api/v1/task/:task_id/complete with the payload's completionToken.
+// Queued tasks are kept in the task storage so that workers can lease them from any instance.
+type PullTaskClient struct{}
+
+// NewPullTaskClient creates a new PullTaskClient.
+func NewPullTaskClient() *PullTaskClient {
+	client := PullTaskClient{}
+	return &client
+}
+
+// Post queues the task for its worker, the task waits in storage for the worker to lease it (see TaskController.LeaseTasks).
+func (client *PullTaskClient) Post(ctx context.Context, task *Task, parents []*Task) (response WorkerResponse, err error) {
+	return WorkerResponse{Async: true, Queued: true}, nil
+}
@@ -0,0 +1,133 @@
+package crew
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestPullWorkerLeasesAndCompletesTasks(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	controller := NewTaskController(storage, NewPullTaskClient(), NewWorkerThrottler(map[string]int{"worker-a": 1}))
+	controller.Feed = nil
+	controller.CallbackSigningSecrets = nil
+	// Keep the evaluations triggered by completions from executing tasks behind the test's back
+	controller.Dispatcher = &recordingDispatcher{}
+	e := echo.New()
+	inShutdown := false
+	allow := func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	BuildRestApi(e, "", controller, allow, nil, &inShutdown, make(map[string]TaskGroupWatcher))
+
+	post := func(path string, token string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("X-Crew-Completion-Token", token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	lease := func() []WorkerPayload {
+		t.Helper()
+		rec := post("/api/v1/lease?worker=worker-a&max=5", "", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected lease to succeed, got %v %v", rec.Code, rec.Body.String())
+		}
+		leased := struct {
+			Tasks []WorkerPayload `json:"tasks"`
+		}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &leased); err != nil {
+			t.Fatal(err)
+		}
+		return leased.Tasks
+	}
+	waitForQueued := func(id string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			found, _ := storage.FindTask(id)
+			if found != nil && found.AwaitingLease {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %v to be queued", id)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	for _, id := range []string{"task200", "task201"} {
+		task := NewTask()
+		task.Id = id
+		task.TaskGroupId = "group23"
+		task.Name = id
+		task.Worker = "worker-a"
+		task.Input = map[string]interface{}{"id": id}
+		storage.SaveTask(task, true)
+		controller.Execute(context.Background(), task)
+		if id == "task200" {
+			waitForQueued(id)
+		}
+	}
+
+	// Evaluating the queued task again must not queue it a second time or change its token
+	queued, _ := storage.FindTask("task200")
+	token := queued.LeaseToken
+	controller.Evaluate(context.Background(), queued)
+	controller.Execute(context.Background(), queued)
+
+	leased := lease()
+	if len(leased) != 1 || leased[0].TaskId != "task200" {
+		t.Fatalf("Expected to lease only task200, got %+v", leased)
+	}
+	if leased[0].CompletionToken == token {
+		t.Fatal("Expected the lease to rotate the completion token")
+	}
+	if again := lease(); len(again) != 0 {
+		t.Fatalf("Expected nothing left to lease, got %+v", again)
+	}
+
+	// task201 waits for the worker's only throttler slot until task200 is done
+	if waiting, _ := storage.FindTask("task201"); waiting.Status == TaskStatusRunning {
+		t.Fatal("Expected task201 to wait for the throttler while task200 is leased")
+	}
+
+	completionToken := leased[0].CompletionToken
+	if rec := post("/api/v1/task/task200/heartbeat", completionToken, `{"progress": 50, "message": "halfway"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected heartbeat to succeed, got %v %v", rec.Code, rec.Body.String())
+	}
+	if working, _ := storage.FindTask("task200"); working.Progress != 50 {
+		t.Fatalf("Expected heartbeat to record progress, got %v", working.Progress)
+	}
+	if rec := post("/api/v1/task/task200/complete", "wrong-token", `{"output": "done"}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected completion with the wrong token to be rejected, got %v", rec.Code)
+	}
+	if rec := post("/api/v1/task/task200/complete", completionToken, `{"output": "done"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected completion to succeed, got %v %v", rec.Code, rec.Body.String())
+	}
+	completed, _ := storage.FindTask("task200")
+	if completed.Status != TaskStatusSucceeded || completed.Output != "done" {
+		t.Fatalf("Expected task200 to succeed with the worker's output, got %v %v", completed.Status, completed.Output)
+	}
+
+	// Completing task200 gave its slot to task201
+	waitForQueued("task201")
+	leased = lease()
+	if len(leased) != 1 || leased[0].TaskId != "task201" {
+		t.Fatalf("Expected to lease task201, got %+v", leased)
+	}
+	if payload, ok := leased[0].Input.(map[string]interface{}); !ok || payload["id"] != "task201" {
+		t.Fatalf("Expected task201's input in the payload, got %+v", leased[0].Input)
+	}
+	if rec := post("/api/v1/task/task201/complete", leased[0].CompletionToken, `{"output": "done"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected completion to succeed, got %v %v", rec.Code, rec.Body.String())
+	}
+	controller.Pending.Wait()
+}
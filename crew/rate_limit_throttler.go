@@ -0,0 +1,221 @@
+package crew
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A RateLimit allows Tokens task executions per Interval.  Burst is how many executions can happen back to back after
+// a quiet period (defaults to Tokens).  A RateLimit without Tokens or Interval is unlimited.
+type RateLimit struct {
+	Tokens   int
+	Interval time.Duration
+	Burst    int
+}
+
+func (limit RateLimit) unlimited() bool {
+	return limit.Tokens <= 0 || limit.Interval <= 0
+}
+
+func (limit RateLimit) capacity() float64 {
+	if limit.Burst > 0 {
+		return float64(limit.Burst)
+	}
+	return float64(limit.Tokens)
+}
+
+// tokenBucket tracks the tokens available to one worker/workgroup.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	pending []ThrottlePushQuery
+}
+
+// refill adds the tokens earned since the bucket was last updated.
+func (bucket *tokenBucket) refill(limit RateLimit, now time.Time) {
+	perSecond := float64(limit.Tokens) / limit.Interval.Seconds()
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * perSecond
+	if bucket.tokens > limit.capacity() {
+		bucket.tokens = limit.capacity()
+	}
+	bucket.updated = now
+}
+
+// nextToken returns how long until the bucket has a whole token.
+func (bucket *tokenBucket) nextToken(limit RateLimit) time.Duration {
+	if bucket.tokens >= 1 {
+		return 0
+	}
+	perSecond := float64(limit.Tokens) / limit.Interval.Seconds()
+	return time.Duration((1 - bucket.tokens) / perSecond * float64(time.Second))
+}
+
+// NewWorkerRateLimitThrottler creates a throttler that limits how often tasks start for each worker.
+// Workers that aren't in limits use limits["*"], workers without a limit are not throttled.
+func NewWorkerRateLimitThrottler(limits map[string]RateLimit) *Throttler {
+	return NewRateLimitThrottler(func(taskId string, worker string, workgroup string) string {
+		return worker
+	}, rateLimitLookup(limits))
+}
+
+// NewWorkgroupRateLimitThrottler creates a throttler that limits how often tasks start for each workgroup.
+// Workgroups that aren't in limits use limits["*"], tasks without a workgroup are not throttled.
+func NewWorkgroupRateLimitThrottler(limits map[string]RateLimit) *Throttler {
+	lookup := rateLimitLookup(limits)
+	return NewRateLimitThrottler(func(taskId string, worker string, workgroup string) string {
+		return workgroup
+	}, func(key string) RateLimit {
+		if key == "" {
+			return RateLimit{}
+		}
+		return lookup(key)
+	})
+}
+
+// NewRateLimitThrottler creates a token bucket throttler that groups tasks with keyFor and lets tasks in each group
+// start at the rate given by limitFor(key).  Tasks that have to wait are released highest priority first, then in the
+// order they arrived.
+// Rate limits only control when tasks start, combine with a concurrency throttler (see ChainThrottlers) to also limit
+// how many run at once.
+func NewRateLimitThrottler(keyFor func(taskId string, worker string, workgroup string) string, limitFor func(key string) RateLimit) *Throttler {
+	throttler := &Throttler{
+		Push: make(chan ThrottlePushQuery, 8),
+		Pop:  make(chan ThrottlePopQuery, 8),
+	}
+
+	go func() {
+		buckets := make(map[string]*tokenBucket)
+		timer := time.NewTimer(time.Hour)
+
+		// release spends tokens on waiting tasks and schedules the timer for the next task that has to wait
+		release := func() {
+			now := time.Now()
+			wait := time.Duration(-1)
+			for key, bucket := range buckets {
+				limit := limitFor(key)
+				bucket.refill(limit, now)
+				for len(bucket.pending) > 0 && bucket.tokens >= 1 {
+					bucket.tokens--
+					bucket.pending[0].Resp <- true
+					bucket.pending = bucket.pending[1:]
+				}
+				if len(bucket.pending) > 0 {
+					if next := bucket.nextToken(limit); wait < 0 || next < wait {
+						wait = next
+					}
+				} else if bucket.tokens >= limit.capacity() {
+					// A full bucket is the same as a new one
+					delete(buckets, key)
+				}
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			if wait >= 0 {
+				timer.Reset(wait)
+			}
+		}
+
+		for {
+			select {
+			case pushQuery := <-throttler.Push:
+				key := keyFor(pushQuery.TaskId, pushQuery.Worker, pushQuery.Workgroup)
+				limit := limitFor(key)
+				if limit.unlimited() {
+					pushQuery.Resp <- true
+					continue
+				}
+				bucket, found := buckets[key]
+				if !found {
+					bucket = &tokenBucket{tokens: limit.capacity(), updated: time.Now()}
+					buckets[key] = bucket
+				}
+				bucket.pending = enqueueByPriority(bucket.pending, pushQuery)
+				release()
+
+			case popQuery := <-throttler.Pop:
+				// Tasks that gave up while waiting (canceled or deleted) are removed from the queue
+				key := keyFor(popQuery.TaskId, popQuery.Worker, popQuery.Workgroup)
+				if bucket, found := buckets[key]; found {
+					for i, queued := range bucket.pending {
+						if queued.TaskId == popQuery.TaskId {
+							bucket.pending = append(bucket.pending[:i:i], bucket.pending[i+1:]...)
+							break
+						}
+					}
+				}
+
+			case <-timer.C:
+				release()
+			}
+		}
+	}()
+
+	return throttler
+}
+
+// rateLimitLookup returns a function that finds the rate limit for a key, falling back to the "*" entry.
+func rateLimitLookup(limits map[string]RateLimit) func(key string) RateLimit {
+	return func(key string) RateLimit {
+		if limit, found := limits[key]; found {
+			return limit
+		}
+		return limits[DefaultConcurrencyLimitKey]
+	}
+}
+
+// ParseRateLimits parses rate limits in the form "worker-a=60/1m,worker-b=5/1s:10,*=100/1m" where the optional
+// number after the colon is the burst size.
+func ParseRateLimits(value string) (limits map[string]RateLimit, err error) {
+	limits = make(map[string]RateLimit)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, errors.New("invalid rate limit: " + entry)
+		}
+		rate := strings.TrimSpace(parts[1])
+		limit := RateLimit{}
+		if colon := strings.LastIndex(rate, ":"); colon >= 0 {
+			limit.Burst, err = strconv.Atoi(rate[colon+1:])
+			if err != nil || limit.Burst < 0 {
+				return nil, errors.New("invalid rate limit: " + entry)
+			}
+			rate = rate[:colon]
+		}
+		tokensAndInterval := strings.SplitN(rate, "/", 2)
+		if len(tokensAndInterval) != 2 {
+			return nil, errors.New("invalid rate limit: " + entry)
+		}
+		limit.Tokens, err = strconv.Atoi(tokensAndInterval[0])
+		if err != nil || limit.Tokens < 0 {
+			return nil, errors.New("invalid rate limit: " + entry)
+		}
+		limit.Interval, err = time.ParseDuration(tokensAndInterval[1])
+		if err != nil || limit.Interval <= 0 {
+			return nil, errors.New("invalid rate limit: " + entry)
+		}
+		limits[strings.TrimSpace(parts[0])] = limit
+	}
+	return limits, nil
+}
+
+// RateLimitsFromEnv parses the rate limits in an env var (see ParseRateLimits).  Invalid values are logged and ignored.
+func RateLimitsFromEnv(name string) map[string]RateLimit {
+	limits, err := ParseRateLimits(os.Getenv(name))
+	if err != nil {
+		log.Println("Ignoring "+name, err)
+		return make(map[string]RateLimit)
+	}
+	return limits
+}
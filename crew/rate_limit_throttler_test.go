@@ -0,0 +1,96 @@
+package crew
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkerRateLimitThrottler(t *testing.T) {
+	throttler := NewWorkerRateLimitThrottler(map[string]RateLimit{
+		"worker-a": {Tokens: 1, Interval: 200 * time.Millisecond, Burst: 2},
+	})
+
+	first := pushThrottle(throttler, "task105", "worker-a", "")
+	second := pushThrottle(throttler, "task106", "worker-a", "")
+	third := pushThrottle(throttler, "task107", "worker-a", "")
+	fourth := pushThrottle(throttler, "task108", "worker-a", "")
+	other := pushThrottle(throttler, "task109", "worker-b", "")
+
+	// The burst runs right away, the rest wait for tokens in order
+	expectGranted(t, first)
+	expectGranted(t, second)
+	expectGranted(t, other)
+	expectWaiting(t, third)
+	expectGranted(t, third)
+	expectWaiting(t, fourth)
+
+	// Completing a task does not free up a token
+	popThrottle(throttler, "task105", "worker-a", "")
+	expectWaiting(t, fourth)
+	expectGranted(t, fourth)
+}
+
+func TestWorkgroupRateLimitThrottler(t *testing.T) {
+	throttler := NewWorkgroupRateLimitThrottler(map[string]RateLimit{
+		DefaultConcurrencyLimitKey: {Tokens: 1, Interval: time.Hour},
+	})
+
+	expectGranted(t, pushThrottle(throttler, "task110", "worker-a", "group13"))
+	waiting := pushThrottle(throttler, "task111", "worker-a", "group13")
+	expectWaiting(t, waiting)
+	expectGranted(t, pushThrottle(throttler, "task112", "worker-a", "group14"))
+	expectGranted(t, pushThrottle(throttler, "task113", "worker-a", ""))
+
+	// A task that gives up while waiting is removed from the queue
+	popThrottle(throttler, "task111", "worker-a", "group13")
+	expectWaiting(t, waiting)
+}
+
+func TestChainThrottlers(t *testing.T) {
+	throttler := ChainThrottlers(
+		NewWorkerThrottler(map[string]int{"worker-a": 1}),
+		NewWorkerRateLimitThrottler(map[string]RateLimit{"worker-a": {Tokens: 1, Interval: time.Hour, Burst: 2}}),
+	)
+
+	first := pushThrottle(throttler, "task114", "worker-a", "")
+	second := pushThrottle(throttler, "task115", "worker-a", "")
+	expectGranted(t, first)
+	expectWaiting(t, second)
+
+	// Finishing the first task frees the concurrency slot and the second task spends the last token
+	popThrottle(throttler, "task114", "worker-a", "")
+	expectGranted(t, second)
+	popThrottle(throttler, "task115", "worker-a", "")
+
+	// Out of tokens, so the next task holds the concurrency slot while it waits, until it gives up
+	third := pushThrottle(throttler, "task116", "worker-a", "")
+	expectWaiting(t, third)
+	popThrottle(throttler, "task116", "worker-a", "")
+
+	// The concurrency slot was given back (the rate limit still blocks tasks for worker-a)
+	fourth := pushThrottle(throttler, "task117", "worker-a", "")
+	expectWaiting(t, fourth)
+	expectGranted(t, pushThrottle(throttler, "task118", "worker-b", ""))
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits("worker-a=60/1m, worker-b=5/1s:10,*=100/1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits["worker-a"] != (RateLimit{Tokens: 60, Interval: time.Minute}) {
+		t.Fatalf("Unexpected limit for worker-a %v", limits["worker-a"])
+	}
+	if limits["worker-b"] != (RateLimit{Tokens: 5, Interval: time.Second, Burst: 10}) {
+		t.Fatalf("Unexpected limit for worker-b %v", limits["worker-b"])
+	}
+	if limits[DefaultConcurrencyLimitKey] != (RateLimit{Tokens: 100, Interval: time.Hour}) {
+		t.Fatalf("Unexpected default limit %v", limits[DefaultConcurrencyLimitKey])
+	}
+
+	for _, invalid := range []string{"worker-a", "worker-a=60", "worker-a=x/1m", "worker-a=60/soon", "worker-a=60/1m:x", "=60/1m"} {
+		if _, err := ParseRateLimits(invalid); err == nil {
+			t.Fatalf("Expected %v to be invalid", invalid)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package crew
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	goredislib "github.com/redis/go-redis/v9"
+)
+
+// RedisEvaluationDispatcher shares evaluation requests between crew instances via a redis stream consumer group.
+// Each request is delivered to exactly one instance.  Requests that were delivered to an instance that died before
+// acknowledging them are claimed by another instance after ClaimIdleTime.
+type RedisEvaluationDispatcher struct {
+	Client   *goredislib.Client
+	Stream   string
+	Group    string
+	Consumer string
+	// MaxLen caps the (approximate) length of the stream.
+	MaxLen int64
+	// ClaimIdleTime is how long a request can go unacknowledged before another instance takes it over.
+	ClaimIdleTime time.Duration
+	// BlockTime is how long each read waits for new requests, Stop can take this long to return.
+	BlockTime time.Duration
+
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+}
+
+// NewRedisEvaluationDispatcher creates a new RedisEvaluationDispatcher that uses the default stream and group names.
+func NewRedisEvaluationDispatcher(client *goredislib.Client) *RedisEvaluationDispatcher {
+	consumer, _ := os.Hostname()
+	dispatcher := RedisEvaluationDispatcher{
+		Client:        client,
+		Stream:        "go-crew/evaluations",
+		Group:         "go-crew",
+		Consumer:      consumer + "-" + uuid.New().String(),
+		MaxLen:        100000,
+		ClaimIdleTime: time.Minute,
+		BlockTime:     5 * time.Second,
+	}
+	return &dispatcher
+}
+
+// Dispatch adds an evaluation request to the stream.
+func (dispatcher *RedisEvaluationDispatcher) Dispatch(taskId string) (err error) {
+	return dispatcher.Client.XAdd(context.Background(), &goredislib.XAddArgs{
+		Stream: dispatcher.Stream,
+		MaxLen: dispatcher.MaxLen,
+		Approx: true,
+		Values: map[string]interface{}{"taskId": taskId},
+	}).Err()
+}
+
+// Start joins the consumer group and begins reading evaluation requests in the background.
+func (dispatcher *RedisEvaluationDispatcher) Start(handler func(taskId string)) (err error) {
+	groupErr := dispatcher.Client.XGroupCreateMkStream(context.Background(), dispatcher.Stream, dispatcher.Group, "$").Err()
+	if groupErr != nil && !strings.HasPrefix(groupErr.Error(), "BUSYGROUP") {
+		return groupErr
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dispatcher.cancel = cancel
+	dispatcher.done.Add(1)
+	go func() {
+		defer dispatcher.done.Done()
+		lastClaim := time.Time{}
+		for ctx.Err() == nil {
+			// Take over requests abandoned by instances that went away
+			if time.Since(lastClaim) > dispatcher.ClaimIdleTime {
+				lastClaim = time.Now()
+				claimed, _, claimErr := dispatcher.Client.XAutoClaim(ctx, &goredislib.XAutoClaimArgs{
+					Stream:   dispatcher.Stream,
+					Group:    dispatcher.Group,
+					Consumer: dispatcher.Consumer,
+					MinIdle:  dispatcher.ClaimIdleTime,
+					Start:    "0-0",
+					Count:    100,
+				}).Result()
+				if claimErr != nil && ctx.Err() == nil {
+					log.Println("Error claiming abandoned evaluations", claimErr)
+				}
+				dispatcher.handle(ctx, claimed, handler)
+			}
+
+			streams, readErr := dispatcher.Client.XReadGroup(ctx, &goredislib.XReadGroupArgs{
+				Group:    dispatcher.Group,
+				Consumer: dispatcher.Consumer,
+				Streams:  []string{dispatcher.Stream, ">"},
+				Count:    10,
+				Block:    dispatcher.BlockTime,
+			}).Result()
+			if readErr != nil {
+				if !errors.Is(readErr, goredislib.Nil) && ctx.Err() == nil {
+					log.Println("Error reading evaluations", readErr)
+					time.Sleep(time.Second)
+				}
+				continue
+			}
+			for _, stream := range streams {
+				dispatcher.handle(ctx, stream.Messages, handler)
+			}
+		}
+	}()
+	return nil
+}
+
+func (dispatcher *RedisEvaluationDispatcher) handle(ctx context.Context, messages []goredislib.XMessage, handler func(taskId string)) {
+	for _, message := range messages {
+		if taskId, ok := message.Values["taskId"].(string); ok {
+			handler(taskId)
+		}
+		// Acknowledge even if the handler failed, the abandoned task scan will catch anything that was missed
+		dispatcher.Client.XAck(ctx, dispatcher.Stream, dispatcher.Group, message.ID)
+	}
+}
+
+// Stop stops reading evaluation requests and waits for the current batch to finish.
+func (dispatcher *RedisEvaluationDispatcher) Stop() (err error) {
+	if dispatcher.cancel != nil {
+		dispatcher.cancel()
+		dispatcher.done.Wait()
+		dispatcher.cancel = nil
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package crew
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	goredislib "github.com/redis/go-redis/v9"
+)
+
+// evaluationRecorder collects the task ids handled by each dispatcher.
+type evaluationRecorder struct {
+	handled map[string][]string
+	mutex   sync.Mutex
+}
+
+func (recorder *evaluationRecorder) handler(instance string) func(taskId string) {
+	return func(taskId string) {
+		recorder.mutex.Lock()
+		defer recorder.mutex.Unlock()
+		recorder.handled[instance] = append(recorder.handled[instance], taskId)
+	}
+}
+
+// waitFor waits until count tasks were handled in total.
+func (recorder *evaluationRecorder) waitFor(t *testing.T, count int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		recorder.mutex.Lock()
+		total := 0
+		for _, taskIds := range recorder.handled {
+			total += len(taskIds)
+		}
+		recorder.mutex.Unlock()
+		if total >= count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %v evaluations, got %v", count, total)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestRedisEvaluationDispatcher(t *testing.T, addr string, consumer string) *RedisEvaluationDispatcher {
+	client := goredislib.NewClient(&goredislib.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+	dispatcher := NewRedisEvaluationDispatcher(client)
+	dispatcher.Consumer = consumer
+	dispatcher.BlockTime = 100 * time.Millisecond
+	return dispatcher
+}
+
+func TestRedisEvaluationDispatcher(t *testing.T) {
+	server, _ := newTestRedis(t)
+	instanceA := newTestRedisEvaluationDispatcher(t, server.Addr(), "instance-a")
+	instanceB := newTestRedisEvaluationDispatcher(t, server.Addr(), "instance-b")
+	recorder := &evaluationRecorder{handled: make(map[string][]string)}
+
+	// Requests dispatched by an instance that isn't reading reach the ones that are
+	if err := instanceB.Start(recorder.handler("instance-b")); err != nil {
+		t.Fatal(err)
+	}
+	defer instanceB.Stop()
+	instanceA.Dispatch("task166")
+	recorder.waitFor(t, 1)
+	if len(recorder.handled["instance-b"]) != 1 || recorder.handled["instance-b"][0] != "task166" {
+		t.Fatalf("Expected instance-b to evaluate task166, got %v", recorder.handled)
+	}
+
+	// With both instances reading, every request is evaluated exactly once
+	if err := instanceA.Start(recorder.handler("instance-a")); err != nil {
+		t.Fatal(err)
+	}
+	defer instanceA.Stop()
+	taskIds := []string{}
+	for i := 0; i < 20; i++ {
+		taskId := fmt.Sprintf("evaluate-%d", i)
+		taskIds = append(taskIds, taskId)
+		if i%2 == 0 {
+			instanceA.Dispatch(taskId)
+		} else {
+			instanceB.Dispatch(taskId)
+		}
+	}
+	recorder.waitFor(t, 21)
+	// Give duplicate deliveries a chance to show up
+	time.Sleep(100 * time.Millisecond)
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	counts := make(map[string]int)
+	for _, handled := range recorder.handled {
+		for _, taskId := range handled {
+			counts[taskId]++
+		}
+	}
+	for _, taskId := range taskIds {
+		if counts[taskId] != 1 {
+			t.Fatalf("Expected %v to be evaluated once, got %v", taskId, counts[taskId])
+		}
+	}
+}
+
+func TestRedisEvaluationDispatcherClaimsAbandonedRequests(t *testing.T) {
+	server, client := newTestRedis(t)
+	dead := newTestRedisEvaluationDispatcher(t, server.Addr(), "instance-dead")
+	if err := client.XGroupCreateMkStream(context.Background(), dead.Stream, dead.Group, "$").Err(); err != nil {
+		t.Fatal(err)
+	}
+	dead.Dispatch("task167")
+
+	// An instance reads the request and dies before acknowledging it
+	streams, err := client.XReadGroup(context.Background(), &goredislib.XReadGroupArgs{
+		Group:    dead.Group,
+		Consumer: dead.Consumer,
+		Streams:  []string{dead.Stream, ">"},
+		Count:    10,
+	}).Result()
+	if err != nil || len(streams) != 1 || len(streams[0].Messages) != 1 {
+		t.Fatalf("Expected to read the request, got %v %v", streams, err)
+	}
+
+	live := newTestRedisEvaluationDispatcher(t, server.Addr(), "instance-live")
+	live.ClaimIdleTime = 50 * time.Millisecond
+	time.Sleep(2 * live.ClaimIdleTime)
+
+	recorder := &evaluationRecorder{handled: make(map[string][]string)}
+	if err := live.Start(recorder.handler("instance-live")); err != nil {
+		t.Fatal(err)
+	}
+	defer live.Stop()
+	recorder.waitFor(t, 1)
+	if recorder.handled["instance-live"][0] != "task167" {
+		t.Fatalf("Expected abandoned task167 to be claimed, got %v", recorder.handled)
+	}
+
+	pending, err := client.XPending(context.Background(), live.Stream, live.Group).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Count != 0 {
+		t.Fatalf("Expected claimed request to be acknowledged, %v pending", pending.Count)
+	}
+}
@@ -0,0 +1,70 @@
+package crew
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	goredislib "github.com/redis/go-redis/v9"
+)
+
+// renewLeaseScript extends the lease only if it is still held by this instance.
+var renewLeaseScript = goredislib.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// releaseLeaseScript deletes the lease only if it is still held by this instance.
+var releaseLeaseScript = goredislib.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// RedisLeaderElector elects a leader by holding an expiring key in redis.
+// If the leader goes away its lease expires and the next instance to ask becomes leader.
+type RedisLeaderElector struct {
+	Client *goredislib.Client
+	Key    string
+	Id     string
+	// LeaseDuration should be longer than the interval at which the leader calls TryAcquireLeadership.
+	LeaseDuration time.Duration
+}
+
+// NewRedisLeaderElector creates a new RedisLeaderElector.
+func NewRedisLeaderElector(client *goredislib.Client, leaseDuration time.Duration) *RedisLeaderElector {
+	hostname, _ := os.Hostname()
+	elector := RedisLeaderElector{
+		Client:        client,
+		Key:           "go-crew/leader",
+		Id:            hostname + "-" + uuid.New().String(),
+		LeaseDuration: leaseDuration,
+	}
+	return &elector
+}
+
+// TryAcquireLeadership takes the lease if nobody holds it, or renews it if this instance already does.
+func (elector *RedisLeaderElector) TryAcquireLeadership() (isLeader bool, err error) {
+	ctx := context.Background()
+	acquired, err := elector.Client.SetNX(ctx, elector.Key, elector.Id, elector.LeaseDuration).Result()
+	if err != nil {
+		return false, err
+	}
+	if acquired {
+		return true, nil
+	}
+
+	renewed, err := renewLeaseScript.Run(ctx, elector.Client, []string{elector.Key}, elector.Id, elector.LeaseDuration.Milliseconds()).Int()
+	if err != nil && !errors.Is(err, goredislib.Nil) {
+		return false, err
+	}
+	return renewed == 1, nil
+}
+
+// ReleaseLeadership deletes the lease if this instance holds it.
+func (elector *RedisLeaderElector) ReleaseLeadership() (err error) {
+	return releaseLeaseScript.Run(context.Background(), elector.Client, []string{elector.Key}, elector.Id).Err()
+}
@@ -0,0 +1,63 @@
+package crew
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRedisLeaderElector(t *testing.T) {
+	server, client := newTestRedis(t)
+	instanceA := NewRedisLeaderElector(client, 10*time.Second)
+	instanceA.Id = "instance-a"
+	instanceB := NewRedisLeaderElector(client, 10*time.Second)
+	instanceB.Id = "instance-b"
+
+	// The first instance to ask becomes leader
+	isLeader, err := instanceA.TryAcquireLeadership()
+	if err != nil || !isLeader {
+		t.Fatalf("Expected instance-a to acquire leadership, got %v %v", isLeader, err)
+	}
+	isLeader, err = instanceB.TryAcquireLeadership()
+	if err != nil || isLeader {
+		t.Fatalf("Expected instance-b not to be leader, got %v %v", isLeader, err)
+	}
+
+	// Asking again renews the lease
+	server.FastForward(8 * time.Second)
+	isLeader, err = instanceA.TryAcquireLeadership()
+	if err != nil || !isLeader {
+		t.Fatalf("Expected instance-a to renew leadership, got %v %v", isLeader, err)
+	}
+	if ttl := server.TTL(instanceA.Key); ttl != 10*time.Second {
+		t.Fatalf("Expected renewed lease to last 10s, got %v", ttl)
+	}
+	server.FastForward(8 * time.Second)
+	if isLeader, _ = instanceB.TryAcquireLeadership(); isLeader {
+		t.Fatal("Expected renewed lease to still be held by instance-a")
+	}
+
+	// A leader that stops renewing loses the lease once it expires
+	server.FastForward(3 * time.Second)
+	isLeader, err = instanceB.TryAcquireLeadership()
+	if err != nil || !isLeader {
+		t.Fatalf("Expected instance-b to take over an expired lease, got %v %v", isLeader, err)
+	}
+	if isLeader, _ = instanceA.TryAcquireLeadership(); isLeader {
+		t.Fatal("Expected instance-a to have lost leadership")
+	}
+
+	// Releasing hands leadership over right away, and only the holder can release it
+	if err = instanceA.ReleaseLeadership(); err != nil {
+		t.Fatal(err)
+	}
+	if holder, _ := server.Get(instanceA.Key); holder != "instance-b" {
+		t.Fatalf("Expected instance-b to still hold the lease, got %v", holder)
+	}
+	if err = instanceB.ReleaseLeadership(); err != nil {
+		t.Fatal(err)
+	}
+	isLeader, err = instanceA.TryAcquireLeadership()
+	if err != nil || !isLeader {
+		t.Fatalf("Expected instance-a to acquire released leadership, got %v %v", isLeader, err)
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -53,6 +53,11 @@ func (storage *RedisTaskStorage) TaskMutexKey(taskId string) string {
 	return "go-crew/tasks/" + taskId + "/mutex"
 }
 
+// AwaitingLeaseKey returns the key of the set of a worker's tasks that are waiting to be leased.
+func (storage *RedisTaskStorage) AwaitingLeaseKey(worker string) string {
+	return "go-crew/awaiting-lease/" + worker
+}
+
 // TaskGroupKey returns the key for a task group.
 func (storage *RedisTaskStorage) TaskGroupKey(taskGroupId string) string {
 	return storage.TaskGroupsPrefix() + taskGroupId
@@ -79,17 +84,7 @@ func (storage *RedisTaskStorage) GetExpiration() time.Duration {
 }
 
 func (storage *RedisTaskStorage) GetLockExpiration() time.Duration {
-	taskLockExpiration := time.Duration(10 * time.Minute)
-
-	taskLockExpirationEnv := os.Getenv("CREW_TASK_LOCK_EXPIRATION")
-	if taskLockExpirationEnv != "" {
-		taskLockExpirationEnvParsed, taskLockExpirationErr := time.ParseDuration(taskLockExpirationEnv)
-		if taskLockExpirationErr == nil {
-			taskLockExpiration = taskLockExpirationEnvParsed
-		}
-	}
-
-	return taskLockExpiration
+	return lockExpirationFromEnv()
 }
 
 // SaveTask saves a task.
@@ -99,7 +94,7 @@ func (storage *RedisTaskStorage) SaveTask(task *Task, create bool) (err error) {
 	}
 	key := storage.TaskKey(task.Id)
 
-	taskJson, jsonErr := json.Marshal(task)
+	taskJson, jsonErr := marshalStoredTask(task)
 	if jsonErr != nil {
 		return jsonErr
 	}
@@ -122,42 +117,129 @@ func (storage *RedisTaskStorage) SaveTask(task *Task, create bool) (err error) {
 		}
 
 		if create {
-			// Add task to taskGroup index
-			tasksIdxErr := storage.Client.LPush(context.Background(), storage.TaskGroupKey(task.TaskGroupId)+"/tasks", task.Id).Err()
-			if tasksIdxErr != nil {
-				return tasksIdxErr
+			indexErr := storage.addTaskToIndexes(context.Background(), storage.Client, task)
+			if indexErr != nil {
+				return indexErr
 			}
+		}
+		return storage.updateAwaitingLeaseIndex(context.Background(), storage.Client, task)
+	} else {
+		return errors.New("cannot overwrite existing task")
+	}
+}
 
-			// Add task to task key index
-			if task.Key != "" {
-				tasksKeyIdxErr := storage.Client.LPush(context.Background(), "go-crew/keys/"+task.Key, task.Id).Err()
-				if tasksKeyIdxErr != nil {
-					return tasksKeyIdxErr
-				}
-			}
+// addTaskToIndexes adds a newly created task to the task group, key, workgroup and parent indexes.
+func (storage *RedisTaskStorage) addTaskToIndexes(ctx context.Context, cmd goredislib.Cmdable, task *Task) (err error) {
+	// Add task to taskGroup index
+	tasksIdxErr := cmd.LPush(ctx, storage.TaskGroupKey(task.TaskGroupId)+"/tasks", task.Id).Err()
+	if tasksIdxErr != nil {
+		return tasksIdxErr
+	}
+
+	// Add task to task key index
+	if task.Key != "" {
+		tasksKeyIdxErr := cmd.LPush(ctx, "go-crew/keys/"+task.Key, task.Id).Err()
+		if tasksKeyIdxErr != nil {
+			return tasksKeyIdxErr
+		}
+	}
+
+	// Add task to workgroup index
+	if task.Workgroup != "" {
+		tasksWorkgroupIdxErr := cmd.LPush(ctx, "go-crew/workgroups/"+task.Workgroup, task.Id).Err()
+		if tasksWorkgroupIdxErr != nil {
+			return tasksWorkgroupIdxErr
+		}
+	}
+
+	// Add task to parent's children list
+	for _, parentId := range task.ParentIds {
+		tasksParentIdxErr := cmd.LPush(ctx, storage.TaskKey(parentId)+"/children", task.Id).Err()
+		if tasksParentIdxErr != nil {
+			return tasksParentIdxErr
+		}
+	}
+	return nil
+}
 
-			// Add task to workgroup index
-			if task.Workgroup != "" {
-				tasksWorkgroupIdxErr := storage.Client.LPush(context.Background(), "go-crew/workgroups/"+task.Workgroup, task.Id).Err()
-				if tasksWorkgroupIdxErr != nil {
-					return tasksWorkgroupIdxErr
-				}
+// updateAwaitingLeaseIndex adds a task to its worker's awaiting lease set while it waits to be leased and removes it otherwise.
+func (storage *RedisTaskStorage) updateAwaitingLeaseIndex(ctx context.Context, cmd goredislib.Cmdable, task *Task) (err error) {
+	if task.Status == TaskStatusRunning && task.AwaitingLease {
+		return cmd.SAdd(ctx, storage.AwaitingLeaseKey(task.Worker), task.Id).Err()
+	}
+	return cmd.SRem(ctx, storage.AwaitingLeaseKey(task.Worker), task.Id).Err()
+}
+
+// SaveTasksAtomically saves existing tasks and creates new tasks in a single MULTI/EXEC transaction.
+// Task keys are WATCHed and the transaction is retried when one of them is written in between, so that a concurrent
+// create or delete fails the whole batch.
+func (storage *RedisTaskStorage) SaveTasksAtomically(updated []*Task, created []*Task) (err error) {
+	ctx := context.Background()
+	keys := make([]string, 0, len(updated)+len(created))
+	taskJsons := make(map[*Task]string)
+	createdIds := make(map[string]bool)
+
+	for _, task := range created {
+		if task.Id == "" {
+			task.Id = uuid.New().String()
+		}
+		if createdIds[task.Id] {
+			return errors.New("task already exists: " + task.Id)
+		}
+		createdIds[task.Id] = true
+	}
+
+	for _, task := range append(append([]*Task{}, updated...), created...) {
+		taskJson, jsonErr := marshalStoredTask(task)
+		if jsonErr != nil {
+			return jsonErr
+		}
+		taskJsons[task] = string(taskJson)
+		keys = append(keys, storage.TaskKey(task.Id))
+	}
+
+	txf := func(tx *goredislib.Tx) error {
+		for _, task := range updated {
+			exists, existsErr := tx.Exists(ctx, storage.TaskKey(task.Id)).Result()
+			if existsErr != nil {
+				return existsErr
+			}
+			if exists == 0 {
+				return errors.New("task not found: " + task.Id)
 			}
+		}
+		for _, task := range created {
+			exists, existsErr := tx.Exists(ctx, storage.TaskKey(task.Id)).Result()
+			if existsErr != nil {
+				return existsErr
+			}
+			if exists != 0 {
+				return errors.New("task already exists: " + task.Id)
+			}
+		}
 
-			// Add task to parent's children list
-			if len(task.ParentIds) > 0 {
-				for _, parentId := range task.ParentIds {
-					tasksParentIdxErr := storage.Client.LPush(context.Background(), storage.TaskKey(parentId)+"/children", task.Id).Err()
-					if tasksParentIdxErr != nil {
-						return tasksParentIdxErr
-					}
-				}
+		_, pipeErr := tx.TxPipelined(ctx, func(pipe goredislib.Pipeliner) error {
+			for _, task := range updated {
+				pipe.Set(ctx, storage.TaskKey(task.Id), taskJsons[task], storage.GetExpiration())
+				storage.updateAwaitingLeaseIndex(ctx, pipe, task)
+			}
+			for _, task := range created {
+				pipe.Set(ctx, storage.TaskKey(task.Id), taskJsons[task], storage.GetExpiration())
+				storage.addTaskToIndexes(ctx, pipe, task)
+				storage.updateAwaitingLeaseIndex(ctx, pipe, task)
 			}
+			return nil
+		})
+		return pipeErr
+	}
+
+	for tries := 0; tries < 10; tries++ {
+		err = storage.Client.Watch(ctx, txf, keys...)
+		if err != goredislib.TxFailedErr {
+			break
 		}
-		return nil
-	} else {
-		return errors.New("cannot overwrite existing task")
 	}
+	return err
 }
 
 func (storage *RedisTaskStorage) FindTaskAtPath(path string) (task *Task, err error) {
@@ -165,8 +247,7 @@ func (storage *RedisTaskStorage) FindTaskAtPath(path string) (task *Task, err er
 	if readTaskErr != nil {
 		return nil, readTaskErr
 	}
-	inflatedTask := NewTask()
-	taskParseError := json.Unmarshal(taskData, &inflatedTask)
+	inflatedTask, taskParseError := unmarshalStoredTask(taskData)
 	if taskParseError != nil {
 		return nil, taskParseError
 	}
@@ -179,10 +260,57 @@ func (storage *RedisTaskStorage) FindTask(taskId string) (task *Task, err error)
 	return storage.FindTaskAtPath(key)
 }
 
+// UpdateTaskIf applies update to a task while it still has the given status and lease token.  The task's key is
+// WATCHed and the update is retried when someone else writes the task in between.
+func (storage *RedisTaskStorage) UpdateTaskIf(taskId string, status TaskStatus, leaseToken string, update func(task *Task)) (task *Task, err error) {
+	ctx := context.Background()
+	key := storage.TaskKey(taskId)
+
+	txf := func(tx *goredislib.Tx) error {
+		taskData, getErr := tx.Get(ctx, key).Bytes()
+		if getErr != nil {
+			return getErr
+		}
+		task, err = unmarshalStoredTask(taskData)
+		if err != nil {
+			return err
+		}
+		if task.Status != status || task.LeaseToken != leaseToken {
+			return ErrTaskChanged
+		}
+		update(task)
+		taskJson, jsonErr := marshalStoredTask(task)
+		if jsonErr != nil {
+			return jsonErr
+		}
+		_, pipeErr := tx.TxPipelined(ctx, func(pipe goredislib.Pipeliner) error {
+			pipe.Set(ctx, key, string(taskJson), storage.GetExpiration())
+			storage.updateAwaitingLeaseIndex(ctx, pipe, task)
+			return nil
+		})
+		return pipeErr
+	}
+
+	for tries := 0; tries < 10; tries++ {
+		err = storage.Client.Watch(ctx, txf, key)
+		if err != goredislib.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
 func (storage *RedisTaskStorage) TryLockTask(taskId string) (unlocker func() error, err error) {
 	// TODO - make lock duration configurable
 	mux := storage.RedSync.NewMutex(storage.TaskMutexKey(taskId), redsync.WithExpiry(storage.GetLockExpiration()))
 	err = mux.Lock()
+	var takenErr *redsync.ErrTaken
+	if errors.Is(err, redsync.ErrFailed) || errors.As(err, &takenErr) {
+		return nil, ErrTaskLocked
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -225,9 +353,15 @@ func (storage *RedisTaskStorage) DeleteTask(taskId string) (err error) {
 		}
 	}
 
+	// Remove from worker's awaiting lease set
+	storage.Client.SRem(context.Background(), storage.AwaitingLeaseKey(task.Worker), task.Id)
+
 	// Remove own children list
 	storage.Client.Del(context.Background(), key+"/children")
 
+	// Remove attempt history
+	storage.Client.Del(context.Background(), key+"/attempts")
+
 	// Remove task itself
 	redisErr := storage.Client.Del(context.Background(), key).Err()
 
@@ -344,6 +478,23 @@ func (storage *RedisTaskStorage) GetTasksWithKey(key string) (tasks []*Task, err
 	return storage.AllTasksInList("go-crew/keys/" + key)
 }
 
+// GetTasksAwaitingLease returns a worker's running tasks that are waiting for the worker to lease them.
+func (storage *RedisTaskStorage) GetTasksAwaitingLease(worker string) (tasks []*Task, err error) {
+	taskIds, err := storage.Client.SMembers(context.Background(), storage.AwaitingLeaseKey(worker)).Result()
+	if err != nil {
+		return nil, err
+	}
+	tasks = make([]*Task, 0)
+	for _, taskId := range taskIds {
+		// The set is updated after the task itself, so double check each task
+		task, taskErr := storage.FindTask(taskId)
+		if taskErr == nil && task.Worker == worker && task.Status == TaskStatusRunning && task.AwaitingLease {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, nil
+}
+
 // DeleteTaskGroup deletes a task group by task group id.
 func (storage *RedisTaskStorage) DeleteTaskGroup(taskGroupId string) (err error) {
 	// Delete all tasks in group
@@ -363,3 +514,81 @@ func (storage *RedisTaskStorage) DeleteTaskGroup(taskGroupId string) (err error)
 
 	return nil
 }
+
+// SaveAttempt saves an attempt, replacing any previously saved attempt with the same id.
+func (storage *RedisTaskStorage) SaveAttempt(attempt *Attempt) (err error) {
+	attemptJson, jsonErr := json.Marshal(attempt)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	return storage.Client.HSet(context.Background(), storage.TaskKey(attempt.TaskId)+"/attempts", attempt.Id, string(attemptJson)).Err()
+}
+
+// GetTaskAttempts returns a task's attempts, oldest first.
+func (storage *RedisTaskStorage) GetTaskAttempts(taskId string) (attempts []*Attempt, err error) {
+	attemptsData, readErr := storage.Client.HVals(context.Background(), storage.TaskKey(taskId)+"/attempts").Result()
+	if readErr != nil {
+		return nil, readErr
+	}
+	attempts = make([]*Attempt, 0, len(attemptsData))
+	for _, attemptData := range attemptsData {
+		attempt := Attempt{}
+		parseErr := json.Unmarshal([]byte(attemptData), &attempt)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		attempts = append(attempts, &attempt)
+	}
+	sort.Slice(attempts, func(i, j int) bool {
+		return attempts[i].Number < attempts[j].Number
+	})
+	return attempts, nil
+}
+
+// SaveWorkgroup saves a workgroup, replacing any previously saved workgroup with the same name.
+func (storage *RedisTaskStorage) SaveWorkgroup(workgroup *Workgroup) (err error) {
+	workgroupJson, jsonErr := json.Marshal(workgroup)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	// Note that go-crew/workgroups/<name> is the workgroup's task index
+	return storage.Client.HSet(context.Background(), "go-crew/workgroup-settings", workgroup.Name, string(workgroupJson)).Err()
+}
+
+// FindWorkgroup returns a workgroup with default settings if the workgroup has never been saved.
+func (storage *RedisTaskStorage) FindWorkgroup(name string) (workgroup *Workgroup, err error) {
+	workgroupData, readErr := storage.Client.HGet(context.Background(), "go-crew/workgroup-settings", name).Result()
+	if readErr == goredislib.Nil {
+		return NewWorkgroup(name), nil
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	workgroup = &Workgroup{}
+	parseErr := json.Unmarshal([]byte(workgroupData), workgroup)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return workgroup, nil
+}
+
+// AllWorkgroups returns all saved workgroups, sorted by name.
+func (storage *RedisTaskStorage) AllWorkgroups() (workgroups []*Workgroup, err error) {
+	workgroupsData, readErr := storage.Client.HVals(context.Background(), "go-crew/workgroup-settings").Result()
+	if readErr != nil {
+		return nil, readErr
+	}
+	workgroups = make([]*Workgroup, 0, len(workgroupsData))
+	for _, workgroupData := range workgroupsData {
+		workgroup := Workgroup{}
+		parseErr := json.Unmarshal([]byte(workgroupData), &workgroup)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		workgroups = append(workgroups, &workgroup)
+	}
+	sort.Slice(workgroups, func(i, j int) bool {
+		return workgroups[i].Name < workgroups[j].Name
+	})
+	return workgroups, nil
+}
@@ -0,0 +1,182 @@
+package crew
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredislib "github.com/redis/go-redis/v9"
+)
+
+// newTestRedis starts an in-memory redis server for the duration of a test.
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *goredislib.Client) {
+	server := miniredis.RunT(t)
+	client := goredislib.NewClient(&goredislib.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return server, client
+}
+
+func TestRedisSaveTasksAtomicallyPartialFailure(t *testing.T) {
+	server, _ := newTestRedis(t)
+	storage := NewRedisTaskStorage(server.Addr(), "", 0)
+
+	parent := NewTask()
+	parent.Id = "task161"
+	parent.Name = "task161"
+	parent.Worker = "worker-a"
+	storage.SaveTask(parent, true)
+
+	existing := NewTask()
+	existing.Id = "task162"
+	existing.Name = "task162"
+	existing.Worker = "worker-a"
+	storage.SaveTask(existing, true)
+
+	child1 := NewTask()
+	child1.Id = "task163"
+	child1.Name = "task163"
+	child1.Worker = "worker-a"
+	child1.Workgroup = "group-d"
+	child1.ParentIds = []string{"task161"}
+
+	// Conflicts with an existing task
+	child2 := NewTask()
+	child2.Id = "task162"
+	child2.Name = "task162 duplicate"
+	child2.Worker = "worker-a"
+	child2.ParentIds = []string{"task161"}
+
+	parent.IsComplete = true
+	err := storage.SaveTasksAtomically([]*Task{parent}, []*Task{child1, child2})
+	if err == nil {
+		t.Fatal("Expected duplicate child to fail")
+	}
+
+	_, err = storage.FindTask("task163")
+	if err == nil {
+		t.Fatal("Expected no children to be created")
+	}
+	found, _ := storage.FindTask("task161")
+	if found.IsComplete {
+		t.Fatal("Expected parent update to be rolled back")
+	}
+	duplicate, _ := storage.FindTask("task162")
+	if duplicate.Name != "task162" {
+		t.Fatalf("Expected existing task to be untouched, got %v", duplicate.Name)
+	}
+	children, _ := storage.GetTaskChildren("task161")
+	if len(children) != 0 {
+		t.Fatalf("Expected 0 children, got %v", len(children))
+	}
+	inWorkgroup, _ := storage.GetTasksInWorkgroup("group-d")
+	if len(inWorkgroup) != 0 {
+		t.Fatalf("Expected 0 tasks in workgroup, got %v", len(inWorkgroup))
+	}
+
+	// Updating a task that no longer exists fails the whole batch too
+	deleted := NewTask()
+	deleted.Id = "task164"
+	err = storage.SaveTasksAtomically([]*Task{deleted}, []*Task{child1})
+	if err == nil {
+		t.Fatal("Expected missing task update to fail")
+	}
+	_, err = storage.FindTask("task163")
+	if err == nil {
+		t.Fatal("Expected no children to be created")
+	}
+
+	// A batch without conflicts is saved
+	err = storage.SaveTasksAtomically([]*Task{parent}, []*Task{child1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, _ = storage.GetTaskChildren("task161")
+	if len(children) != 1 {
+		t.Fatalf("Expected 1 child, got %v", len(children))
+	}
+}
+
+// interferingHook runs interfere right before the first transaction is sent, to simulate a concurrent write.
+type interferingHook struct {
+	interfere func()
+}
+
+func (hook *interferingHook) DialHook(next goredislib.DialHook) goredislib.DialHook {
+	return next
+}
+
+func (hook *interferingHook) ProcessHook(next goredislib.ProcessHook) goredislib.ProcessHook {
+	return next
+}
+
+func (hook *interferingHook) ProcessPipelineHook(next goredislib.ProcessPipelineHook) goredislib.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []goredislib.Cmder) error {
+		if hook.interfere != nil {
+			interfere := hook.interfere
+			hook.interfere = nil
+			interfere()
+		}
+		return next(ctx, cmds)
+	}
+}
+
+func TestRedisSaveTasksAtomicallyRetriesConflicts(t *testing.T) {
+	server, _ := newTestRedis(t)
+	storage := NewRedisTaskStorage(server.Addr(), "", 0)
+	otherStorage := NewRedisTaskStorage(server.Addr(), "", 0)
+
+	parent := NewTask()
+	parent.Id = "task205"
+	parent.Name = "task205"
+	parent.Worker = "worker-a"
+	storage.SaveTask(parent, true)
+
+	child := NewTask()
+	child.Id = "task206"
+	child.Name = "task206"
+	child.Worker = "worker-a"
+	child.ParentIds = []string{"task205"}
+
+	// Another instance writes the parent between WATCH and EXEC
+	storage.Client.AddHook(&interferingHook{interfere: func() {
+		heartbeat := *parent
+		heartbeat.Progress = 50
+		otherStorage.SaveTask(&heartbeat, false)
+	}})
+
+	parent.IsComplete = true
+	err := storage.SaveTasksAtomically([]*Task{parent}, []*Task{child})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, _ := storage.FindTask("task205")
+	if !found.IsComplete {
+		t.Fatal("Expected parent update to be saved")
+	}
+	children, _ := storage.GetTaskChildren("task205")
+	if len(children) != 1 {
+		t.Fatalf("Expected 1 child, got %v", len(children))
+	}
+}
+
+func TestRedisLeaseTokenIsStored(t *testing.T) {
+	server, _ := newTestRedis(t)
+	storage := NewRedisTaskStorage(server.Addr(), "", 0)
+	task := NewTask()
+	task.Id = "task182"
+	task.Name = "task182"
+	task.Worker = "worker-a"
+	task.SetStatus(TaskStatusScheduled)
+	task.SetStatus(TaskStatusRunning)
+	task.AcquireLease("node-a", time.Minute)
+	storage.SaveTask(task, true)
+
+	found, err := storage.FindTask("task182")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.LeaseToken == "" || found.LeaseToken != task.LeaseToken {
+		t.Fatalf("Expected lease token to be stored, got %q", found.LeaseToken)
+	}
+}
@@ -0,0 +1,197 @@
+package crew
+
+import (
+	"context"
+	"log"
+	"time"
+
+	goredislib "github.com/redis/go-redis/v9"
+)
+
+// acquireSlotsScript takes a slot in every semaphore (KEYS) for a task, or none of them if any semaphore is full.
+// Slots are sorted set members scored by their expiry so that slots held by dead nodes free themselves.
+// ARGV: task id, lease in ms, then one limit per key.
+var acquireSlotsScript = goredislib.NewScript(`
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local lease = tonumber(ARGV[2])
+for i, key in ipairs(KEYS) do
+	redis.call("ZREMRANGEBYSCORE", key, "-inf", now)
+	if not redis.call("ZSCORE", key, ARGV[1]) and redis.call("ZCARD", key) >= tonumber(ARGV[2 + i]) then
+		return 0
+	end
+end
+for i, key in ipairs(KEYS) do
+	redis.call("ZADD", key, now + lease, ARGV[1])
+	redis.call("PEXPIRE", key, lease)
+end
+return 1`)
+
+// renewSlotsScript extends the expiry of a task's slots.  ARGV: task id, lease in ms.
+var renewSlotsScript = goredislib.NewScript(`
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local lease = tonumber(ARGV[2])
+for _, key in ipairs(KEYS) do
+	if redis.call("ZSCORE", key, ARGV[1]) then
+		redis.call("ZADD", key, now + lease, ARGV[1])
+		redis.call("PEXPIRE", key, lease)
+	end
+end
+return 1`)
+
+// RedisThrottler enforces cluster wide concurrency limits per worker and per workgroup.
+// Each limit is a counting semaphore in redis whose slots expire unless the node holding them keeps renewing them,
+// so slots held by a node that dies mid-execution are released automatically after LeaseDuration.
+// Tasks waiting on the same node are released highest priority first, then in the order they arrived.  Across nodes
+// waiting tasks poll for free slots.
+type RedisThrottler struct {
+	Client *goredislib.Client
+	// WorkerLimits and WorkgroupLimits work like the limits for NewWorkerThrottler and NewWorkgroupThrottler.
+	WorkerLimits    map[string]int
+	WorkgroupLimits map[string]int
+	// LeaseDuration is how long a slot is held without being renewed.
+	LeaseDuration time.Duration
+	// PollInterval is how often waiting tasks check for free slots (and held slots are renewed).
+	PollInterval time.Duration
+}
+
+// NewRedisThrottler creates a new RedisThrottler, call Throttler to start it.
+func NewRedisThrottler(client *goredislib.Client, workerLimits map[string]int, workgroupLimits map[string]int) *RedisThrottler {
+	throttler := RedisThrottler{
+		Client:          client,
+		WorkerLimits:    workerLimits,
+		WorkgroupLimits: workgroupLimits,
+		LeaseDuration:   30 * time.Second,
+		PollInterval:    500 * time.Millisecond,
+	}
+	return &throttler
+}
+
+// slots returns the semaphore keys (and their limits) that a task needs a slot in.
+func (throttler *RedisThrottler) slots(worker string, workgroup string) (keys []string, limits []interface{}) {
+	if limit := limitLookup(throttler.WorkerLimits)(worker); limit > 0 {
+		keys = append(keys, "go-crew/throttle/workers/"+worker)
+		limits = append(limits, limit)
+	}
+	if workgroup != "" {
+		if limit := limitLookup(throttler.WorkgroupLimits)(workgroup); limit > 0 {
+			keys = append(keys, "go-crew/throttle/workgroups/"+workgroup)
+			limits = append(limits, limit)
+		}
+	}
+	return keys, limits
+}
+
+func (throttler *RedisThrottler) tryAcquire(query ThrottlePushQuery) (acquired bool, err error) {
+	keys, limits := throttler.slots(query.Worker, query.Workgroup)
+	if len(keys) == 0 {
+		return true, nil
+	}
+	args := append([]interface{}{query.TaskId, throttler.LeaseDuration.Milliseconds()}, limits...)
+	result, err := acquireSlotsScript.Run(context.Background(), throttler.Client, keys, args...).Int()
+	if err != nil {
+		return false, err
+	}
+	return result == 1, nil
+}
+
+func (throttler *RedisThrottler) renew(query ThrottlePushQuery) (err error) {
+	keys, _ := throttler.slots(query.Worker, query.Workgroup)
+	if len(keys) == 0 {
+		return nil
+	}
+	return renewSlotsScript.Run(context.Background(), throttler.Client, keys, query.TaskId, throttler.LeaseDuration.Milliseconds()).Err()
+}
+
+func (throttler *RedisThrottler) release(query ThrottlePushQuery) (err error) {
+	keys, _ := throttler.slots(query.Worker, query.Workgroup)
+	for _, key := range keys {
+		if remErr := throttler.Client.ZRem(context.Background(), key, query.TaskId).Err(); remErr != nil {
+			err = remErr
+		}
+	}
+	return err
+}
+
+// Throttler starts the throttler and returns the channels to hand to a TaskController.
+func (throttler *RedisThrottler) Throttler() *Throttler {
+	channels := &Throttler{
+		Push: make(chan ThrottlePushQuery, 8),
+		Pop:  make(chan ThrottlePopQuery, 8),
+	}
+
+	go func() {
+		pending := make([]ThrottlePushQuery, 0)
+		executing := make(map[string]ThrottlePushQuery)
+		ticker := time.NewTicker(throttler.PollInterval)
+		lastRenew := time.Now()
+
+		// grant lets as many waiting tasks run as there are free slots, in queue order
+		grant := func() {
+			blocked := make(map[string]bool)
+			remaining := make([]ThrottlePushQuery, 0, len(pending))
+			for _, query := range pending {
+				// Don't let a task jump ahead of one queued before it on the same worker/workgroup
+				if blocked["w:"+query.Worker] || blocked["g:"+query.Workgroup] {
+					remaining = append(remaining, query)
+					continue
+				}
+				acquired, err := throttler.tryAcquire(query)
+				if err != nil {
+					log.Println("Error acquiring throttle slot", query.TaskId, err)
+				}
+				if acquired {
+					executing[query.TaskId] = query
+					query.Resp <- true
+				} else {
+					blocked["w:"+query.Worker] = true
+					if query.Workgroup != "" {
+						blocked["g:"+query.Workgroup] = true
+					}
+					remaining = append(remaining, query)
+				}
+			}
+			pending = remaining
+		}
+
+		for {
+			select {
+			case pushQuery := <-channels.Push:
+				pending = enqueueByPriority(pending, pushQuery)
+				grant()
+
+			case popQuery := <-channels.Pop:
+				for i, query := range pending {
+					if query.TaskId == popQuery.TaskId {
+						pending = append(pending[:i:i], pending[i+1:]...)
+						break
+					}
+				}
+				if query, found := executing[popQuery.TaskId]; found {
+					delete(executing, popQuery.TaskId)
+					if err := throttler.release(query); err != nil {
+						log.Println("Error releasing throttle slot", query.TaskId, err)
+					}
+				}
+				grant()
+
+			case <-ticker.C:
+				// Keep slots for tasks that are still executing
+				if time.Since(lastRenew) > throttler.LeaseDuration/3 {
+					lastRenew = time.Now()
+					for _, query := range executing {
+						if err := throttler.renew(query); err != nil {
+							log.Println("Error renewing throttle slot", query.TaskId, err)
+						}
+					}
+				}
+				if len(pending) > 0 {
+					grant()
+				}
+			}
+		}
+	}()
+
+	return channels
+}
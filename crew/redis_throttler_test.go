@@ -0,0 +1,112 @@
+package crew
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	goredislib "github.com/redis/go-redis/v9"
+)
+
+func TestRedisThrottlerSlots(t *testing.T) {
+	throttler := NewRedisThrottler(nil, map[string]int{"worker-a": 2, "worker-b": 0}, map[string]int{"*": 5})
+
+	keys, limits := throttler.slots("worker-a", "group-a")
+	if !reflect.DeepEqual(keys, []string{"go-crew/throttle/workers/worker-a", "go-crew/throttle/workgroups/group-a"}) {
+		t.Fatalf("Unexpected keys %v", keys)
+	}
+	if !reflect.DeepEqual(limits, []interface{}{2, 5}) {
+		t.Fatalf("Unexpected limits %v", limits)
+	}
+
+	// Unlimited workers and tasks without a workgroup don't need a slot
+	keys, _ = throttler.slots("worker-b", "")
+	if len(keys) != 0 {
+		t.Fatalf("Expected no slots, got %v", keys)
+	}
+
+	acquired, err := throttler.tryAcquire(ThrottlePushQuery{TaskId: "task104", Worker: "worker-b"})
+	if err != nil || !acquired {
+		t.Fatalf("Expected unthrottled task to acquire without redis")
+	}
+}
+
+// newTestRedisThrottler creates a throttler for one node, each node gets its own redis connection.
+func newTestRedisThrottler(t *testing.T, addr string) *RedisThrottler {
+	client := goredislib.NewClient(&goredislib.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+	throttler := NewRedisThrottler(client, map[string]int{"worker-a": 2}, map[string]int{"group-e": 1})
+	throttler.LeaseDuration = time.Second
+	throttler.PollInterval = 10 * time.Millisecond
+	return throttler
+}
+
+func TestRedisThrottlerLimitsAcrossNodes(t *testing.T) {
+	server, _ := newTestRedis(t)
+	nodeA := newTestRedisThrottler(t, server.Addr()).Throttler()
+	nodeB := newTestRedisThrottler(t, server.Addr()).Throttler()
+
+	first := pushThrottle(nodeA, "task168", "worker-a", "")
+	second := pushThrottle(nodeB, "task169", "worker-a", "")
+	expectGranted(t, first)
+	expectGranted(t, second)
+	third := pushThrottle(nodeB, "task170", "worker-a", "")
+	expectWaiting(t, third)
+
+	// A slot freed on one node is picked up by a task waiting on the other
+	popThrottle(nodeA, "task168", "worker-a", "")
+	expectGranted(t, third)
+	fourth := pushThrottle(nodeA, "task171", "worker-a", "")
+	expectWaiting(t, fourth)
+	popThrottle(nodeB, "task169", "worker-a", "")
+	expectGranted(t, fourth)
+
+	// Workgroup limits are shared too
+	grouped := pushThrottle(nodeA, "task172", "worker-b", "group-e")
+	expectGranted(t, grouped)
+	waiting := pushThrottle(nodeB, "task173", "worker-b", "group-e")
+	expectWaiting(t, waiting)
+	popThrottle(nodeA, "task172", "worker-b", "group-e")
+	expectGranted(t, waiting)
+
+	popThrottle(nodeB, "task170", "worker-a", "")
+	popThrottle(nodeB, "task173", "worker-b", "group-e")
+	popThrottle(nodeA, "task171", "worker-a", "")
+}
+
+func TestRedisThrottlerReleasesSlotsOfDeadNodes(t *testing.T) {
+	server, _ := newTestRedis(t)
+	now := time.Now()
+	server.SetTime(now)
+
+	// A node takes every slot and dies without releasing or renewing them
+	dead := newTestRedisThrottler(t, server.Addr())
+	for _, taskId := range []string{"task174", "task175"} {
+		acquired, err := dead.tryAcquire(ThrottlePushQuery{TaskId: taskId, Worker: "worker-a"})
+		if err != nil || !acquired {
+			t.Fatalf("Expected %v to take a slot, got %v %v", taskId, acquired, err)
+		}
+	}
+
+	live := newTestRedisThrottler(t, server.Addr())
+	channels := live.Throttler()
+	waiting := pushThrottle(channels, "task176", "worker-a", "")
+	expectWaiting(t, waiting)
+
+	// Slots that aren't renewed run out after LeaseDuration
+	server.SetTime(now.Add(live.LeaseDuration / 2))
+	expectWaiting(t, waiting)
+	server.SetTime(now.Add(live.LeaseDuration + 100*time.Millisecond))
+	expectGranted(t, waiting)
+
+	// Only the dead node's slots were freed, the live node holds one of the two slots
+	acquired, err := dead.tryAcquire(ThrottlePushQuery{TaskId: "task177", Worker: "worker-a"})
+	if err != nil || !acquired {
+		t.Fatalf("Expected an expired slot to be free, got %v %v", acquired, err)
+	}
+	acquired, _ = dead.tryAcquire(ThrottlePushQuery{TaskId: "task178", Worker: "worker-a"})
+	if acquired {
+		t.Fatal("Expected the live node's slot to still be held")
+	}
+	popThrottle(channels, "task176", "worker-a", "")
+}
@@ -1,8 +1,10 @@
 package crew
 
 import (
+	"bytes"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -12,6 +14,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -116,7 +119,19 @@ func BuildRestApi(e *echo.Echo, prefix string, controller *TaskController, authM
 			skipCompleted, _ = strconv.ParseBool(c.QueryParam("skipCompleted"))
 		}
 
-		tasks, total, err := controller.GetTasksInGroup(taskGroupId, page, pageSize, search, skipCompleted)
+		// Comma separated list of statuses to include, e.g. ?status=failed,canceled
+		statuses := make([]TaskStatus, 0)
+		if c.QueryParams().Has("status") && c.QueryParam("status") != "" {
+			for _, value := range strings.Split(c.QueryParam("status"), ",") {
+				status, statusErr := ParseTaskStatus(strings.TrimSpace(value))
+				if statusErr != nil {
+					return c.String(http.StatusBadRequest, statusErr.Error())
+				}
+				statuses = append(statuses, status)
+			}
+		}
+
+		tasks, total, err := controller.GetTasksInGroup(taskGroupId, page, pageSize, search, skipCompleted, statuses)
 
 		if err != nil {
 			return c.String(http.StatusInternalServerError, err.Error())
@@ -153,6 +168,120 @@ func BuildRestApi(e *echo.Echo, prefix string, controller *TaskController, authM
 		}
 		return c.JSON(http.StatusOK, task)
 	}, authMiddleware)
+	e.GET(prefix+"/api/v1/task/:task_id/attempts", func(c echo.Context) error {
+		taskId := c.Param("task_id")
+		attempts, err := controller.GetTaskAttempts(taskId)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"attempts": attempts,
+		})
+	}, authMiddleware)
+	e.POST(prefix+"/api/v1/task/:task_id/complete", func(c echo.Context) error {
+		// Async workers report a task's result here, the completionToken they were sent authorizes the call.
+		taskId := c.Param("task_id")
+		token := c.Request().Header.Get("X-Crew-Completion-Token")
+
+		bodyBytes, readErr := io.ReadAll(c.Request().Body)
+		if readErr != nil {
+			return c.String(http.StatusBadRequest, readErr.Error())
+		}
+		if verifyErr := controller.VerifyCallback(taskId, c.Request().Header, bodyBytes); verifyErr != nil {
+			return c.String(http.StatusUnauthorized, verifyErr.Error())
+		}
+		response := WorkerResponse{}
+		parseErr := json.Unmarshal(bodyBytes, &response)
+		if parseErr != nil {
+			return c.String(http.StatusBadRequest, parseErr.Error())
+		}
+		response.RawBody = string(bodyBytes)
+
+		task, err := controller.CompleteTask(taskId, token, response)
+		if errors.Is(err, ErrInvalidCompletionToken) {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+		if errors.Is(err, ErrTaskNotAwaitingCompletion) {
+			return c.String(http.StatusConflict, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, task)
+	})
+	e.POST(prefix+"/api/v1/lease", func(c echo.Context) error {
+		// Pull workers claim up to max (default 1) of their queued tasks here
+		worker := c.QueryParam("worker")
+		if worker == "" {
+			return c.String(http.StatusBadRequest, "worker is required")
+		}
+		max := 1
+		maxParam := c.QueryParam("max")
+		if maxParam != "" {
+			parsedMax, parseErr := strconv.Atoi(maxParam)
+			if parseErr != nil || parsedMax < 1 {
+				return c.String(http.StatusBadRequest, "max must be a number >= 1")
+			}
+			max = parsedMax
+		}
+
+		bodyBytes, readErr := io.ReadAll(c.Request().Body)
+		if readErr != nil {
+			return c.String(http.StatusBadRequest, readErr.Error())
+		}
+		if verifyErr := controller.VerifyLease(worker, c.Request().URL.RawQuery, c.Request().Header, bodyBytes); verifyErr != nil {
+			return c.String(http.StatusUnauthorized, verifyErr.Error())
+		}
+
+		payloads, err := controller.LeaseTasks(worker, max)
+		if errors.Is(err, ErrLeaseNotSupported) {
+			return c.String(http.StatusNotImplemented, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"tasks": payloads,
+		})
+	}, authMiddleware)
+	e.POST(prefix+"/api/v1/task/:task_id/heartbeat", func(c echo.Context) error {
+		// Workers report {"progress": 0-100, "message": "..."} here while working on a task, authorized like complete.
+		taskId := c.Param("task_id")
+		token := c.Request().Header.Get("X-Crew-Completion-Token")
+
+		bodyBytes, readErr := io.ReadAll(c.Request().Body)
+		if readErr != nil {
+			return c.String(http.StatusBadRequest, readErr.Error())
+		}
+		if verifyErr := controller.VerifyCallback(taskId, c.Request().Header, bodyBytes); verifyErr != nil {
+			return c.String(http.StatusUnauthorized, verifyErr.Error())
+		}
+		body := struct {
+			Progress *float64 `json:"progress"`
+			Message  *string  `json:"message"`
+		}{}
+		if len(bytes.TrimSpace(bodyBytes)) > 0 {
+			parseErr := json.Unmarshal(bodyBytes, &body)
+			if parseErr != nil {
+				return c.String(http.StatusBadRequest, parseErr.Error())
+			}
+		}
+		if body.Progress != nil && (*body.Progress < 0 || *body.Progress > 100) {
+			return c.String(http.StatusBadRequest, "progress must be between 0 and 100")
+		}
+
+		task, err := controller.Heartbeat(taskId, token, body.Progress, body.Message)
+		if errors.Is(err, ErrInvalidCompletionToken) {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+		if errors.Is(err, ErrTaskNotRunning) {
+			return c.String(http.StatusConflict, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, task)
+	})
 	e.POST(prefix+"/api/v1/task_groups", func(c echo.Context) error {
 		// Create a task group
 		group := NewTaskGroup("", "")
@@ -292,6 +421,31 @@ func BuildRestApi(e *echo.Echo, prefix string, controller *TaskController, authM
 
 		return c.JSON(http.StatusOK, task)
 	}, authMiddleware)
+	e.POST(prefix+"/api/v1/task_group/:task_group_id/cancel", func(c echo.Context) error {
+		taskGroupId := c.Param("task_group_id")
+		err := controller.CancelTaskGroup(taskGroupId)
+		if errors.Is(err, ErrTaskLocked) {
+			return c.String(http.StatusConflict, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": true,
+		})
+	}, authMiddleware)
+	e.POST(prefix+"/api/v1/task_group/:task_group_id/task/:task_id/cancel", func(c echo.Context) error {
+		// Stop a task, aborting its worker call if it is currently executing.
+		taskId := c.Param("task_id")
+		task, err := controller.CancelTask(taskId)
+		if errors.Is(err, ErrTaskLocked) {
+			return c.String(http.StatusConflict, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, task)
+	}, authMiddleware)
 	e.POST(prefix+"/api/v1/task_group/:task_group_id/task/:task_id/retry", func(c echo.Context) error {
 		// Force a retry of a task by updating its remainingAttempts value.
 		taskId := c.Param("task_id")
@@ -355,12 +509,86 @@ func BuildRestApi(e *echo.Echo, prefix string, controller *TaskController, authM
 		}
 
 		task, err := controller.UpdateTask(taskId, update)
+		if errors.Is(err, ErrInvalidTaskUpdate) {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if errors.Is(err, ErrTaskLocked) {
+			return c.String(http.StatusConflict, err.Error())
+		}
 		if err != nil {
 			return c.String(http.StatusInternalServerError, err.Error())
 		}
 
 		return c.JSON(http.StatusOK, task)
 	}, authMiddleware)
+	e.GET(prefix+"/api/v1/workgroups", func(c echo.Context) error {
+		// Workgroups that have been delayed, paused or configured
+		workgroups, err := controller.GetWorkgroups()
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"workgroups": workgroups,
+		})
+	}, authMiddleware)
+	e.GET(prefix+"/api/v1/workgroup/:workgroup", func(c echo.Context) error {
+		workgroup, err := controller.GetWorkgroup(c.Param("workgroup"))
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, workgroup)
+	}, authMiddleware)
+	e.POST(prefix+"/api/v1/workgroup/:workgroup/pause", func(c echo.Context) error {
+		// Pause until resumed (empty body), or for {"seconds": N}
+		until := time.Time{}
+		bodyBytes, readErr := io.ReadAll(c.Request().Body)
+		if readErr != nil {
+			return c.String(http.StatusBadRequest, readErr.Error())
+		}
+		if len(bytes.TrimSpace(bodyBytes)) > 0 {
+			body := struct {
+				Seconds *float64 `json:"seconds"`
+			}{}
+			parseErr := json.Unmarshal(bodyBytes, &body)
+			if parseErr != nil {
+				return c.String(http.StatusBadRequest, parseErr.Error())
+			}
+			if body.Seconds == nil || *body.Seconds <= 0 {
+				return c.String(http.StatusBadRequest, "seconds must be a number > 0")
+			}
+			until = time.Now().Add(time.Duration(*body.Seconds * float64(time.Second)))
+		}
+
+		workgroup, err := controller.PauseWorkgroup(c.Param("workgroup"), until)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, workgroup)
+	}, authMiddleware)
+	e.POST(prefix+"/api/v1/workgroup/:workgroup/resume", func(c echo.Context) error {
+		workgroup, err := controller.ResumeWorkgroup(c.Param("workgroup"))
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, workgroup)
+	}, authMiddleware)
+	e.PUT(prefix+"/api/v1/workgroup/:workgroup", func(c echo.Context) error {
+		// Update a workgroup's maxConcurrency / rateLimit / rateLimitIntervalInSeconds / rateLimitBurst
+		update := make(map[string]interface{})
+		parseErr := json.NewDecoder(c.Request().Body).Decode(&update)
+		if parseErr != nil {
+			return c.String(http.StatusBadRequest, parseErr.Error())
+		}
+
+		workgroup, err := controller.UpdateWorkgroup(c.Param("workgroup"), update)
+		if errors.Is(err, ErrInvalidWorkgroupUpdate) {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, workgroup)
+	}, authMiddleware)
 
 	// Demo worker endpoints
 	e.POST(prefix+"/demo/worker-a", func(c echo.Context) error {
@@ -0,0 +1,54 @@
+package crew
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestPauseWorkgroupBody(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	controller := NewTaskController(storage, nil, nil)
+	controller.Feed = nil
+	e := echo.New()
+	inShutdown := false
+	allow := func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	BuildRestApi(e, "", controller, allow, nil, &inShutdown, make(map[string]TaskGroupWatcher))
+
+	pause := func(workgroup string, body string) int {
+		req := httptest.NewRequest("POST", "/api/v1/workgroup/"+workgroup+"/pause", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, body := range []string{`{"seconds": `, `{"seconds": "soon"}`, `{"seconds": 0}`, `{}`, `[]`} {
+		if code := pause("group-g", body); code != http.StatusBadRequest {
+			t.Fatalf("Expected %v to be rejected, got %v", body, code)
+		}
+	}
+	if workgroup, _ := storage.FindWorkgroup("group-g"); !workgroup.IsAvailable(time.Now()) {
+		t.Fatal("Expected rejected pauses to leave the workgroup alone")
+	}
+
+	if code := pause("group-g", ""); code != http.StatusOK {
+		t.Fatalf("Expected empty body to pause, got %v", code)
+	}
+	workgroup, _ := storage.FindWorkgroup("group-g")
+	if !workgroup.IsPaused {
+		t.Fatal("Expected workgroup to be paused until resumed")
+	}
+
+	if code := pause("group-h", `{"seconds": 300}`); code != http.StatusOK {
+		t.Fatalf("Expected timed pause, got %v", code)
+	}
+	workgroup, _ = storage.FindWorkgroup("group-h")
+	if workgroup.IsPaused || !workgroup.PausedUntil.After(time.Now().Add(200*time.Second)) {
+		t.Fatalf("Expected workgroup to be paused for 300 seconds, got %+v", workgroup)
+	}
+}
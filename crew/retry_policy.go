@@ -0,0 +1,75 @@
+package crew
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	// RetryStrategyFixed waits the same delay before every retry.
+	RetryStrategyFixed = "fixed"
+	// RetryStrategyLinear waits delay * failures before each retry.
+	RetryStrategyLinear = "linear"
+	// RetryStrategyExponential waits delay * multiplier^(failures-1) before each retry.
+	RetryStrategyExponential = "exponential"
+)
+
+// RetryPolicy defines how long a task waits before it is retried after a failed attempt.
+type RetryPolicy struct {
+	// Strategy is one of fixed (default), linear or exponential.
+	Strategy string `json:"strategy"`
+	// DelayInSeconds is the base delay, the task's errorDelayInSeconds is used when this is 0.
+	DelayInSeconds int `json:"delayInSeconds"`
+	// MaxDelayInSeconds caps the delay between retries (0 = no cap).
+	MaxDelayInSeconds int `json:"maxDelayInSeconds"`
+	// Multiplier is the growth factor for exponential backoff (defaults to 2).
+	Multiplier float64 `json:"multiplier"`
+	// Jitter randomly shortens each delay by up to this fraction (0.0 - 1.0) so that tasks failing together don't retry in lockstep.
+	Jitter float64 `json:"jitter"`
+	// MaxRetryWindowInSeconds stops retries once this much time has passed since the first failure (0 = no limit).
+	MaxRetryWindowInSeconds int `json:"maxRetryWindowInSeconds"`
+}
+
+// Delay returns how long to wait before the next attempt given the number of failures so far (including the latest one).
+func (policy *RetryPolicy) Delay(failures int, baseDelay time.Duration) time.Duration {
+	if policy.DelayInSeconds > 0 {
+		baseDelay = time.Duration(policy.DelayInSeconds) * time.Second
+	}
+	if failures < 1 {
+		failures = 1
+	}
+
+	delay := float64(baseDelay)
+	switch policy.Strategy {
+	case RetryStrategyLinear:
+		delay = delay * float64(failures)
+	case RetryStrategyExponential:
+		multiplier := policy.Multiplier
+		if multiplier <= 0 {
+			multiplier = 2
+		}
+		delay = delay * math.Pow(multiplier, float64(failures-1))
+	}
+
+	if policy.MaxDelayInSeconds > 0 {
+		delay = math.Min(delay, float64(time.Duration(policy.MaxDelayInSeconds)*time.Second))
+	}
+	// Guard against overflow from large exponents
+	delay = math.Min(delay, float64(math.MaxInt64))
+
+	if policy.Jitter > 0 {
+		jitter := math.Min(policy.Jitter, 1)
+		delay = delay - (delay * jitter * rand.Float64())
+	}
+
+	return time.Duration(delay)
+}
+
+// WindowExceeded returns true if a retry at retryAt would fall outside of the policy's max retry window.
+func (policy *RetryPolicy) WindowExceeded(firstFailureAt time.Time, retryAt time.Time) bool {
+	if policy.MaxRetryWindowInSeconds <= 0 || firstFailureAt.IsZero() {
+		return false
+	}
+	return retryAt.Sub(firstFailureAt) > time.Duration(policy.MaxRetryWindowInSeconds)*time.Second
+}
@@ -0,0 +1,101 @@
+package crew
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFixedRetryDelay(t *testing.T) {
+	task := NewTask()
+	task.ErrorDelayInSeconds = 30
+	task.Errors = []string{"oops", "oops"}
+
+	delay := task.RetryDelay()
+	if delay != 30*time.Second {
+		t.Fatalf(`RetryDelay() = %v, want %v`, delay, 30*time.Second)
+	}
+}
+
+func TestLinearRetryDelay(t *testing.T) {
+	policy := &RetryPolicy{Strategy: RetryStrategyLinear, DelayInSeconds: 10}
+
+	delay := policy.Delay(3, time.Minute)
+	if delay != 30*time.Second {
+		t.Fatalf(`Delay(3) = %v, want %v`, delay, 30*time.Second)
+	}
+}
+
+func TestExponentialRetryDelayWithCap(t *testing.T) {
+	policy := &RetryPolicy{Strategy: RetryStrategyExponential, DelayInSeconds: 1, MaxDelayInSeconds: 60}
+
+	expected := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	for i, want := range expected {
+		delay := policy.Delay(i+1, time.Minute)
+		if delay != want {
+			t.Fatalf(`Delay(%v) = %v, want %v`, i+1, delay, want)
+		}
+	}
+
+	delay := policy.Delay(100, time.Minute)
+	if delay != 60*time.Second {
+		t.Fatalf(`Delay(100) = %v, want %v (capped)`, delay, 60*time.Second)
+	}
+}
+
+func TestExponentialRetryDelayUsesTaskDelay(t *testing.T) {
+	task := NewTask()
+	task.ErrorDelayInSeconds = 5
+	task.RetryPolicy = &RetryPolicy{Strategy: RetryStrategyExponential, Multiplier: 3}
+	task.Errors = []string{"oops", "oops", "oops"}
+
+	delay := task.RetryDelay()
+	if delay != 45*time.Second {
+		t.Fatalf(`RetryDelay() = %v, want %v`, delay, 45*time.Second)
+	}
+}
+
+func TestJitteredRetryDelay(t *testing.T) {
+	policy := &RetryPolicy{Strategy: RetryStrategyFixed, DelayInSeconds: 100, Jitter: 0.5}
+
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < 50; i++ {
+		delay := policy.Delay(1, time.Minute)
+		if delay < 50*time.Second || delay > 100*time.Second {
+			t.Fatalf(`Delay(1) = %v, want between 50s and 100s`, delay)
+		}
+		distinct[delay] = true
+	}
+	if len(distinct) < 2 {
+		t.Fatal("Expected jittered delays to vary")
+	}
+}
+
+func TestRetryWindowExceeded(t *testing.T) {
+	policy := &RetryPolicy{MaxRetryWindowInSeconds: 60}
+	firstFailureAt := time.Now()
+
+	if policy.WindowExceeded(firstFailureAt, firstFailureAt.Add(30*time.Second)) {
+		t.Fatal("Expected retry within window to be allowed")
+	}
+	if !policy.WindowExceeded(firstFailureAt, firstFailureAt.Add(90*time.Second)) {
+		t.Fatal("Expected retry outside of window to be rejected")
+	}
+}
+
+func TestHandleExecuteErrorStopsAfterRetryWindow(t *testing.T) {
+	controller := NewTaskController(NewMemoryTaskStorage(), nil, nil)
+	task := NewTask()
+	task.RetryPolicy = &RetryPolicy{DelayInSeconds: 60, MaxRetryWindowInSeconds: 90}
+
+	controller.HandleExecuteError(task, "first failure")
+	if task.RemainingAttempts != 5 {
+		t.Fatalf(`RemainingAttempts = %v, want %v`, task.RemainingAttempts, 5)
+	}
+
+	// Pretend the first failure happened a while ago
+	task.FirstFailureAt = time.Now().Add(-60 * time.Second)
+	controller.HandleExecuteError(task, "second failure")
+	if task.RemainingAttempts != 0 {
+		t.Fatalf(`RemainingAttempts = %v, want %v (retry window exceeded)`, task.RemainingAttempts, 0)
+	}
+}
@@ -0,0 +1,96 @@
+package crew
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers used to sign calls between crew and workers (see SignRequest).
+const (
+	SignatureHeader          = "X-Crew-Signature"
+	SignatureTimestampHeader = "X-Crew-Timestamp"
+	SignatureTaskIdHeader    = "X-Crew-Task-Id"
+)
+
+// DefaultSignatureWindow is how far a signature's timestamp can be from the current time before it is rejected.
+const DefaultSignatureWindow = 5 * time.Minute
+
+// ErrInvalidSignature is returned when a request's signature is missing or doesn't match its body.
+var ErrInvalidSignature = errors.New("Invalid or missing request signature")
+
+// ErrSignatureExpired is returned when a request's signature was made outside of the replay window.
+var ErrSignatureExpired = errors.New("Request signature is outside of the replay window")
+
+// Signature returns the hmac-sha256 signature of a request made at timestamp (unix seconds) for a task.
+func Signature(secret string, timestamp int64, taskId string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "." + taskId + "."))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// LeaseSignatureId is what pull workers sign in place of a task id when they call POST /api/v1/lease.  It covers the
+// raw query string of the call (for example "worker=worker-a&max=5"), so that a lease signature can't be used with
+// another worker or max, or as a task's callback.  There is no nonce, a signed lease call can be replayed as is
+// until its timestamp falls outside the signature window.
+func LeaseSignatureId(query string) string {
+	return "lease:" + query
+}
+
+// SignRequest adds the signature headers to a request, body must be the request's body.
+func SignRequest(req *http.Request, secret string, taskId string, body []byte) {
+	timestamp := time.Now().Unix()
+	req.Header.Set(SignatureTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureTaskIdHeader, taskId)
+	req.Header.Set(SignatureHeader, Signature(secret, timestamp, taskId, body))
+}
+
+// VerifySignature checks a request's signature headers against its body and returns the task id that was signed.
+// Any of secrets may have made the signature so that secrets can be rotated.  Callers must check that the returned
+// task id is the task the request is about.
+func VerifySignature(header http.Header, body []byte, now time.Time, window time.Duration, secrets ...string) (taskId string, err error) {
+	timestamp, parseErr := strconv.ParseInt(header.Get(SignatureTimestampHeader), 10, 64)
+	signature := header.Get(SignatureHeader)
+	if parseErr != nil || signature == "" {
+		return "", ErrInvalidSignature
+	}
+	taskId = header.Get(SignatureTaskIdHeader)
+
+	matched := false
+	for _, secret := range secrets {
+		if secret != "" && hmac.Equal([]byte(signature), []byte(Signature(secret, timestamp, taskId, body))) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return "", ErrInvalidSignature
+	}
+
+	// Checked after the signature so that the timestamp can be trusted
+	signedAt := time.Unix(timestamp, 0)
+	if signedAt.Before(now.Add(-window)) || signedAt.After(now.Add(window)) {
+		return "", ErrSignatureExpired
+	}
+	return taskId, nil
+}
+
+// SigningSecretsFromEnv reads a comma separated list of signing secrets, for example CREW_WORKER_SIGNING_SECRET=new,old.
+// The first secret is used to sign and every secret is accepted when verifying.
+func SigningSecretsFromEnv(name string) []string {
+	secrets := []string{}
+	for _, secret := range strings.Split(os.Getenv(name), ",") {
+		secret = strings.TrimSpace(secret)
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
@@ -0,0 +1,204 @@
+package crew
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSignature(t *testing.T) {
+	body := []byte(`{"taskId":"task156"}`)
+	now := time.Now()
+	req, _ := http.NewRequest("POST", "http://example.com", nil)
+	SignRequest(req, "new", "task156", body)
+
+	taskId, err := VerifySignature(req.Header, body, now, DefaultSignatureWindow, "new")
+	if err != nil || taskId != "task156" {
+		t.Fatalf("Expected signature to verify, got %v %v", taskId, err)
+	}
+
+	// Any of the secrets can verify so that secrets can be rotated
+	if _, err := VerifySignature(req.Header, body, now, DefaultSignatureWindow, "newer", "new"); err != nil {
+		t.Fatalf("Expected rotated secret to verify, got %v", err)
+	}
+	if _, err := VerifySignature(req.Header, body, now, DefaultSignatureWindow, "other"); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Expected wrong secret to be rejected, got %v", err)
+	}
+	if _, err := VerifySignature(req.Header, []byte(`{"taskId":"task157"}`), now, DefaultSignatureWindow, "new"); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Expected changed body to be rejected, got %v", err)
+	}
+
+	// The task id is part of the signature
+	req.Header.Set(SignatureTaskIdHeader, "task157")
+	if _, err := VerifySignature(req.Header, body, now, DefaultSignatureWindow, "new"); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Expected changed task id to be rejected, got %v", err)
+	}
+
+	// Old signatures are replays
+	old := now.Add(-10 * time.Minute).Unix()
+	req.Header.Set(SignatureTaskIdHeader, "task156")
+	req.Header.Set(SignatureTimestampHeader, strconv.FormatInt(old, 10))
+	req.Header.Set(SignatureHeader, Signature("new", old, "task156", body))
+	if _, err := VerifySignature(req.Header, body, now, DefaultSignatureWindow, "new"); !errors.Is(err, ErrSignatureExpired) {
+		t.Fatalf("Expected old signature to be rejected, got %v", err)
+	}
+
+	if _, err := VerifySignature(http.Header{}, body, now, DefaultSignatureWindow, "new"); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Expected missing signature to be rejected, got %v", err)
+	}
+}
+
+func TestSignedHttpPostClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		taskId, err := VerifySignature(r.Header, body, time.Now(), DefaultSignatureWindow, "secret")
+		if err != nil || taskId != "task158" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"output":"verified"}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("CREW_WORKER_SIGNING_SECRET", "secret,old-secret")
+	client := NewHttpPostClient()
+	client.UrlForTask = func(task *Task) (url string, err error) {
+		return server.URL, nil
+	}
+
+	task := NewTask()
+	task.Id = "task158"
+	task.Worker = "worker-a"
+	response, err := client.Post(context.Background(), task, []*Task{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Output != "verified" {
+		t.Fatalf("Unexpected response %+v", response)
+	}
+
+	client.SigningSecret = "old-secret"
+	if _, err := client.Post(context.Background(), task, []*Task{}); err == nil {
+		t.Fatal("Expected call signed with another secret to be rejected")
+	}
+}
+
+func TestVerifyCallback(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	controller := NewTaskController(storage, NewHttpPostClient(), nil)
+	body := []byte(`{"progress": 50}`)
+	header := http.Header{}
+
+	// Callbacks aren't checked unless secrets are configured
+	if err := controller.VerifyCallback("task159", header, body); err != nil {
+		t.Fatal(err)
+	}
+
+	controller.CallbackSigningSecrets = []string{"secret"}
+	if err := controller.VerifyCallback("task159", header, body); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Expected unsigned callback to be rejected, got %v", err)
+	}
+
+	req, _ := http.NewRequest("POST", "http://example.com", nil)
+	SignRequest(req, "secret", "task159", body)
+	if err := controller.VerifyCallback("task159", req.Header, body); err != nil {
+		t.Fatalf("Expected signed callback to be accepted, got %v", err)
+	}
+	// A callback signed for one task can't be used for another
+	if err := controller.VerifyCallback("task160", req.Header, body); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Expected callback for another task to be rejected, got %v", err)
+	}
+}
+
+func TestVerifyCallbackWithRouteSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	writeRoutesFile(t, path, `{"routes": [
+		{"worker": "resize", "url": "https://images.example.com/resize", "signingSecret": "route-secret"},
+		{"worker": "*", "url": "https://workers.example.com/{worker}"}
+	]}`)
+	routes, err := LoadWorkerRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewHttpPostClient()
+	client.Routes = routes
+	storage := NewMemoryTaskStorage()
+	controller := NewTaskController(storage, client, nil)
+	controller.CallbackSigningSecrets = []string{}
+
+	for id, worker := range map[string]string{"task197": "resize", "task198": "plain"} {
+		task := NewTask()
+		task.Id = id
+		task.Worker = worker
+		storage.SaveTask(task, true)
+	}
+	body := []byte(`{"progress": 50}`)
+
+	// Only the route secret is configured, the callback still has to be signed
+	if err := controller.VerifyCallback("task197", http.Header{}, body); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Expected unsigned callback to be rejected, got %v", err)
+	}
+	req, _ := http.NewRequest("POST", "http://example.com", nil)
+	SignRequest(req, "route-secret", "task197", body)
+	if err := controller.VerifyCallback("task197", req.Header, body); err != nil {
+		t.Fatalf("Expected callback signed with the route secret to be accepted, got %v", err)
+	}
+	SignRequest(req, "other-secret", "task197", body)
+	if err := controller.VerifyCallback("task197", req.Header, body); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Expected callback signed with another secret to be rejected, got %v", err)
+	}
+
+	// Routes without a secret aren't signed, so their callbacks aren't checked
+	if err := controller.VerifyCallback("task198", http.Header{}, body); err != nil {
+		t.Fatal(err)
+	}
+
+	// The global secrets are accepted alongside the route's
+	controller.CallbackSigningSecrets = []string{"secret"}
+	SignRequest(req, "secret", "task197", body)
+	if err := controller.VerifyCallback("task197", req.Header, body); err != nil {
+		t.Fatalf("Expected callback signed with the global secret to be accepted, got %v", err)
+	}
+}
+
+func TestLeaseRequiresSignature(t *testing.T) {
+	controller := NewTaskController(NewMemoryTaskStorage(), NewPullTaskClient(), nil)
+	controller.Feed = nil
+	controller.CallbackSigningSecrets = []string{"secret"}
+	e := echo.New()
+	inShutdown := false
+	allow := func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	BuildRestApi(e, "", controller, allow, nil, &inShutdown, make(map[string]TaskGroupWatcher))
+
+	lease := func(query string, sign func(req *http.Request)) int {
+		req := httptest.NewRequest("POST", "/api/v1/lease?"+query, nil)
+		sign(req)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := lease("worker=worker-a", func(req *http.Request) {}); code != http.StatusUnauthorized {
+		t.Fatalf("Expected unsigned lease to be rejected, got %v", code)
+	}
+	if code := lease("worker=worker-a", func(req *http.Request) { SignRequest(req, "secret", LeaseSignatureId("worker=worker-b"), nil) }); code != http.StatusUnauthorized {
+		t.Fatalf("Expected lease signed for another worker to be rejected, got %v", code)
+	}
+	if code := lease("worker=worker-a&max=50", func(req *http.Request) { SignRequest(req, "secret", LeaseSignatureId("worker=worker-a&max=1"), nil) }); code != http.StatusUnauthorized {
+		t.Fatalf("Expected lease signed for another max to be rejected, got %v", code)
+	}
+	if code := lease("worker=worker-a", func(req *http.Request) { SignRequest(req, "secret", LeaseSignatureId("worker=worker-a"), nil) }); code != http.StatusOK {
+		t.Fatalf("Expected signed lease to be accepted, got %v", code)
+	}
+	if code := lease("worker=worker-a&max=5", func(req *http.Request) { SignRequest(req, "secret", LeaseSignatureId("worker=worker-a&max=5"), nil) }); code != http.StatusOK {
+		t.Fatalf("Expected signed lease with max to be accepted, got %v", code)
+	}
+}
@@ -0,0 +1,590 @@
+package crew
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// SqlDialectSqlite is used for SQLite databases (tests and single-node deployments).
+	SqlDialectSqlite = "sqlite"
+	// SqlDialectPostgres is used for Postgres databases.
+	SqlDialectPostgres = "postgres"
+)
+
+// sqlMigrations are applied in order, the index of each entry (+1) is its schema version.
+// Never edit an existing entry, append a new one instead.
+var sqlMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS crew_task_groups (
+		id VARCHAR(255) PRIMARY KEY,
+		name TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		data TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS crew_tasks (
+		id VARCHAR(255) PRIMARY KEY,
+		task_group_id VARCHAR(255) NOT NULL,
+		name TEXT NOT NULL,
+		worker VARCHAR(255) NOT NULL,
+		workgroup VARCHAR(255) NOT NULL,
+		task_key VARCHAR(255) NOT NULL,
+		remaining_attempts INTEGER NOT NULL,
+		is_paused BOOLEAN NOT NULL,
+		is_complete BOOLEAN NOT NULL,
+		is_seed BOOLEAN NOT NULL,
+		busy_executing BOOLEAN NOT NULL,
+		run_after TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		data TEXT NOT NULL,
+		lock_token VARCHAR(64),
+		lock_expires_at BIGINT
+	);
+	CREATE INDEX IF NOT EXISTS crew_tasks_task_group_id_idx ON crew_tasks (task_group_id, created_at);
+	CREATE INDEX IF NOT EXISTS crew_tasks_workgroup_idx ON crew_tasks (workgroup);
+	CREATE INDEX IF NOT EXISTS crew_tasks_task_key_idx ON crew_tasks (task_key);
+	CREATE TABLE IF NOT EXISTS crew_task_edges (
+		parent_id VARCHAR(255) NOT NULL,
+		child_id VARCHAR(255) NOT NULL,
+		PRIMARY KEY (parent_id, child_id)
+	);
+	CREATE INDEX IF NOT EXISTS crew_task_edges_child_id_idx ON crew_task_edges (child_id);`,
+	`ALTER TABLE crew_tasks ADD COLUMN status VARCHAR(32) NOT NULL DEFAULT 'pending';
+	CREATE INDEX IF NOT EXISTS crew_tasks_status_idx ON crew_tasks (task_group_id, status);`,
+	`CREATE TABLE IF NOT EXISTS crew_task_attempts (
+		id VARCHAR(255) PRIMARY KEY,
+		task_id VARCHAR(255) NOT NULL,
+		number INTEGER NOT NULL,
+		started_at TIMESTAMP NOT NULL,
+		data TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS crew_task_attempts_task_id_idx ON crew_task_attempts (task_id, number);`,
+	`CREATE TABLE IF NOT EXISTS crew_workgroups (
+		name VARCHAR(255) PRIMARY KEY,
+		data TEXT NOT NULL
+	);`,
+	`ALTER TABLE crew_tasks ADD COLUMN lease_token VARCHAR(64) NOT NULL DEFAULT '';`,
+	`CREATE INDEX IF NOT EXISTS crew_tasks_worker_status_idx ON crew_tasks (worker, status);`,
+}
+
+// SqlTaskStorage stores tasks in a relational database via database/sql.
+// The caller is responsible for importing a driver (for example github.com/mattn/go-sqlite3 or github.com/lib/pq).
+type SqlTaskStorage struct {
+	DB      *sql.DB
+	Dialect string
+}
+
+// NewSqlTaskStorage creates a new SqlTaskStorage and brings the database schema up to date.
+func NewSqlTaskStorage(db *sql.DB, dialect string) (*SqlTaskStorage, error) {
+	if dialect != SqlDialectSqlite && dialect != SqlDialectPostgres {
+		return nil, errors.New("unsupported sql dialect: " + dialect)
+	}
+	storage := SqlTaskStorage{
+		DB:      db,
+		Dialect: dialect,
+	}
+	migrateErr := storage.Migrate()
+	if migrateErr != nil {
+		return nil, migrateErr
+	}
+	return &storage, nil
+}
+
+// Migrate applies any schema migrations that have not yet been applied.
+func (storage *SqlTaskStorage) Migrate() (err error) {
+	_, err = storage.DB.Exec(`CREATE TABLE IF NOT EXISTS crew_schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+
+	version := 0
+	err = storage.DB.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM crew_schema_migrations`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqlMigrations); i++ {
+		tx, txErr := storage.DB.Begin()
+		if txErr != nil {
+			return txErr
+		}
+		for _, statement := range strings.Split(sqlMigrations[i], ";") {
+			if strings.TrimSpace(statement) == "" {
+				continue
+			}
+			if _, execErr := tx.Exec(statement); execErr != nil {
+				tx.Rollback()
+				return execErr
+			}
+		}
+		if _, execErr := tx.Exec(storage.rebind(`INSERT INTO crew_schema_migrations (version) VALUES (?)`), i+1); execErr != nil {
+			tx.Rollback()
+			return execErr
+		}
+		if commitErr := tx.Commit(); commitErr != nil {
+			return commitErr
+		}
+	}
+	return nil
+}
+
+// rebind converts ? placeholders into the style used by the storage's dialect.
+func (storage *SqlTaskStorage) rebind(query string) string {
+	if storage.Dialect != SqlDialectPostgres {
+		return query
+	}
+	var builder strings.Builder
+	n := 0
+	for _, char := range query {
+		if char == '?' {
+			n++
+			builder.WriteString("$" + strconv.Itoa(n))
+		} else {
+			builder.WriteRune(char)
+		}
+	}
+	return builder.String()
+}
+
+// GetLockExpiration returns how long a task lock lease is held before it is considered abandoned.
+func (storage *SqlTaskStorage) GetLockExpiration() time.Duration {
+	return lockExpirationFromEnv()
+}
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (storage *SqlTaskStorage) insertTask(execer sqlExecer, task *Task) (err error) {
+	taskJson, jsonErr := marshalStoredTask(task)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	_, err = execer.Exec(storage.rebind(`INSERT INTO crew_tasks
+		(id, task_group_id, name, worker, workgroup, task_key, remaining_attempts, is_paused, is_complete, is_seed, busy_executing, status, lease_token, run_after, created_at, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		task.Id, task.TaskGroupId, task.Name, task.Worker, task.Workgroup, task.Key, task.RemainingAttempts,
+		task.IsPaused, task.IsComplete, task.IsSeed, task.BusyExecuting, string(task.Status), task.LeaseToken, task.RunAfter.UTC(), task.CreatedAt.UTC(), string(taskJson))
+	if err != nil {
+		return err
+	}
+
+	for _, parentId := range task.ParentIds {
+		_, err = execer.Exec(storage.rebind(`INSERT INTO crew_task_edges (parent_id, child_id) VALUES (?, ?)`), parentId, task.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (storage *SqlTaskStorage) updateTask(execer sqlExecer, task *Task) (err error) {
+	updated, err := storage.updateTaskWhere(execer, task, "")
+	if err != nil {
+		return err
+	}
+	if !updated {
+		// Task was deleted, do not re-create it
+		return errors.New("task not found")
+	}
+	return nil
+}
+
+// updateTaskWhere updates a task's row if it also matches condition (which is ANDed with the id), updated is false
+// when no row matched.
+func (storage *SqlTaskStorage) updateTaskWhere(execer sqlExecer, task *Task, condition string, conditionArgs ...interface{}) (updated bool, err error) {
+	taskJson, jsonErr := marshalStoredTask(task)
+	if jsonErr != nil {
+		return false, jsonErr
+	}
+
+	// Note that workgroup, key, task group and parents are not updated (see TODO in task_storage.go)
+	args := []interface{}{task.Name, task.Worker, task.RemainingAttempts, task.IsPaused, task.IsComplete, task.IsSeed, task.BusyExecuting,
+		string(task.Status), task.LeaseToken, task.RunAfter.UTC(), string(taskJson), task.Id}
+	result, err := execer.Exec(storage.rebind(`UPDATE crew_tasks SET
+		name = ?, worker = ?, remaining_attempts = ?, is_paused = ?, is_complete = ?, is_seed = ?, busy_executing = ?, status = ?, lease_token = ?, run_after = ?, data = ?
+		WHERE id = ?`+condition), append(args, conditionArgs...)...)
+	if err != nil {
+		return false, err
+	}
+	affected, affectedErr := result.RowsAffected()
+	if affectedErr != nil {
+		return false, affectedErr
+	}
+	return affected > 0, nil
+}
+
+// SaveTask saves a task.
+func (storage *SqlTaskStorage) SaveTask(task *Task, create bool) (err error) {
+	if task.Id == "" {
+		task.Id = uuid.New().String()
+	}
+
+	if !create {
+		return storage.updateTask(storage.DB, task)
+	}
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return err
+	}
+	err = storage.insertTask(tx, task)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SaveTasksAtomically saves existing tasks and creates new tasks in a single transaction.
+func (storage *SqlTaskStorage) SaveTasksAtomically(updated []*Task, created []*Task) (err error) {
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, task := range updated {
+		if updateErr := storage.updateTask(tx, task); updateErr != nil {
+			tx.Rollback()
+			return updateErr
+		}
+	}
+	for _, task := range created {
+		if task.Id == "" {
+			task.Id = uuid.New().String()
+		}
+		if insertErr := storage.insertTask(tx, task); insertErr != nil {
+			tx.Rollback()
+			return insertErr
+		}
+	}
+	return tx.Commit()
+}
+
+func (storage *SqlTaskStorage) scanTasks(rows *sql.Rows, rowsErr error) (tasks []*Task, err error) {
+	if rowsErr != nil {
+		return nil, rowsErr
+	}
+	defer rows.Close()
+
+	tasks = make([]*Task, 0)
+	for rows.Next() {
+		taskJson := ""
+		if scanErr := rows.Scan(&taskJson); scanErr != nil {
+			return nil, scanErr
+		}
+		task, parseErr := unmarshalStoredTask([]byte(taskJson))
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+// FindTask finds a task by task id.
+func (storage *SqlTaskStorage) FindTask(taskId string) (task *Task, err error) {
+	tasks, err := storage.scanTasks(storage.DB.Query(storage.rebind(`SELECT data FROM crew_tasks WHERE id = ?`), taskId))
+	if err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
+		return nil, errors.New("task not found")
+	}
+	return tasks[0], nil
+}
+
+// UpdateTaskIf applies update to a task while it still has the given status and lease token.  The row is only
+// written when its status and lease_token columns still match.
+func (storage *SqlTaskStorage) UpdateTaskIf(taskId string, status TaskStatus, leaseToken string, update func(task *Task)) (task *Task, err error) {
+	task, err = storage.FindTask(taskId)
+	if err != nil {
+		return nil, err
+	}
+	if task.Status != status || task.LeaseToken != leaseToken {
+		return nil, ErrTaskChanged
+	}
+	update(task)
+	updated, err := storage.updateTaskWhere(storage.DB, task, " AND status = ? AND lease_token = ?", string(status), leaseToken)
+	if err != nil {
+		return nil, err
+	}
+	if !updated {
+		return nil, ErrTaskChanged
+	}
+	return task, nil
+}
+
+// TryLockTask locks a task by writing a lease onto its row.  Leases expire so that locks held by crashed processes are released.
+func (storage *SqlTaskStorage) TryLockTask(taskId string) (unlocker func() error, err error) {
+	token := uuid.New().String()
+	now := time.Now()
+	expiresAt := now.Add(storage.GetLockExpiration())
+
+	result, err := storage.DB.Exec(storage.rebind(`UPDATE crew_tasks SET lock_token = ?, lock_expires_at = ?
+		WHERE id = ? AND (lock_token IS NULL OR lock_expires_at < ?)`),
+		token, expiresAt.UnixMilli(), taskId, now.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		if _, findErr := storage.FindTask(taskId); findErr != nil {
+			return nil, findErr
+		}
+		return nil, ErrTaskLocked
+	}
+
+	unlocker = func() error {
+		_, unlockErr := storage.DB.Exec(storage.rebind(`UPDATE crew_tasks SET lock_token = NULL, lock_expires_at = NULL
+			WHERE id = ? AND lock_token = ?`), taskId, token)
+		return unlockErr
+	}
+	return unlocker, nil
+}
+
+// DeleteTask deletes a task by task id.
+func (storage *SqlTaskStorage) DeleteTask(taskId string) (err error) {
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if _, execErr := tx.Exec(storage.rebind(`DELETE FROM crew_task_edges WHERE child_id = ? OR parent_id = ?`), taskId, taskId); execErr != nil {
+		tx.Rollback()
+		return execErr
+	}
+	if _, execErr := tx.Exec(storage.rebind(`DELETE FROM crew_task_attempts WHERE task_id = ?`), taskId); execErr != nil {
+		tx.Rollback()
+		return execErr
+	}
+	if _, execErr := tx.Exec(storage.rebind(`DELETE FROM crew_tasks WHERE id = ?`), taskId); execErr != nil {
+		tx.Rollback()
+		return execErr
+	}
+	return tx.Commit()
+}
+
+// GetTaskChildren returns the children of a task.
+func (storage *SqlTaskStorage) GetTaskChildren(taskId string) (tasks []*Task, err error) {
+	return storage.scanTasks(storage.DB.Query(storage.rebind(`SELECT t.data FROM crew_tasks t
+		JOIN crew_task_edges e ON e.child_id = t.id
+		WHERE e.parent_id = ? ORDER BY t.created_at, t.id`), taskId))
+}
+
+// GetTaskParents returns the parents of a task.
+func (storage *SqlTaskStorage) GetTaskParents(taskId string) (tasks []*Task, err error) {
+	if _, findErr := storage.FindTask(taskId); findErr != nil {
+		return nil, findErr
+	}
+	return storage.scanTasks(storage.DB.Query(storage.rebind(`SELECT t.data FROM crew_tasks t
+		JOIN crew_task_edges e ON e.parent_id = t.id
+		WHERE e.child_id = ? ORDER BY t.created_at, t.id`), taskId))
+}
+
+func (storage *SqlTaskStorage) GetTasksInWorkgroup(workgroup string) (tasks []*Task, err error) {
+	return storage.scanTasks(storage.DB.Query(storage.rebind(`SELECT data FROM crew_tasks WHERE workgroup = ? ORDER BY created_at, id`), workgroup))
+}
+
+func (storage *SqlTaskStorage) GetTasksWithKey(key string) (tasks []*Task, err error) {
+	return storage.scanTasks(storage.DB.Query(storage.rebind(`SELECT data FROM crew_tasks WHERE task_key = ? ORDER BY created_at, id`), key))
+}
+
+// GetTasksAwaitingLease returns a worker's running tasks that are waiting for the worker to lease them.
+func (storage *SqlTaskStorage) GetTasksAwaitingLease(worker string) (tasks []*Task, err error) {
+	running, err := storage.scanTasks(storage.DB.Query(storage.rebind(`SELECT data FROM crew_tasks WHERE worker = ? AND status = ? ORDER BY created_at, id`),
+		worker, string(TaskStatusRunning)))
+	if err != nil {
+		return nil, err
+	}
+	tasks = make([]*Task, 0)
+	for _, task := range running {
+		if task.AwaitingLease {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, nil
+}
+
+// SaveTaskGroup saves a task group.
+func (storage *SqlTaskStorage) SaveTaskGroup(taskGroup *TaskGroup, create bool) (err error) {
+	if taskGroup.Id == "" {
+		taskGroup.Id = uuid.New().String()
+	}
+
+	groupJson, jsonErr := json.Marshal(taskGroup)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	if create {
+		_, err = storage.DB.Exec(storage.rebind(`INSERT INTO crew_task_groups (id, name, created_at, data) VALUES (?, ?, ?, ?)`),
+			taskGroup.Id, taskGroup.Name, taskGroup.CreatedAt.UTC(), string(groupJson))
+		return err
+	}
+
+	_, err = storage.DB.Exec(storage.rebind(`UPDATE crew_task_groups SET name = ?, data = ? WHERE id = ?`),
+		taskGroup.Name, string(groupJson), taskGroup.Id)
+	return err
+}
+
+func (storage *SqlTaskStorage) scanTaskGroups(rows *sql.Rows, rowsErr error) (taskGroups []*TaskGroup, err error) {
+	if rowsErr != nil {
+		return nil, rowsErr
+	}
+	defer rows.Close()
+
+	taskGroups = make([]*TaskGroup, 0)
+	for rows.Next() {
+		groupJson := ""
+		if scanErr := rows.Scan(&groupJson); scanErr != nil {
+			return nil, scanErr
+		}
+		taskGroup := NewTaskGroup("", "")
+		if parseErr := json.Unmarshal([]byte(groupJson), &taskGroup); parseErr != nil {
+			return nil, parseErr
+		}
+		taskGroups = append(taskGroups, taskGroup)
+	}
+	return taskGroups, rows.Err()
+}
+
+// AllTaskGroups returns all task groups.
+func (storage *SqlTaskStorage) AllTaskGroups() (taskGroups []*TaskGroup, err error) {
+	return storage.scanTaskGroups(storage.DB.Query(`SELECT data FROM crew_task_groups ORDER BY created_at, id`))
+}
+
+// AllTasksInGroup returns all tasks within a group.
+func (storage *SqlTaskStorage) AllTasksInGroup(taskGroupId string) (tasks []*Task, err error) {
+	return storage.scanTasks(storage.DB.Query(storage.rebind(`SELECT data FROM crew_tasks WHERE task_group_id = ? ORDER BY created_at, id`), taskGroupId))
+}
+
+// FindTaskGroup finds a task group by task group id.
+func (storage *SqlTaskStorage) FindTaskGroup(taskGroupId string) (taskGroup *TaskGroup, err error) {
+	taskGroups, err := storage.scanTaskGroups(storage.DB.Query(storage.rebind(`SELECT data FROM crew_task_groups WHERE id = ?`), taskGroupId))
+	if err != nil {
+		return nil, err
+	}
+	if len(taskGroups) == 0 {
+		return nil, errors.New("task group not found")
+	}
+	return taskGroups[0], nil
+}
+
+// DeleteTaskGroup deletes a task group (and all of its tasks) by task group id.
+func (storage *SqlTaskStorage) DeleteTaskGroup(taskGroupId string) (err error) {
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		`DELETE FROM crew_task_edges WHERE child_id IN (SELECT id FROM crew_tasks WHERE task_group_id = ?)`,
+		`DELETE FROM crew_task_edges WHERE parent_id IN (SELECT id FROM crew_tasks WHERE task_group_id = ?)`,
+		`DELETE FROM crew_task_attempts WHERE task_id IN (SELECT id FROM crew_tasks WHERE task_group_id = ?)`,
+		`DELETE FROM crew_tasks WHERE task_group_id = ?`,
+		`DELETE FROM crew_task_groups WHERE id = ?`,
+	} {
+		if _, execErr := tx.Exec(storage.rebind(query), taskGroupId); execErr != nil {
+			tx.Rollback()
+			return execErr
+		}
+	}
+	return tx.Commit()
+}
+
+// SaveAttempt saves an attempt, replacing any previously saved attempt with the same id.
+func (storage *SqlTaskStorage) SaveAttempt(attempt *Attempt) (err error) {
+	attemptJson, jsonErr := json.Marshal(attempt)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	_, err = storage.DB.Exec(storage.rebind(`INSERT INTO crew_task_attempts (id, task_id, number, started_at, data) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET data = excluded.data`),
+		attempt.Id, attempt.TaskId, attempt.Number, attempt.StartedAt.UTC(), string(attemptJson))
+	return err
+}
+
+// GetTaskAttempts returns a task's attempts, oldest first.
+func (storage *SqlTaskStorage) GetTaskAttempts(taskId string) (attempts []*Attempt, err error) {
+	rows, err := storage.DB.Query(storage.rebind(`SELECT data FROM crew_task_attempts WHERE task_id = ? ORDER BY number, started_at`), taskId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts = make([]*Attempt, 0)
+	for rows.Next() {
+		attemptJson := ""
+		if scanErr := rows.Scan(&attemptJson); scanErr != nil {
+			return nil, scanErr
+		}
+		attempt := Attempt{}
+		if parseErr := json.Unmarshal([]byte(attemptJson), &attempt); parseErr != nil {
+			return nil, parseErr
+		}
+		attempts = append(attempts, &attempt)
+	}
+	return attempts, rows.Err()
+}
+
+// SaveWorkgroup saves a workgroup, replacing any previously saved workgroup with the same name.
+func (storage *SqlTaskStorage) SaveWorkgroup(workgroup *Workgroup) (err error) {
+	workgroupJson, jsonErr := json.Marshal(workgroup)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	_, err = storage.DB.Exec(storage.rebind(`INSERT INTO crew_workgroups (name, data) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET data = excluded.data`),
+		workgroup.Name, string(workgroupJson))
+	return err
+}
+
+// FindWorkgroup returns a workgroup with default settings if the workgroup has never been saved.
+func (storage *SqlTaskStorage) FindWorkgroup(name string) (workgroup *Workgroup, err error) {
+	workgroupJson := ""
+	err = storage.DB.QueryRow(storage.rebind(`SELECT data FROM crew_workgroups WHERE name = ?`), name).Scan(&workgroupJson)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NewWorkgroup(name), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	workgroup = &Workgroup{}
+	if parseErr := json.Unmarshal([]byte(workgroupJson), workgroup); parseErr != nil {
+		return nil, parseErr
+	}
+	return workgroup, nil
+}
+
+// AllWorkgroups returns all saved workgroups, sorted by name.
+func (storage *SqlTaskStorage) AllWorkgroups() (workgroups []*Workgroup, err error) {
+	rows, err := storage.DB.Query(`SELECT data FROM crew_workgroups ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workgroups = make([]*Workgroup, 0)
+	for rows.Next() {
+		workgroupJson := ""
+		if scanErr := rows.Scan(&workgroupJson); scanErr != nil {
+			return nil, scanErr
+		}
+		workgroup := Workgroup{}
+		if parseErr := json.Unmarshal([]byte(workgroupJson), &workgroup); parseErr != nil {
+			return nil, parseErr
+		}
+		workgroups = append(workgroups, &workgroup)
+	}
+	return workgroups, rows.Err()
+}
@@ -1,31 +1,46 @@
 package crew
 
 import (
+	"encoding/json"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 // A Task represents a unit of work that can be completed by a worker.
 // IMPORTANT! If you change task's fields, also update Task.ts in crew-go-javascript
 type Task struct {
-	Id                  string      `json:"id"`
-	TaskGroupId         string      `json:"taskGroupId"`
-	Name                string      `json:"name"`
-	Worker              string      `json:"worker"`
-	Workgroup           string      `json:"workgroup"`
-	Key                 string      `json:"key"`
-	RemainingAttempts   int         `json:"remainingAttempts"`
-	IsPaused            bool        `json:"isPaused"`
-	IsComplete          bool        `json:"isComplete"`
-	RunAfter            time.Time   `json:"runAfter"`
-	IsSeed              bool        `json:"isSeed"`
-	ErrorDelayInSeconds int         `json:"errorDelayInSeconds"`
-	Input               interface{} `json:"input"`
-	Output              interface{} `json:"output"`
-	Errors              []string    `json:"errors"`
-	CreatedAt           time.Time   `json:"createdAt"`
-	ParentIds           []string    `json:"parentIds"`
-	BusyExecuting       bool        `json:"busyExecuting"`
-	Storage             TaskStorage `json:"-"`
+	Id                  string       `json:"id"`
+	TaskGroupId         string       `json:"taskGroupId"`
+	Name                string       `json:"name"`
+	Worker              string       `json:"worker"`
+	Workgroup           string       `json:"workgroup"`
+	Key                 string       `json:"key"`
+	RemainingAttempts   int          `json:"remainingAttempts"`
+	IsPaused            bool         `json:"isPaused"`
+	IsComplete          bool         `json:"isComplete"`
+	RunAfter            time.Time    `json:"runAfter"`
+	IsSeed              bool         `json:"isSeed"`
+	ErrorDelayInSeconds int          `json:"errorDelayInSeconds"`
+	Priority            int          `json:"priority"`
+	TimeoutInSeconds    int          `json:"timeoutInSeconds"`
+	RetryPolicy         *RetryPolicy `json:"retryPolicy"`
+	FirstFailureAt      time.Time    `json:"firstFailureAt"`
+	Input               interface{}  `json:"input"`
+	Output              interface{}  `json:"output"`
+	Errors              []string     `json:"errors"`
+	CreatedAt           time.Time    `json:"createdAt"`
+	ParentIds           []string     `json:"parentIds"`
+	BusyExecuting       bool         `json:"busyExecuting"`
+	Status              TaskStatus   `json:"status"`
+	LeaseOwner          string       `json:"leaseOwner"`
+	LeaseToken          string       `json:"-"`
+	LeaseExpiresAt      time.Time    `json:"leaseExpiresAt"`
+	AwaitingCompletion  bool         `json:"awaitingCompletion"`
+	AwaitingLease       bool         `json:"awaitingLease"`
+	Progress            float64      `json:"progress"`
+	ProgressMessage     string       `json:"progressMessage"`
+	Storage             TaskStorage  `json:"-"`
 }
 
 // NewTask creates a new Task.
@@ -43,28 +58,65 @@ func NewTask() *Task {
 		RunAfter:            time.Now(),
 		IsSeed:              false,
 		ErrorDelayInSeconds: 60,
+		Priority:            0,
+		TimeoutInSeconds:    0,
+		RetryPolicy:         nil,
 		Input:               nil,
 		Output:              nil,
 		Errors:              make([]string, 0),
 		CreatedAt:           time.Now(),
 		ParentIds:           make([]string, 0),
 		BusyExecuting:       false,
+		Status:              TaskStatusPending,
 	}
 	return &task
 }
 
+// storedTask is the json that storages keep for a task.  LeaseToken is the credential for completing and heartbeating
+// the task so it is left out of api responses and feed events, but it has to be persisted.
+type storedTask struct {
+	*Task
+	LeaseToken string `json:"leaseToken"`
+}
+
+// marshalStoredTask serializes a task for storage.
+func marshalStoredTask(task *Task) ([]byte, error) {
+	return json.Marshal(storedTask{Task: task, LeaseToken: task.LeaseToken})
+}
+
+// unmarshalStoredTask parses a task that was serialized with marshalStoredTask.
+func unmarshalStoredTask(data []byte) (*Task, error) {
+	stored := storedTask{Task: NewTask()}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	stored.Task.LeaseToken = stored.LeaseToken
+	return stored.Task, nil
+}
+
 // CanExecute determines if a Task is in a state where it can be executed.
-func (task *Task) CanExecute(parents []*Task) bool {
+// workgroup is the task's workgroup (nil if the task doesn't have one).
+func (task *Task) CanExecute(parents []*Task, workgroup *Workgroup) bool {
 	// Task should not execute if
 	// - it is already complete
 	// - it is paused
 	// - it has no remaining attempts
 	// - its task group is paused
-	// Note that we do not check runAfter here, task timing is handled by operator
+	// - its workgroup is paused
+	// - it has failed, been canceled or skipped
+	// Note that we do not check runAfter (or the workgroup's pausedUntil) here, task timing is handled by operator
 	if task.IsComplete || task.IsPaused || task.RemainingAttempts <= 0 {
 		return false
 	}
 
+	if workgroup != nil && workgroup.IsPaused {
+		return false
+	}
+
+	if task.Status == TaskStatusFailed || task.Status == TaskStatusCanceled || task.Status == TaskStatusSkipped {
+		return false
+	}
+
 	if task.Worker == "" {
 		return false
 	}
@@ -78,3 +130,47 @@ func (task *Task) CanExecute(parents []*Task) bool {
 
 	return true
 }
+
+// StartAfter returns the earliest time the task may start, its runAfter or its workgroup's pausedUntil.
+func (task *Task) StartAfter(workgroup *Workgroup) time.Time {
+	if workgroup != nil && workgroup.PausedUntil.After(task.RunAfter) {
+		return workgroup.PausedUntil
+	}
+	return task.RunAfter
+}
+
+// RetryDelay returns how long to wait before retrying the task given its failures so far.
+// Tasks without a retry policy wait a fixed ErrorDelayInSeconds.
+func (task *Task) RetryDelay() time.Duration {
+	baseDelay := time.Duration(task.ErrorDelayInSeconds) * time.Second
+	if task.RetryPolicy == nil {
+		return baseDelay
+	}
+	return task.RetryPolicy.Delay(len(task.Errors), baseDelay)
+}
+
+// AcquireLease records which crew instance is executing the task and when that claim runs out.
+func (task *Task) AcquireLease(owner string, duration time.Duration) {
+	task.LeaseOwner = owner
+	task.LeaseToken = uuid.New().String()
+	task.LeaseExpiresAt = time.Now().Add(duration)
+}
+
+// ReleaseLease clears the task's execution lease and the progress its worker reported.
+func (task *Task) ReleaseLease() {
+	task.LeaseOwner = ""
+	task.LeaseToken = ""
+	task.LeaseExpiresAt = time.Time{}
+	task.AwaitingCompletion = false
+	task.AwaitingLease = false
+	task.Progress = 0
+	task.ProgressMessage = ""
+}
+
+// LeaseExpired returns true if the task is marked as executing but nobody holds a live lease on it.
+func (task *Task) LeaseExpired(now time.Time) bool {
+	if task.Status != TaskStatusRunning && !task.BusyExecuting {
+		return false
+	}
+	return task.LeaseExpiresAt.IsZero() || task.LeaseExpiresAt.Before(now)
+}
@@ -2,6 +2,7 @@ package crew
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,21 +10,26 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type ChildTask struct {
-	Id                  string      `json:"id"`
-	Name                string      `json:"name"`
-	Worker              string      `json:"worker"`
-	Workgroup           string      `json:"workgroup"`
-	Key                 string      `json:"key"`
-	RemainingAttempts   int         `json:"remainingAttempts"`
-	IsPaused            bool        `json:"isPaused"`
-	RunAfter            time.Time   `json:"runAfter"`
-	ErrorDelayInSeconds int         `json:"errorDelayInSeconds"`
-	Input               interface{} `json:"input"`
-	ParentIds           []string    `json:"parentIds"`
+	Id                  string       `json:"id"`
+	Name                string       `json:"name"`
+	Worker              string       `json:"worker"`
+	Workgroup           string       `json:"workgroup"`
+	Key                 string       `json:"key"`
+	RemainingAttempts   int          `json:"remainingAttempts"`
+	IsPaused            bool         `json:"isPaused"`
+	RunAfter            time.Time    `json:"runAfter"`
+	ErrorDelayInSeconds int          `json:"errorDelayInSeconds"`
+	Priority            *int         `json:"priority"`
+	TimeoutInSeconds    int          `json:"timeoutInSeconds"`
+	RetryPolicy         *RetryPolicy `json:"retryPolicy"`
+	Input               interface{}  `json:"input"`
+	ParentIds           []string     `json:"parentIds"`
 }
 
 // WorkerResponse defines the schema of output returned from workers.
@@ -33,16 +39,107 @@ type WorkerResponse struct {
 	WorkgroupDelayInSeconds int          `json:"workgroupDelayInSeconds"`
 	ChildrenDelayInSeconds  int          `json:"childrenDelayInSeconds"`
 	Error                   interface{}  `json:"error"`
+	Retryable               *bool        `json:"retryable"`
+	// DeadlineInSeconds can be sent with a 202 acknowledgement to override the controller's AsyncDeadline.
+	DeadlineInSeconds int `json:"deadlineInSeconds"`
+	// WorkerUrl, StatusCode and RawBody describe the call itself and are used for attempt history.
+	WorkerUrl  string `json:"-"`
+	StatusCode int    `json:"-"`
+	RawBody    string `json:"-"`
+	// Async is set when the worker accepted the task (202) and will report its result via the complete endpoint.
+	Async bool `json:"-"`
+	// Queued is set along with Async when the task waits for its worker to lease it (see PullTaskClient).
+	Queued bool `json:"-"`
+}
+
+// WorkerError is returned by task clients when a worker call fails.
+type WorkerError struct {
+	Message    string
+	StatusCode int
+	Retryable  bool
+}
+
+func (err *WorkerError) Error() string {
+	return err.Message
+}
+
+// RateLimitError is returned by task clients when a worker (or the api behind it) asks crew to back off.
+// The task is retried after RetryAfter without using up an attempt and the rest of its workgroup is delayed as well.
+type RateLimitError struct {
+	Message    string
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (err *RateLimitError) Error() string {
+	return err.Message
+}
+
+// TimeoutError is recorded when a worker doesn't respond within the task's timeout.
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (err *TimeoutError) Error() string {
+	return fmt.Sprintf("Worker did not respond within %v", err.Timeout)
+}
+
+// ParseRetryAfter parses the value of a Retry-After header, which is either a number of seconds or an http date.
+func ParseRetryAfter(value string, now time.Time) (delay time.Duration, ok bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if date.Before(now) {
+			return 0, true
+		}
+		return date.Sub(now), true
+	}
+	return 0, false
+}
+
+// IsRetryableError returns false for errors that should fail a task immediately instead of being retried.
+// Errors that are not a WorkerError (timeouts, connection refused, etc) are considered retryable.
+func IsRetryableError(err error) bool {
+	var workerErr *WorkerError
+	if errors.As(err, &workerErr) {
+		return workerErr.Retryable
+	}
+	return true
+}
+
+// IsRetryableStatusCode returns true for http status codes that indicate a transient failure.
+func IsRetryableStatusCode(statusCode int) bool {
+	return statusCode >= 500 || statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests
 }
 
 // TaskClient defines the interface for delivering tasks to workers.
+// Post should abandon the call and return an error once ctx is canceled (ctx also carries the task's timeout).
 type TaskClient interface {
-	Post(task *Task, parents []*Task) (response WorkerResponse, err error)
+	Post(ctx context.Context, task *Task, parents []*Task) (response WorkerResponse, err error)
+}
+
+// TaskCanceler is optionally implemented by task clients that can tell a worker to stop working on a canceled task.
+type TaskCanceler interface {
+	Cancel(ctx context.Context, task *Task) (err error)
 }
 
 // HttpPostClient delivers tasks to workers via http post.
 type HttpPostClient struct {
 	UrlForTask func(task *Task) (url string, err error) `json:"-"`
+	// CancelUrlForTask returns the url that is notified when a running task is canceled, workers are not notified when nil.
+	CancelUrlForTask func(task *Task) (url string, err error) `json:"-"`
+	// Routes, when set, is used instead of UrlForTask and tasks for workers without a route fail without being retried.
+	Routes *WorkerRoutes `json:"-"`
+	// SigningSecret, when set, is used to sign each call so that workers can verify it came from crew (see SignRequest).
+	SigningSecret string `json:"-"`
 }
 
 // NewHttpPostClient creates a new HttpPostClient.
@@ -63,15 +160,72 @@ func NewHttpPostClient() *HttpPostClient {
 	client := HttpPostClient{
 		UrlForTask: urlGenerator,
 	}
+	if secrets := SigningSecretsFromEnv("CREW_WORKER_SIGNING_SECRET"); len(secrets) > 0 {
+		client.SigningSecret = secrets[0]
+	}
+
+	// Workers that support cancellation listen on their own url + this suffix (for example /cancel)
+	cancelSuffix := os.Getenv("CREW_WORKER_CANCEL_SUFFIX")
+	if cancelSuffix != "" {
+		client.CancelUrlForTask = func(task *Task) (url string, err error) {
+			workerUrl, _, err := client.route(task)
+			if err != nil {
+				return "", err
+			}
+			return workerUrl + cancelSuffix, nil
+		}
+	}
 	return &client
 }
 
+// route returns the url for a task's worker along with its route (nil when Routes isn't set).
+func (client *HttpPostClient) route(task *Task) (url string, route *WorkerRoute, err error) {
+	if client.Routes == nil {
+		url, err = client.UrlForTask(task)
+		return url, nil, err
+	}
+	route, err = client.Routes.Find(task.Worker)
+	if err != nil {
+		return "", nil, err
+	}
+	return route.UrlFor(task.Worker), route, nil
+}
+
+// newRequest builds a signed post to a worker with the authorization header and the route's headers.
+func (client *HttpPostClient) newRequest(ctx context.Context, url string, route *WorkerRoute, taskId string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	// The default header is meant for the default workers, routes may point at other hosts and have to opt in
+	authHeader, ok := os.LookupEnv("CREW_WORKER_AUTHORIZATION_HEADER")
+	if ok && (route == nil || route.SendDefaultAuthorization) {
+		req.Header.Set("Authorization", authHeader)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signingSecret := client.SigningSecret
+	if route != nil {
+		for name, value := range route.Headers {
+			req.Header.Set(name, value)
+		}
+		if route.SigningSecret != "" {
+			signingSecret = route.SigningSecret
+		}
+	}
+	if signingSecret != "" {
+		SignRequest(req, signingSecret, taskId, body)
+	}
+	return req, nil
+}
+
 // WorkerPayload defines the input sent to a worker (post body).
 type WorkerPayload struct {
 	Input   interface{}                 `json:"input"`
 	Worker  string                      `json:"worker"`
 	Parents []WorkerPayloadParentResult `json:"parents"`
 	TaskId  string                      `json:"taskId"`
+	// CompletionToken authorizes the worker to report this attempt's result via POST /api/v1/task/:task_id/complete.
+	CompletionToken string `json:"completionToken"`
 }
 
 // WorkerPayloadParentResult defines the schema for output from a worker.
@@ -82,8 +236,8 @@ type WorkerPayloadParentResult struct {
 	Output interface{} `json:"output"`
 }
 
-// Post delivers a task to a worker.
-func (client *HttpPostClient) Post(task *Task, parents []*Task) (response WorkerResponse, err error) {
+// newWorkerPayload builds the payload that is sent to a task's worker.
+func newWorkerPayload(task *Task, parents []*Task) WorkerPayload {
 	// Start preparing the task input by gathering info from parents
 	payloadParents := []WorkerPayloadParentResult{}
 
@@ -99,12 +253,19 @@ func (client *HttpPostClient) Post(task *Task, parents []*Task) (response Worker
 		payloadParents = append(payloadParents, parentResult)
 	}
 
-	payload := WorkerPayload{
+	return WorkerPayload{
 		Input:   task.Input,
 		Parents: payloadParents,
 		Worker:  task.Worker,
 		TaskId:  task.Id,
+		// The lease token changes with every attempt, so late callbacks from earlier attempts are rejected
+		CompletionToken: task.LeaseToken,
 	}
+}
+
+// Post delivers a task to a worker.
+func (client *HttpPostClient) Post(ctx context.Context, task *Task, parents []*Task) (response WorkerResponse, err error) {
+	payload := newWorkerPayload(task, parents)
 
 	payloadJsonStr, buildPayloadErr := json.Marshal(payload)
 	if buildPayloadErr != nil {
@@ -112,48 +273,93 @@ func (client *HttpPostClient) Post(task *Task, parents []*Task) (response Worker
 	}
 	payloadBytes := []byte(payloadJsonStr)
 
-	url, urlError := client.UrlForTask(task)
+	url, route, urlError := client.route(task)
 	if urlError != nil {
+		var unknownErr *UnknownWorkerError
+		if errors.As(urlError, &unknownErr) {
+			// Retrying won't help until the routes are fixed
+			return WorkerResponse{}, &WorkerError{Message: unknownErr.Error(), Retryable: false}
+		}
 		return WorkerResponse{}, urlError
 	}
 
 	// fmt.Println("~~ Sending task to", url, task.Worker)
 
+	// The timeout comes from ctx (see TaskController.TaskTimeout), routes can shorten it
+	callCtx := ctx
+	httpClient := &http.Client{}
+	if route != nil {
+		httpClient = route.HttpClient()
+		if route.TimeoutInSeconds > 0 {
+			routeCtx, cancelRoute := context.WithTimeout(ctx, route.Timeout())
+			defer cancelRoute()
+			callCtx = routeCtx
+		}
+	}
+
 	// Build the request
-	req, reqSetupErr := http.NewRequest("POST", url, bytes.NewBuffer(payloadBytes))
+	req, reqSetupErr := client.newRequest(callCtx, url, route, task.Id, payloadBytes)
 	if reqSetupErr != nil {
 		return WorkerResponse{}, reqSetupErr
 	}
-	authHeader, ok := os.LookupEnv("CREW_WORKER_AUTHORIZATION_HEADER")
-	if ok {
-		req.Header.Set("Authorization", authHeader)
-	}
-	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 
 	// fmt.Println("~~ Worker Request", string(payloadJsonStr))
 
 	// Send the request
-	httpClient := &http.Client{}
-	// Set a very generous timeout (crew docs recommend tasks should complete in 60 seconds)
-	// TODO - set this with an env var?
-	httpClient.Timeout = 300 * time.Second
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return WorkerResponse{}, err
+		if errors.Is(callCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			err = &TimeoutError{Timeout: route.Timeout()}
+		}
+		return WorkerResponse{WorkerUrl: url}, err
 	}
 
 	// Read the response
 	defer resp.Body.Close()
 	bodyBytes, bodyErr := io.ReadAll(resp.Body)
+	callInfo := WorkerResponse{
+		WorkerUrl:  url,
+		StatusCode: resp.StatusCode,
+		RawBody:    string(bodyBytes),
+	}
 	if bodyErr != nil {
-		return WorkerResponse{}, bodyErr
+		return callInfo, bodyErr
+	}
+
+	// 202 response => worker will report the result later, the body may hold a deadlineInSeconds
+	if resp.StatusCode == http.StatusAccepted {
+		ack := WorkerResponse{}
+		if json.Unmarshal(bodyBytes, &ack) == nil {
+			callInfo.DeadlineInSeconds = ack.DeadlineInSeconds
+		}
+		callInfo.Async = true
+		return callInfo, nil
 	}
 
 	// Non 200 response => return response body via call error
 	if resp.StatusCode != http.StatusOK {
 		errorMessage := fmt.Sprintf("Http call to worker returned non 200 status code: %d, body: %v", resp.StatusCode, string(bodyBytes))
-		return WorkerResponse{}, errors.New(errorMessage)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			if retryAfter, ok := ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				return callInfo, &RateLimitError{
+					Message:    errorMessage,
+					StatusCode: resp.StatusCode,
+					RetryAfter: retryAfter,
+				}
+			}
+		}
+		workerErr := &WorkerError{
+			Message:    errorMessage,
+			StatusCode: resp.StatusCode,
+			Retryable:  IsRetryableStatusCode(resp.StatusCode),
+		}
+		// Workers can override the status code's classification with "retryable" in the response body
+		errorResp := WorkerResponse{}
+		if json.Unmarshal(bodyBytes, &errorResp) == nil && errorResp.Retryable != nil {
+			workerErr.Retryable = *errorResp.Retryable
+		}
+		return callInfo, workerErr
 	}
 
 	// bodyString := string(bodyBytes)
@@ -163,8 +369,56 @@ func (client *HttpPostClient) Post(task *Task, parents []*Task) (response Worker
 	workerResp := WorkerResponse{}
 	jsonErr := json.Unmarshal(bodyBytes, &workerResp) // when logging code above is no longer needed : json.NewDecoder(resp.Body).Decode(&workerResp)
 	if jsonErr != nil {
-		return WorkerResponse{}, jsonErr
+		return callInfo, jsonErr
 	}
+	workerResp.WorkerUrl = callInfo.WorkerUrl
+	workerResp.StatusCode = callInfo.StatusCode
+	workerResp.RawBody = callInfo.RawBody
 
 	return workerResp, nil
 }
+
+// Cancel notifies a worker that a task it is working on has been canceled.
+func (client *HttpPostClient) Cancel(ctx context.Context, task *Task) (err error) {
+	if client.CancelUrlForTask == nil {
+		return nil
+	}
+	url, urlError := client.CancelUrlForTask(task)
+	if urlError != nil {
+		return urlError
+	}
+
+	payloadJsonStr, buildPayloadErr := json.Marshal(map[string]interface{}{
+		"taskId": task.Id,
+		"worker": task.Worker,
+	})
+	if buildPayloadErr != nil {
+		return buildPayloadErr
+	}
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	var route *WorkerRoute
+	if client.Routes != nil {
+		if route, err = client.Routes.Find(task.Worker); err != nil {
+			return err
+		}
+		// Use the route's tls settings without changing its client's timeout
+		httpClient.Transport = route.HttpClient().Transport
+	}
+
+	req, reqSetupErr := client.newRequest(ctx, url, route, task.Id, payloadJsonStr)
+	if reqSetupErr != nil {
+		return reqSetupErr
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Http call to worker cancel returned non 2xx status code: %d", resp.StatusCode)
+	}
+	return nil
+}
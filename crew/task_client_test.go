@@ -1,11 +1,13 @@
 package crew
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestSuccessResponse(t *testing.T) {
@@ -32,7 +34,7 @@ func TestSuccessResponse(t *testing.T) {
 	task.Worker = "worker-a"
 	parents := make([]*Task, 0)
 
-	response, postError := client.Post(task, parents)
+	response, postError := client.Post(context.Background(), task, parents)
 
 	if postError != nil {
 		t.Fatal("Recieved an unexpected response error", postError)
@@ -72,11 +74,14 @@ func TestHttpErrorResponse(t *testing.T) {
 	task.Worker = "worker-a"
 	parents := make([]*Task, 0)
 
-	_, postError := client.Post(task, parents)
+	response, postError := client.Post(context.Background(), task, parents)
 
 	if postError == nil || postError.Error() != "Http call to worker returned non 200 status code: 500, body: I am confused..." {
 		t.Fatalf("Expected to receive error, but got %v", postError)
 	}
+	if response.WorkerUrl != server.URL+"/test-worker" || response.StatusCode != 500 || response.RawBody != "I am confused..." {
+		t.Fatalf("Expected call info in response, got %v %v %v", response.WorkerUrl, response.StatusCode, response.RawBody)
+	}
 }
 
 func TestErrorResponse(t *testing.T) {
@@ -103,7 +108,7 @@ func TestErrorResponse(t *testing.T) {
 	task.Worker = "worker-a"
 	parents := make([]*Task, 0)
 
-	response, postError := client.Post(task, parents)
+	response, postError := client.Post(context.Background(), task, parents)
 
 	if postError != nil {
 		t.Fatal("Recieved an unexpected response error", postError)
@@ -182,7 +187,7 @@ func TestParentDataInPayload(t *testing.T) {
 	parents := make([]*Task, 0)
 	parents = append(parents, task)
 
-	_, postError := client.Post(child, parents)
+	_, postError := client.Post(context.Background(), child, parents)
 	if postError != nil {
 		t.Fatal("Recieved an unexpected response error", postError)
 	}
@@ -212,7 +217,7 @@ func TestChildrenResponse(t *testing.T) {
 	task.Worker = "worker-a"
 	parents := make([]*Task, 0)
 
-	response, postError := client.Post(task, parents)
+	response, postError := client.Post(context.Background(), task, parents)
 
 	if postError != nil {
 		t.Fatal("Recieved an unexpected response error", postError)
@@ -227,3 +232,248 @@ func TestChildrenResponse(t *testing.T) {
 		t.Fatalf(`response.Children[0].Id = %v, want %v`, response.Children[0].Id, "task17")
 	}
 }
+
+func TestPermanentHttpErrorResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`invalid input`))
+	}))
+	defer server.Close()
+
+	client := NewHttpPostClient()
+	client.UrlForTask = func(task *Task) (url string, err error) {
+		return server.URL + "/test-worker", nil
+	}
+
+	task := NewTask()
+	task.Id = "task45"
+	task.Name = "task45"
+	task.Worker = "worker-a"
+
+	_, postError := client.Post(context.Background(), task, make([]*Task, 0))
+	if postError == nil {
+		t.Fatal("Expected to receive error")
+	}
+	if IsRetryableError(postError) {
+		t.Fatal("Expected 400 response to be a permanent error")
+	}
+}
+
+func TestRetryableHttpErrorResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`try again later`))
+	}))
+	defer server.Close()
+
+	client := NewHttpPostClient()
+	client.UrlForTask = func(task *Task) (url string, err error) {
+		return server.URL + "/test-worker", nil
+	}
+
+	task := NewTask()
+	task.Id = "task46"
+	task.Name = "task46"
+	task.Worker = "worker-a"
+
+	_, postError := client.Post(context.Background(), task, make([]*Task, 0))
+	if postError == nil {
+		t.Fatal("Expected to receive error")
+	}
+	if !IsRetryableError(postError) {
+		t.Fatal("Expected 503 response to be a retryable error")
+	}
+}
+
+func TestRetryableOverrideInErrorResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"bad input","retryable":false}`))
+	}))
+	defer server.Close()
+
+	client := NewHttpPostClient()
+	client.UrlForTask = func(task *Task) (url string, err error) {
+		return server.URL + "/test-worker", nil
+	}
+
+	task := NewTask()
+	task.Id = "task47"
+	task.Name = "task47"
+	task.Worker = "worker-a"
+
+	_, postError := client.Post(context.Background(), task, make([]*Task, 0))
+	if postError == nil {
+		t.Fatal("Expected to receive error")
+	}
+	if IsRetryableError(postError) {
+		t.Fatal("Expected retryable:false in body to make the error permanent")
+	}
+}
+
+func TestConnectionRefusedIsRetryable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := server.URL
+	server.Close()
+
+	client := NewHttpPostClient()
+	client.UrlForTask = func(task *Task) (string, error) {
+		return url + "/test-worker", nil
+	}
+
+	task := NewTask()
+	task.Id = "task48"
+	task.Name = "task48"
+	task.Worker = "worker-a"
+
+	_, postError := client.Post(context.Background(), task, make([]*Task, 0))
+	if postError == nil {
+		t.Fatal("Expected to receive error")
+	}
+	if !IsRetryableError(postError) {
+		t.Fatal("Expected connection refused to be a retryable error")
+	}
+}
+
+func TestRateLimitResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`slow down`))
+	}))
+	defer server.Close()
+
+	client := NewHttpPostClient()
+	client.UrlForTask = func(task *Task) (url string, err error) {
+		return server.URL + "/test-worker", nil
+	}
+
+	task := NewTask()
+	task.Id = "task119"
+	task.Name = "task119"
+	task.Worker = "worker-a"
+
+	response, postError := client.Post(context.Background(), task, make([]*Task, 0))
+	rateLimitErr, ok := postError.(*RateLimitError)
+	if !ok {
+		t.Fatalf("Expected a rate limit error, got %v", postError)
+	}
+	if rateLimitErr.RetryAfter != 30*time.Second || rateLimitErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Unexpected rate limit error %+v", rateLimitErr)
+	}
+	if response.StatusCode != http.StatusTooManyRequests || response.RawBody != "slow down" {
+		t.Fatalf("Expected call info in response, got %v %v", response.StatusCode, response.RawBody)
+	}
+}
+
+func TestAcceptedResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := WorkerPayload{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		if payload.CompletionToken != "token-a" {
+			t.Errorf("Expected completion token in payload, got: %v", payload.CompletionToken)
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"deadlineInSeconds":120,"output":"ignored"}`))
+	}))
+	defer server.Close()
+
+	client := NewHttpPostClient()
+	client.UrlForTask = func(task *Task) (url string, err error) {
+		return server.URL + "/test-worker", nil
+	}
+
+	task := NewTask()
+	task.Id = "task136"
+	task.Name = "task136"
+	task.Worker = "worker-a"
+	task.LeaseToken = "token-a"
+
+	response, postError := client.Post(context.Background(), task, make([]*Task, 0))
+	if postError != nil {
+		t.Fatal("Recieved an unexpected response error", postError)
+	}
+	if !response.Async || response.DeadlineInSeconds != 120 || response.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected an async acknowledgement, got %+v", response)
+	}
+	if response.Output != nil {
+		t.Fatalf("Expected acknowledgement output to be ignored, got %v", response.Output)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	delay, ok := ParseRetryAfter("120", now)
+	if !ok || delay != 2*time.Minute {
+		t.Fatalf("Expected 2m, got %v %v", delay, ok)
+	}
+	delay, ok = ParseRetryAfter("Mon, 01 May 2023 12:00:45 GMT", now)
+	if !ok || delay != 45*time.Second {
+		t.Fatalf("Expected 45s, got %v %v", delay, ok)
+	}
+	delay, ok = ParseRetryAfter("Mon, 01 May 2023 11:00:00 GMT", now)
+	if !ok || delay != 0 {
+		t.Fatalf("Expected a date in the past to mean no delay, got %v %v", delay, ok)
+	}
+	for _, invalid := range []string{"", "-5", "soon"} {
+		if _, ok := ParseRetryAfter(invalid, now); ok {
+			t.Fatalf("Expected %v to be invalid", invalid)
+		}
+	}
+}
+
+func TestPostAbortsWhenContextCanceled(t *testing.T) {
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := NewHttpPostClient()
+	client.UrlForTask = func(task *Task) (url string, err error) {
+		return server.URL + "/test-worker", nil
+	}
+
+	task := NewTask()
+	task.Id = "task69"
+	task.Worker = "worker-a"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, postError := client.Post(ctx, task, make([]*Task, 0))
+	if postError == nil {
+		t.Fatal("Expected canceled post to fail")
+	}
+}
+
+func TestCancelNotifiesWorker(t *testing.T) {
+	var cancelPayload map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/test-worker/cancel" {
+			t.Errorf("Unexpected path %v", r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(&cancelPayload)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	t.Setenv("CREW_WORKER_CANCEL_SUFFIX", "/cancel")
+	client := NewHttpPostClient()
+	client.UrlForTask = func(task *Task) (url string, err error) {
+		return server.URL + "/test-worker", nil
+	}
+
+	task := NewTask()
+	task.Id = "task70"
+	task.Worker = "worker-a"
+
+	err := client.Cancel(context.Background(), task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelPayload["taskId"] != "task70" {
+		t.Fatalf("Expected task70 in cancel payload, got %v", cancelPayload["taskId"])
+	}
+}
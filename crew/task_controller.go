@@ -1,29 +1,43 @@
 package crew
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"os"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-co-op/gocron"
+	"github.com/google/uuid"
 )
 
 // A ThrottlePushQuery is a request to the throttler to see if there is enough bandwidth for a worker to run.
 type ThrottlePushQuery struct {
-	TaskId string
-	Worker string
-	Resp   chan bool
+	TaskId    string
+	Worker    string
+	Workgroup string
+	// Priority is the task's priority, throttlers serve higher priorities first.
+	Priority int
+	Resp     chan bool
 }
 
 // ThrottlePopQuery is a request to the throttler to notify that a worker is done.
+// It is also sent for tasks that stop waiting before the throttler let them run (canceled or deleted tasks),
+// so throttlers should remove the task from their queue as well as from the executing tasks.
 type ThrottlePopQuery struct {
-	TaskId string
-	Worker string
+	TaskId    string
+	Worker    string
+	Workgroup string
 }
 
+// Throttler controls when tasks may execute, see throttler.go for ready made throttlers.
 type Throttler struct {
 	Push chan ThrottlePushQuery
 	Pop  chan ThrottlePopQuery
@@ -38,19 +52,68 @@ type TaskController struct {
 	Pending                 *sync.WaitGroup
 	AbandonedCheckScheduler *gocron.Scheduler
 	AbandonedCheckMutex     *sync.Mutex
+	// Running holds a cancel func for each task that this controller is currently executing.
+	Running      map[string]context.CancelFunc
+	RunningMutex *sync.Mutex
+	// Dispatcher delivers evaluation requests, replace it before calling Startup to distribute evaluations across instances.
+	Dispatcher EvaluationDispatcher
+	// NodeId identifies this instance as the owner of the execution leases it takes.
+	NodeId string
+	// ExecutionLeaseDuration is how long an execution can go before other instances consider it abandoned (CREW_EXECUTION_LEASE_DURATION, defaults to 10m).
+	// Executions with a longer timeout get a longer lease.
+	ExecutionLeaseDuration time.Duration
+	// DefaultTaskTimeout bounds each attempt of tasks that don't set timeoutInSeconds (CREW_TASK_TIMEOUT, defaults to 5m).
+	DefaultTaskTimeout time.Duration
+	// AsyncDeadline is how long a worker that accepted a task (202) has to report its result (CREW_ASYNC_DEADLINE, defaults to 1h).
+	AsyncDeadline time.Duration
+	// CallbackSigningSecrets, when set, must have signed each call to the complete, heartbeat and lease endpoints (CREW_WORKER_SIGNING_SECRET).
+	// Route signing secrets are accepted too (see VerifyCallback).
+	CallbackSigningSecrets []string
+	// SignatureWindow is how far a signed callback's timestamp can be from now (CREW_SIGNATURE_WINDOW, defaults to 5m).
+	SignatureWindow time.Duration
+	// LeaderElector picks the one instance that runs the abandoned task scan.
+	LeaderElector LeaderElector
+	// AbandonedCheckInterval is how often the abandoned task scan runs (CREW_ABANDONED_CHECK_INTERVAL, defaults to 15m).
+	AbandonedCheckInterval time.Duration
+	// AbandonedCheckTaskPause is how long the scan waits after each evaluate it triggers (CREW_ABANDONED_CHECK_TASK_PAUSE, defaults to 100ms).
+	AbandonedCheckTaskPause time.Duration
+	// AbandonedCheckGroupPause is how long the scan waits between task groups (CREW_ABANDONED_CHECK_GROUP_PAUSE, defaults to 1s).
+	AbandonedCheckGroupPause time.Duration
+
+	// queuedSlots are the throttler slots held by tasks that this instance queued for pull workers (see releaseQueuedSlot).
+	queuedSlots      map[string]ThrottlePopQuery
+	queuedSlotsMutex sync.Mutex
 }
 
 // NewTaskController returns a new TaskController.
 func NewTaskController(storage TaskStorage, client TaskClient, throttler *Throttler) *TaskController {
-	return &TaskController{
+	hostname, _ := os.Hostname()
+	controller := &TaskController{
 		Storage:   storage,
 		Client:    client,
 		Feed:      make(chan interface{}, 8),
 		Throttler: throttler,
 		Pending:   &sync.WaitGroup{},
 		// AbandonedCheckScheduler is created in startup
-		AbandonedCheckMutex: &sync.Mutex{},
+		AbandonedCheckMutex:      &sync.Mutex{},
+		Running:                  make(map[string]context.CancelFunc),
+		RunningMutex:             &sync.Mutex{},
+		Dispatcher:               NewLocalEvaluationDispatcher(),
+		NodeId:                   hostname + "-" + uuid.New().String(),
+		ExecutionLeaseDuration:   durationFromEnv("CREW_EXECUTION_LEASE_DURATION", 10*time.Minute),
+		DefaultTaskTimeout:       durationFromEnv("CREW_TASK_TIMEOUT", 5*time.Minute),
+		AsyncDeadline:            durationFromEnv("CREW_ASYNC_DEADLINE", time.Hour),
+		CallbackSigningSecrets:   SigningSecretsFromEnv("CREW_WORKER_SIGNING_SECRET"),
+		SignatureWindow:          durationFromEnv("CREW_SIGNATURE_WINDOW", DefaultSignatureWindow),
+		LeaderElector:            NewLocalLeaderElector(),
+		AbandonedCheckInterval:   durationFromEnv("CREW_ABANDONED_CHECK_INTERVAL", 15*time.Minute),
+		AbandonedCheckTaskPause:  durationFromEnv("CREW_ABANDONED_CHECK_TASK_PAUSE", 100*time.Millisecond),
+		AbandonedCheckGroupPause: durationFromEnv("CREW_ABANDONED_CHECK_GROUP_PAUSE", time.Second),
+		queuedSlots:              make(map[string]ThrottlePopQuery),
 	}
+	// The local dispatcher is started right away so that evaluations work before Startup is called
+	controller.Dispatcher.Start(controller.EvaluateTaskById)
+	return controller
 }
 
 type TaskFeedEvent struct {
@@ -115,7 +178,7 @@ func (controller *TaskController) GetTaskGroup(id string) (taskGroup *TaskGroup,
 	return controller.Storage.FindTaskGroup(id)
 }
 
-func (controller *TaskController) GetTasksInGroup(taskGroupId string, page int, pageSize int, search string, skipCompleted bool) (tasks []*Task, total int, err error) {
+func (controller *TaskController) GetTasksInGroup(taskGroupId string, page int, pageSize int, search string, skipCompleted bool, statuses []TaskStatus) (tasks []*Task, total int, err error) {
 
 	allTasksInGroup, allTasksInGroupError := controller.Storage.AllTasksInGroup(taskGroupId)
 	if allTasksInGroupError != nil {
@@ -145,6 +208,20 @@ func (controller *TaskController) GetTasksInGroup(taskGroupId string, page int,
 		tasks = filtered
 	}
 
+	if len(statuses) > 0 {
+		// Only include tasks with one of the requested statuses
+		filtered := make([]*Task, 0)
+		for _, task := range tasks {
+			for _, status := range statuses {
+				if task.Status == status {
+					filtered = append(filtered, task)
+					break
+				}
+			}
+		}
+		tasks = filtered
+	}
+
 	// sort all tasks slice
 	sort.Slice(tasks, func(a, b int) bool {
 		return tasks[a].CreatedAt.Before(tasks[b].CreatedAt)
@@ -201,6 +278,15 @@ func (controller *TaskController) GetTask(id string) (task *Task, err error) {
 	return task, err
 }
 
+// GetTaskAttempts returns the execution history of a task, oldest attempt first.
+func (controller *TaskController) GetTaskAttempts(id string) (attempts []*Attempt, err error) {
+	_, err = controller.Storage.FindTask(id)
+	if err != nil {
+		return nil, err
+	}
+	return controller.Storage.GetTaskAttempts(id)
+}
+
 func (controller *TaskController) EmitTaskGroupFeedEvent(event string, taskGroup *TaskGroup) {
 	if controller.Feed != nil {
 		select {
@@ -227,21 +313,23 @@ func (controller *TaskController) EmitTaskFeedEvent(event string, task *Task) {
 	}
 }
 
+// TriggerTaskEvaluate requests an evaluation of a task via the controller's dispatcher.
+// With the default LocalEvaluationDispatcher the evaluation happens in a goroutine on this host,
+// distributed dispatchers may hand it to any crew instance.
 func (controller *TaskController) TriggerTaskEvaluate(id string) (err error) {
-	// We have two options here:
-	// 1) Just call evaluate in a goroutine (for a single host system)
-
-	// 2) Use an API call to trigger the evaluation (for a scalable system)
-
-	// Option 1:
-	go func() {
-		task, err := controller.Storage.FindTask(id)
-		if err == nil {
-			controller.Evaluate(task)
-		}
-	}()
+	err = controller.Dispatcher.Dispatch(id)
+	if err != nil {
+		log.Println("Failed to dispatch task evaluate", id, err)
+	}
+	return err
+}
 
-	return nil
+// EvaluateTaskById loads a task and evaluates it, this is the handler for dispatched evaluations.
+func (controller *TaskController) EvaluateTaskById(id string) {
+	task, err := controller.Storage.FindTask(id)
+	if err == nil {
+		controller.Evaluate(context.Background(), task)
+	}
 }
 
 func (controller *TaskController) CreateTaskGroup(taskGroup *TaskGroup) (err error) {
@@ -273,15 +361,17 @@ func (controller *TaskController) DeleteTask(id string) (err error) {
 		return err
 	}
 	err = controller.Storage.DeleteTask(task.Id)
+	controller.releaseQueuedSlot(task.Id)
 	controller.EmitTaskFeedEvent("delete", task)
 	return err
 }
 
 func (controller *TaskController) ResetTask(task *Task, remainingAttempts int) {
 	task.RemainingAttempts = remainingAttempts
-	task.IsComplete = false
+	controller.transition(task, TaskStatusPending)
 	task.Output = nil
 	task.Errors = make([]string, 0)
+	task.FirstFailureAt = time.Time{}
 	task.RunAfter = time.Now()
 	controller.Storage.SaveTask(task, false)
 	controller.EmitTaskFeedEvent("update", task)
@@ -321,9 +411,14 @@ func (controller *TaskController) RetryTaskGroup(id string, remainingAttempts in
 		return allTasksInGroupError
 	}
 
-	for _, task := range allTasksInGroup {
+	for _, task := range byPriority(allTasksInGroup) {
 		if !task.IsComplete {
 			task.RemainingAttempts = remainingAttempts
+			// A manual retry starts a new retry window
+			task.FirstFailureAt = time.Time{}
+			if task.Status == TaskStatusFailed || task.Status == TaskStatusCanceled {
+				controller.transition(task, TaskStatusPending)
+			}
 			controller.Storage.SaveTask(task, false)
 			controller.EmitTaskFeedEvent("update", task)
 			controller.TriggerTaskEvaluate(task.Id)
@@ -338,7 +433,7 @@ func (controller *TaskController) PauseOrResumeTaskGroup(id string, isPaused boo
 		return allTasksInGroupError
 	}
 
-	for _, task := range allTasksInGroup {
+	for _, task := range byPriority(allTasksInGroup) {
 		task.IsPaused = isPaused
 		controller.Storage.SaveTask(task, false)
 		controller.EmitTaskFeedEvent("update", task)
@@ -350,6 +445,118 @@ func (controller *TaskController) PauseOrResumeTaskGroup(id string, isPaused boo
 	return nil
 }
 
+// GetWorkgroups returns all workgroups that have been delayed, paused or configured.
+func (controller *TaskController) GetWorkgroups() (workgroups []*Workgroup, err error) {
+	return controller.Storage.AllWorkgroups()
+}
+
+// GetWorkgroup returns a workgroup (with default settings if it has never been saved).
+func (controller *TaskController) GetWorkgroup(name string) (workgroup *Workgroup, err error) {
+	return controller.Storage.FindWorkgroup(name)
+}
+
+// byPriority returns a copy of tasks sorted so that higher priority tasks come first, so that their evaluations are
+// dispatched first.
+func byPriority(tasks []*Task) []*Task {
+	sorted := make([]*Task, len(tasks))
+	copy(sorted, tasks)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+	return sorted
+}
+
+// findWorkgroup returns the workgroup a task belongs to, or nil for tasks without a workgroup.
+func (controller *TaskController) findWorkgroup(name string) *Workgroup {
+	if name == "" {
+		return nil
+	}
+	workgroup, err := controller.Storage.FindWorkgroup(name)
+	if err != nil {
+		log.Println("Error reading workgroup", name, err)
+		return nil
+	}
+	return workgroup
+}
+
+// PauseWorkgroup stops tasks in a workgroup from starting, until resumed or (when until is not zero) until the given time.
+func (controller *TaskController) PauseWorkgroup(name string, until time.Time) (workgroup *Workgroup, err error) {
+	workgroup, err = controller.Storage.FindWorkgroup(name)
+	if err != nil {
+		return nil, err
+	}
+	if until.IsZero() {
+		workgroup.IsPaused = true
+	} else {
+		workgroup.PausedUntil = until
+	}
+	workgroup.UpdatedAt = time.Now()
+	err = controller.Storage.SaveWorkgroup(workgroup)
+	return workgroup, err
+}
+
+// ResumeWorkgroup clears a workgroup's pause and delay and evaluates the tasks that were waiting on it.
+func (controller *TaskController) ResumeWorkgroup(name string) (workgroup *Workgroup, err error) {
+	workgroup, err = controller.Storage.FindWorkgroup(name)
+	if err != nil {
+		return nil, err
+	}
+	workgroup.IsPaused = false
+	workgroup.PausedUntil = time.Time{}
+	workgroup.UpdatedAt = time.Now()
+	err = controller.Storage.SaveWorkgroup(workgroup)
+	if err != nil {
+		return nil, err
+	}
+
+	workgroupTasks, err := controller.Storage.GetTasksInWorkgroup(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, task := range byPriority(workgroupTasks) {
+		if !task.IsComplete {
+			controller.TriggerTaskEvaluate(task.Id)
+		}
+	}
+	return workgroup, nil
+}
+
+// ErrInvalidWorkgroupUpdate is returned by UpdateWorkgroup when the workgroup name or one of its settings is invalid.
+var ErrInvalidWorkgroupUpdate = errors.New("invalid workgroup update")
+
+// UpdateWorkgroup changes a workgroup's maxConcurrency and rate limit settings.
+func (controller *TaskController) UpdateWorkgroup(name string, update map[string]interface{}) (workgroup *Workgroup, err error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidWorkgroupUpdate)
+	}
+	workgroup, err = controller.Storage.FindWorkgroup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := map[string]*int{
+		"maxConcurrency":             &workgroup.MaxConcurrency,
+		"rateLimit":                  &workgroup.RateLimit,
+		"rateLimitIntervalInSeconds": &workgroup.RateLimitIntervalInSeconds,
+		"rateLimitBurst":             &workgroup.RateLimitBurst,
+	}
+	for field, value := range update {
+		setting, found := settings[field]
+		if !found {
+			continue
+		}
+		number, ok := value.(float64)
+		if !ok || number < 0 {
+			return nil, fmt.Errorf("%w: %v must be a number >= 0", ErrInvalidWorkgroupUpdate, field)
+		}
+		*setting = int(number)
+	}
+
+	workgroup.UpdatedAt = time.Now()
+	err = controller.Storage.SaveWorkgroup(workgroup)
+	return workgroup, err
+}
+
 func (controller *TaskController) ResetTaskById(id string, remainingAttempts int) (task *Task, err error) {
 	foundTask, err := controller.Storage.FindTask(id)
 	if err != nil {
@@ -365,12 +572,104 @@ func (controller *TaskController) RetryTaskById(id string, remainingAttempts int
 		return nil, err
 	}
 	foundTask.RemainingAttempts = remainingAttempts
+	// A manual retry starts a new retry window
+	foundTask.FirstFailureAt = time.Time{}
+	if foundTask.Status == TaskStatusFailed || foundTask.Status == TaskStatusCanceled {
+		controller.transition(foundTask, TaskStatusPending)
+	}
 	controller.Storage.SaveTask(foundTask, false)
 	controller.EmitTaskFeedEvent("update", foundTask)
 	controller.TriggerTaskEvaluate(foundTask.Id)
 	return task, nil
 }
 
+// CancelTask stops a task from being executed.  If the task is currently executing its worker call is aborted
+// and the worker is notified (when the client supports it).  ErrTaskLocked is returned when the task is being
+// executed by another instance, the cancel has to be sent again once that execution is over.
+func (controller *TaskController) CancelTask(id string) (task *Task, err error) {
+	task, err = controller.Storage.FindTask(id)
+	if err != nil {
+		return nil, err
+	}
+
+	controller.RunningMutex.Lock()
+	cancel, running := controller.Running[id]
+	controller.RunningMutex.Unlock()
+	if running {
+		// Execute marks the task canceled once the worker call has been aborted
+		cancel()
+		controller.notifyWorkerOfCancel(task)
+		return task, nil
+	}
+
+	// Hold the task's lock so that an execution can't start while the task is being canceled
+	unlocker, lockErr := controller.Storage.TryLockTask(id)
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	defer unlocker()
+
+	task, err = controller.Storage.FindTask(id)
+	if err != nil {
+		return nil, err
+	}
+	// Async workers are still working on the task even though no execution is running
+	wasAwaitingCompletion := task.AwaitingCompletion
+	err = task.SetStatus(TaskStatusCanceled)
+	if err != nil {
+		return nil, err
+	}
+	err = controller.Storage.SaveTask(task, false)
+	if err != nil {
+		return nil, err
+	}
+	controller.EmitTaskFeedEvent("update", task)
+	if wasAwaitingCompletion {
+		controller.releaseQueuedSlot(task.Id)
+		if attempt := controller.openAttempt(task.Id); attempt != nil {
+			attempt.EndedAt = time.Now()
+			attempt.DurationMs = attempt.EndedAt.Sub(attempt.StartedAt).Milliseconds()
+			attempt.Error = "canceled"
+			attempt.ErrorType = AttemptErrorCanceled
+			controller.Storage.SaveAttempt(attempt)
+		}
+		controller.notifyWorkerOfCancel(task)
+	}
+	return task, nil
+}
+
+// notifyWorkerOfCancel tells the task's worker to stop working on it (when the client supports it).
+func (controller *TaskController) notifyWorkerOfCancel(task *Task) {
+	if canceler, ok := controller.Client.(TaskCanceler); ok {
+		go func() {
+			cancelErr := canceler.Cancel(context.Background(), task)
+			if cancelErr != nil {
+				log.Println("Failed to notify worker of cancel", task.Id, cancelErr)
+			}
+		}()
+	}
+}
+
+// CancelTaskGroup cancels every task in a group that hasn't already finished.
+func (controller *TaskController) CancelTaskGroup(id string) (err error) {
+	tasks, err := controller.Storage.AllTasksInGroup(id)
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		switch task.Status {
+		case TaskStatusSucceeded, TaskStatusFailed, TaskStatusCanceled, TaskStatusSkipped:
+			continue
+		}
+		_, cancelErr := controller.CancelTask(task.Id)
+		if cancelErr != nil && err == nil {
+			// Keep canceling the rest of the group, report the first failure
+			err = cancelErr
+		}
+	}
+	return err
+}
+
 func (controller *TaskController) UpdateTaskGroup(id string, update map[string]interface{}) (taskGroup *TaskGroup, err error) {
 	foundTaskGroup, err := controller.Storage.FindTaskGroup(id)
 	if err != nil {
@@ -388,14 +687,39 @@ func (controller *TaskController) UpdateTaskGroup(id string, update map[string]i
 	return foundTaskGroup, nil
 }
 
+// ErrInvalidTaskUpdate is returned by UpdateTask when an update can't be applied to the task, such as an unknown status.
+var ErrInvalidTaskUpdate = errors.New("invalid task update")
+
 func (controller *TaskController) UpdateTask(id string, update map[string]interface{}) (updatedTask *Task, err error) {
 	task, err := controller.Storage.FindTask(id)
 	if err != nil {
 		return nil, err
 	}
 
+	// Validate status changes before anything else is modified
+	newStatus, hasNewStatus := update["status"].(string)
+	cancelRunning := false
+	if hasNewStatus {
+		status, statusErr := ParseTaskStatus(newStatus)
+		if statusErr != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidTaskUpdate, statusErr)
+		}
+		if !status.IsUserSettable() {
+			return nil, fmt.Errorf("%w: status can only be set to %v, %v or %v", ErrInvalidTaskUpdate, TaskStatusPending, TaskStatusCanceled, TaskStatusSkipped)
+		}
+		if task.Status == TaskStatusRunning {
+			// A worker has the task, it has to be stopped like any other cancel (see below)
+			if status != TaskStatusCanceled {
+				return nil, fmt.Errorf("%w: running task can't be set to %v, cancel it first", ErrInvalidTaskUpdate, status)
+			}
+			cancelRunning = true
+		} else if statusErr = task.SetStatus(status); statusErr != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidTaskUpdate, statusErr)
+		}
+	}
+
 	// shouldReIndex := false
-	shouldReEvaluate := false
+	shouldReEvaluate := hasNewStatus
 	newName, hasNewName := update["name"].(string)
 	if hasNewName {
 		task.Name = newName
@@ -438,8 +762,12 @@ func (controller *TaskController) UpdateTask(id string, update map[string]interf
 	}
 
 	newIsComplete, hasIsComplete := update["isComplete"].(bool)
-	if hasIsComplete {
-		task.IsComplete = newIsComplete
+	if hasIsComplete && newIsComplete != task.IsComplete {
+		if newIsComplete {
+			controller.transition(task, TaskStatusSucceeded)
+		} else {
+			controller.transition(task, TaskStatusPending)
+		}
 	}
 
 	newRemainingAttempts, hasRemainingAttempts := update["remainingAttempts"]
@@ -452,6 +780,9 @@ func (controller *TaskController) UpdateTask(id string, update map[string]interf
 		default:
 			task.RemainingAttempts = 0
 		}
+		if task.Status == TaskStatusFailed && task.RemainingAttempts > 0 {
+			controller.transition(task, TaskStatusPending)
+		}
 		shouldReEvaluate = true
 	}
 
@@ -467,6 +798,51 @@ func (controller *TaskController) UpdateTask(id string, update map[string]interf
 		}
 	}
 
+	newPriority, hasPriority := update["priority"]
+	if hasPriority {
+		switch t := newPriority.(type) {
+		case int:
+			task.Priority = t
+		case float64:
+			task.Priority = int(t)
+		default:
+			task.Priority = 0
+		}
+	}
+
+	newTimeoutInSeconds, hasTimeoutInSeconds := update["timeoutInSeconds"]
+	if hasTimeoutInSeconds {
+		switch t := newTimeoutInSeconds.(type) {
+		case int:
+			task.TimeoutInSeconds = t
+		case float64:
+			task.TimeoutInSeconds = int(t)
+		default:
+			task.TimeoutInSeconds = 0
+		}
+	}
+
+	newRetryPolicy, hasRetryPolicy := update["retryPolicy"]
+	if hasRetryPolicy {
+		switch t := newRetryPolicy.(type) {
+		case *RetryPolicy:
+			task.RetryPolicy = t
+		case map[string]interface{}:
+			// Decoded from json, round trip it into a RetryPolicy
+			policy := &RetryPolicy{}
+			policyJson, policyJsonErr := json.Marshal(t)
+			if policyJsonErr != nil {
+				return nil, policyJsonErr
+			}
+			if policyParseErr := json.Unmarshal(policyJson, policy); policyParseErr != nil {
+				return nil, policyParseErr
+			}
+			task.RetryPolicy = policy
+		default:
+			task.RetryPolicy = nil
+		}
+	}
+
 	newInput, hasInput := update["input"]
 	if hasInput {
 		task.Input = newInput
@@ -492,81 +868,189 @@ func (controller *TaskController) UpdateTask(id string, update map[string]interf
 	// if shouldReIndex {
 
 	// }
+	if cancelRunning {
+		return controller.CancelTask(task.Id)
+	}
 	if shouldReEvaluate && !task.IsComplete && !task.IsPaused {
 		controller.TriggerTaskEvaluate(task.Id)
 	}
+	if (hasNewStatus || hasIsComplete) && task.IsComplete {
+		// Notify children that parent is complete (via an evaluate)
+		go controller.EvaluateChildren(task.Id)
+	}
 	return task, nil
 }
 
+// EvaluateChildren triggers an evaluate of each of a task's children.
+func (controller *TaskController) EvaluateChildren(id string) {
+	allChildren, getChildrenError := controller.Storage.GetTaskChildren(id)
+	if getChildrenError == nil {
+		for _, child := range byPriority(allChildren) {
+			controller.TriggerTaskEvaluate(child.Id)
+		}
+	}
+}
+
 func (controller *TaskController) Startup() (err error) {
+	err = controller.Dispatcher.Start(controller.EvaluateTaskById)
+	if err != nil {
+		return err
+	}
+
 	// Restart tasks on startup and/or check for tasks that may have been abandoned due to crashes (or power outages) during execution.
 	// Note that for this to work for abandonments the storage mechanism must have expirations on task locks.
-	// Only the redis storage mechanism currently supports this.
 	s := gocron.NewScheduler(time.UTC)
-	// TODO - configure interval with an env var?
-	s.Every(15).Minutes().Do(func() {
-		log.Println("Abandoned task scan starting")
-
-		// Use a mutex to make sure this doesn't run more than once at a time
-		locked := controller.AbandonedCheckMutex.TryLock()
-		if !locked {
-			log.Println("Previous abandoned task scan still running, bailing out.")
-			return
-		}
-		defer controller.AbandonedCheckMutex.Unlock()
-
-		taskGroups, taskGroupsError := controller.Storage.AllTaskGroups()
-		if taskGroupsError == nil {
-			for _, group := range taskGroups {
-				tasks, tasksError := controller.Storage.AllTasksInGroup(group.Id)
-				if tasksError == nil {
-					for _, task := range tasks {
-						// Do a couple of quick checks to prevent unecessary evaluates
-						if !task.IsComplete && !task.IsPaused && task.RunAfter.After(time.Now()) && task.RemainingAttempts > 0 {
-							controller.TriggerTaskEvaluate(task.Id)
-							// Slight pause here to prevent a flood of evaluates
-							time.Sleep(time.Second / 10)
+	_, err = s.Every(controller.AbandonedCheckInterval).Do(controller.ScanForAbandonedTasks)
+	if err != nil {
+		return err
+	}
+	s.StartAsync()
+	controller.AbandonedCheckScheduler = s
+
+	return nil
+}
+
+// ScanForAbandonedTasks reclaims tasks whose execution lease has expired and triggers an evaluate of every task that is due.
+// Only the instance that holds leadership runs the scan.
+func (controller *TaskController) ScanForAbandonedTasks() {
+	// Use a mutex to make sure this doesn't run more than once at a time
+	locked := controller.AbandonedCheckMutex.TryLock()
+	if !locked {
+		log.Println("Previous abandoned task scan still running, bailing out.")
+		return
+	}
+	defer controller.AbandonedCheckMutex.Unlock()
+
+	isLeader, leaderErr := controller.LeaderElector.TryAcquireLeadership()
+	if leaderErr != nil {
+		log.Println("Error acquiring leadership for abandoned task scan", leaderErr)
+		return
+	}
+	if !isLeader {
+		log.Println("Not the leader, skipping abandoned task scan")
+		return
+	}
+
+	log.Println("Abandoned task scan starting")
+
+	taskGroups, taskGroupsError := controller.Storage.AllTaskGroups()
+	if taskGroupsError == nil {
+		for _, group := range taskGroups {
+			tasks, tasksError := controller.Storage.AllTasksInGroup(group.Id)
+			if tasksError == nil {
+				for _, task := range byPriority(tasks) {
+					now := time.Now()
+					if task.LeaseExpired(now) {
+						_, reclaimErr := controller.ReclaimTask(task.Id)
+						if reclaimErr != nil {
+							log.Println("Error reclaiming abandoned task", task.Id, reclaimErr)
 						}
+						time.Sleep(controller.AbandonedCheckTaskPause)
+						continue
 					}
-				} else {
-					log.Println("Error scanning for abandoned tasks", tasksError)
+
+					// Do a couple of quick checks to prevent unecessary evaluates
+					if task.BusyExecuting || task.IsComplete || task.IsPaused || task.RemainingAttempts <= 0 || task.RunAfter.After(now) {
+						continue
+					}
+					switch task.Status {
+					case TaskStatusFailed, TaskStatusCanceled, TaskStatusSkipped:
+						continue
+					}
+					controller.TriggerTaskEvaluate(task.Id)
+					// Slight pause here to prevent a flood of evaluates
+					time.Sleep(controller.AbandonedCheckTaskPause)
 				}
+			} else {
+				log.Println("Error scanning for abandoned tasks", tasksError)
+			}
 
-				// Pause between groups to prevent overloading ourselves.
-				time.Sleep(time.Second * 1)
+			// Pause between groups to prevent overloading ourselves.
+			time.Sleep(controller.AbandonedCheckGroupPause)
+
+			// Keep the leader lease alive during long scans, stop if another instance has taken over
+			isLeader, leaderErr = controller.LeaderElector.TryAcquireLeadership()
+			if leaderErr != nil || !isLeader {
+				log.Println("Lost leadership during abandoned task scan, bailing out.", leaderErr)
+				return
 			}
-		} else {
-			log.Println("Error scanning for abandoned tasks (fetch groups)", taskGroupsError)
 		}
+	} else {
+		log.Println("Error scanning for abandoned tasks (fetch groups)", taskGroupsError)
+	}
 
-		log.Println("Abandoned task scan completed")
-	})
-	s.StartAsync()
-	controller.AbandonedCheckScheduler = s
-
-	return nil
+	log.Println("Abandoned task scan completed")
 }
 
 func (controller *TaskController) Shutdown() (err error) {
 	if controller.AbandonedCheckScheduler != nil {
 		controller.AbandonedCheckScheduler.Stop()
 	}
+	controller.Dispatcher.Stop()
+	controller.LeaderElector.ReleaseLeadership()
 
 	// Wait till all pending task executions are complete
 	controller.Pending.Wait()
 	return nil
 }
 
-func (controller *TaskController) Evaluate(task *Task) {
+func (controller *TaskController) Evaluate(ctx context.Context, task *Task) {
+	// Running tasks are left alone, their attempt (or ReclaimTask once their lease runs out) decides what happens next
+	if task.Status == TaskStatusRunning {
+		log.Println("Not evaluating running task", task.Id)
+		return
+	}
 	parents, _ := controller.Storage.GetTaskParents(task.Id)
 	log.Println("Evaluating task", task.Id, len(parents))
-	canExecute := task.CanExecute(parents)
+	canExecute := task.CanExecute(parents, controller.findWorkgroup(task.Workgroup))
 	if canExecute {
-		controller.Execute(task)
+		if task.Status != TaskStatusScheduled {
+			controller.transition(task, TaskStatusScheduled)
+			controller.Storage.SaveTask(task, false)
+			controller.EmitTaskFeedEvent("update", task)
+		}
+		controller.Execute(ctx, task)
+	} else if status := waitingStatus(task, parents); status != "" && status != task.Status {
+		controller.transition(task, status)
+		controller.Storage.SaveTask(task, false)
+		controller.EmitTaskFeedEvent("update", task)
+	}
+}
+
+// waitingStatus returns the status a task that cannot execute should be in (or "" to leave it alone).
+func waitingStatus(task *Task, parents []*Task) TaskStatus {
+	switch task.Status {
+	case TaskStatusPending, TaskStatusBlocked, TaskStatusScheduled:
+	default:
+		return ""
+	}
+	if task.IsPaused || task.Worker == "" {
+		return ""
+	}
+	if task.RemainingAttempts <= 0 {
+		return TaskStatusFailed
+	}
+	for _, parent := range parents {
+		if !parent.IsComplete {
+			return TaskStatusBlocked
+		}
+	}
+	return ""
+}
+
+// transition moves a task to a new status, invalid transitions are logged and ignored.
+func (controller *TaskController) transition(task *Task, status TaskStatus) bool {
+	err := task.SetStatus(status)
+	if err != nil {
+		log.Println(err)
+		return false
 	}
+	return true
 }
 
-func (controller *TaskController) Execute(taskToExecute *Task) {
+// Execute sends a task to its worker once its runAfter has passed.
+// Canceling ctx (or calling CancelTask) aborts the execution and marks the task canceled.
+func (controller *TaskController) Execute(ctx context.Context, taskToExecute *Task) {
 	log.Println("Executing task", taskToExecute.Id)
 	parents, _ := controller.Storage.GetTaskParents(taskToExecute.Id)
 
@@ -591,6 +1075,18 @@ func (controller *TaskController) Execute(taskToExecute *Task) {
 		// Unlock task no matter what else happens below!
 		defer unlocker()
 
+		// Register so that the execution can be canceled
+		taskCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		controller.RunningMutex.Lock()
+		controller.Running[taskToExecute.Id] = cancel
+		controller.RunningMutex.Unlock()
+		defer func() {
+			controller.RunningMutex.Lock()
+			delete(controller.Running, taskToExecute.Id)
+			controller.RunningMutex.Unlock()
+		}()
+
 		if lockError != nil {
 			// Couldn't lock task, do not execute
 			log.Println("Executing task (lock fail)", taskToExecute.Id)
@@ -605,205 +1101,695 @@ func (controller *TaskController) Execute(taskToExecute *Task) {
 			return
 		}
 
-		// If runAfter has not passed, it may have been updated while we were waiting for the timer.
+		// The task may have started running since it was evaluated, here or on another instance.  Posting it again would
+		// give it a new lease token and the worker that has it couldn't report back.
+		if task.Status == TaskStatusRunning && !task.LeaseExpired(time.Now()) {
+			log.Println("Task is already running, not executing it again", task.Id)
+			return
+		}
+
+		if taskCtx.Err() != nil {
+			controller.HandleCancel(task)
+			return
+		}
+
+		// If runAfter has not passed, it (or the workgroup's delay) may have been updated while we were waiting for the timer.
 		// Do not execute, but re-evaluate
-		if task.RunAfter.After(time.Now()) {
+		workgroup := controller.findWorkgroup(task.Workgroup)
+		if task.StartAfter(workgroup).After(time.Now()) {
 			controller.TriggerTaskEvaluate(task.Id)
 			return
 		}
 
-		canExecute := task.CanExecute(parents)
+		canExecute := task.CanExecute(parents, workgroup)
 		// Double check if task is still executable
 		if canExecute {
 
 			// Apply worker throttling if a throttler is defined
 			throttler := controller.Throttler
 			if (throttler != nil) && (task.Worker != "") {
+				// A slot held for an earlier queued attempt that ended on another instance has to go first
+				controller.releaseQueuedSlot(task.Id)
+				// Resp is buffered so that the throttler never blocks on a canceled task
 				query := ThrottlePushQuery{
-					TaskId: task.Id,
-					Worker: task.Worker,
-					Resp:   make(chan bool)}
+					TaskId:    task.Id,
+					Worker:    task.Worker,
+					Workgroup: task.Workgroup,
+					Priority:  task.Priority,
+					Resp:      make(chan bool, 1)}
 				throttler.Push <- query
 				// Block until throttler says it is ok to send task request
-				<-query.Resp
+				select {
+				case <-query.Resp:
+				case <-taskCtx.Done():
+					// Take the task out of the throttler's queue (or give back its slot if it was just granted)
+					throttler.Pop <- ThrottlePopQuery{
+						TaskId:    task.Id,
+						Worker:    task.Worker,
+						Workgroup: task.Workgroup}
+					controller.HandleCancel(task)
+					return
+				}
+
+				// Make sure task wasn't deleted while it was waiting on the throttler
+				if _, findErr := controller.Storage.FindTask(task.Id); findErr != nil {
+					throttler.Pop <- ThrottlePopQuery{
+						TaskId:    task.Id,
+						Worker:    task.Worker,
+						Workgroup: task.Workgroup}
+					return
+				}
 			}
 
-			task.BusyExecuting = true
+			// Tasks that were executed without being evaluated first are scheduled on the way to running
+			if task.Status == TaskStatusPending || task.Status == TaskStatusBlocked {
+				controller.transition(task, TaskStatusScheduled)
+			}
+			if !controller.transition(task, TaskStatusRunning) {
+				if (throttler != nil) && (task.Worker != "") {
+					throttler.Pop <- ThrottlePopQuery{
+						TaskId:    task.Id,
+						Worker:    task.Worker,
+						Workgroup: task.Workgroup}
+				}
+				return
+			}
+			timeout := controller.TaskTimeout(task)
+			leaseDuration := controller.ExecutionLeaseDuration
+			if timeout+time.Minute > leaseDuration {
+				// Don't let the lease run out while the worker is still allowed to be working
+				leaseDuration = timeout + time.Minute
+			}
+			task.AcquireLease(controller.NodeId, leaseDuration)
 			controller.Storage.SaveTask(task, false)
 			controller.EmitTaskFeedEvent("update", task)
 
-			workerResponse, err := controller.Client.Post(task, parents)
+			// Record the attempt before calling the worker so that in-flight attempts show up in history
+			previousAttempts, _ := controller.Storage.GetTaskAttempts(task.Id)
+			attempt := NewAttempt(task, len(previousAttempts)+1)
+			controller.Storage.SaveAttempt(attempt)
+
+			attemptCtx, cancelAttempt := context.WithCancel(taskCtx)
+			if timeout > 0 {
+				attemptCtx, cancelAttempt = context.WithTimeout(taskCtx, timeout)
+			}
+			workerResponse, err := controller.Client.Post(attemptCtx, task, parents)
+			if errors.Is(attemptCtx.Err(), context.DeadlineExceeded) && taskCtx.Err() == nil {
+				err = &TimeoutError{Timeout: timeout}
+			}
+			cancelAttempt()
 
 			if (throttler != nil) && (task.Worker != "") {
 				query := ThrottlePopQuery{
-					TaskId: task.Id,
-					Worker: task.Worker}
-				// Let throttler know that task attempt is complete
-				throttler.Pop <- query
+					TaskId:    task.Id,
+					Worker:    task.Worker,
+					Workgroup: task.Workgroup}
+				if err == nil && workerResponse.Queued && taskCtx.Err() == nil {
+					// Queued tasks haven't even been leased yet, they keep their slot until the worker is done with them
+					controller.queuedSlotsMutex.Lock()
+					controller.queuedSlots[task.Id] = query
+					controller.queuedSlotsMutex.Unlock()
+				} else {
+					// Let throttler know that task attempt is complete
+					throttler.Pop <- query
+				}
 			}
 
-			// post exec state updates
-			task.RemainingAttempts--
-			task.Output = workerResponse.Output
-			task.BusyExecuting = false
-
-			if err != nil {
-				log.Println("Got standard error", task.Id, err)
-				controller.HandleExecuteError(task, fmt.Sprintf("%v", err))
-			} else if workerResponse.Error != nil {
-				log.Println("Got worker response error", task.Id, workerResponse.Error)
-				controller.HandleExecuteError(task, fmt.Sprintf("%v", workerResponse.Error))
-			} else {
-				// No error!
-				task.IsComplete = true
-
-				// Create children
-				createdChildren := make([]*Task, 0)
-				var errorCreatingChildren error
-				for _, childTask := range workerResponse.Children {
-					child := NewTask()
-					child.Id = childTask.Id
-					child.TaskGroupId = task.TaskGroupId
-					child.Name = childTask.Name
-					child.Worker = childTask.Worker
-					child.Workgroup = childTask.Workgroup
-					child.Key = childTask.Key
-					child.RemainingAttempts = childTask.RemainingAttempts
-					if child.RemainingAttempts == 0 {
-						child.RemainingAttempts = 5
-					}
-					child.IsPaused = childTask.IsPaused
-					child.IsComplete = false
-					child.RunAfter = childTask.RunAfter
-					child.ErrorDelayInSeconds = childTask.ErrorDelayInSeconds
-					if child.ErrorDelayInSeconds == 0 {
-						child.ErrorDelayInSeconds = 60
-					}
-					child.Input = childTask.Input
-					child.ParentIds = childTask.ParentIds
-
-					// NOTE - current task is always added as a parent so that children won't begin exec until we are done creating them all
-					// This allows children to be created in any order.
-					child.ParentIds = append(child.ParentIds, task.Id)
-
-					// Save the new child
-					// Create children in a "transaction" so that if one fails to create, all get removed?
-					errorCreatingChildren := controller.Storage.SaveTask(child, true)
-					if errorCreatingChildren != nil {
-						break
-					}
-					createdChildren = append(createdChildren, child)
-				}
+			if err == nil && workerResponse.Async && taskCtx.Err() == nil {
+				// The worker accepted the task and will report the result via CompleteTask
+				controller.awaitCompletion(task, attempt, workerResponse)
+				return
+			}
+			attempt.Finish(workerResponse, err)
+
+			if taskCtx.Err() != nil {
+				// Canceled mid-flight, whatever the worker returned is discarded
+				attempt.Error = "canceled"
+				attempt.ErrorType = AttemptErrorCanceled
+				controller.Storage.SaveAttempt(attempt)
+				controller.HandleCancel(task)
+				return
+			}
 
-				if errorCreatingChildren != nil {
-					// A child failed to create, delete all created children
-					for _, child := range createdChildren {
-						controller.Storage.DeleteTask(child.Id)
-					}
+			controller.handleWorkerResponse(task, attempt, workerResponse, err)
+		}
+	}()
 
-					// Because children failed we have to fail the task so that users will know something went wrong.
-					task.IsComplete = false
-					log.Println("Got child creation error", task.Id, errorCreatingChildren)
-					controller.HandleExecuteError(task, fmt.Sprintf("Child create failure : %v", errorCreatingChildren))
-				} else {
-					for _, child := range createdChildren {
-						controller.EmitTaskFeedEvent("create", child)
-					}
-				}
+	now := time.Now()
+	startAfter := taskToExecute.StartAfter(controller.findWorkgroup(taskToExecute.Workgroup))
+	if now.Before(startAfter) {
+		// Task's run after (or its workgroup's delay) has not passed
+		timer.Reset(startAfter.Sub(now))
+	} else {
+		// Task's run after has already passed or was not set
+		timer.Reset(time.Millisecond)
+	}
+}
+
+// handleWorkerResponse applies the outcome of an attempt (from Execute or CompleteTask) to its task.
+func (controller *TaskController) handleWorkerResponse(task *Task, attempt *Attempt, workerResponse WorkerResponse, err error) {
+	var rateLimitErr *RateLimitError
+	isRateLimited := errors.As(err, &rateLimitErr)
+	if !isRateLimited {
+		// Being told to back off doesn't count against the task
+		task.RemainingAttempts--
+	}
+	task.Output = workerResponse.Output
+
+	if isRateLimited {
+		log.Println("Got rate limited", task.Id, rateLimitErr.RetryAfter)
+		controller.HandleRateLimit(task, rateLimitErr)
+	} else if err != nil {
+		log.Println("Got standard error", task.Id, err)
+		if IsRetryableError(err) {
+			controller.HandleExecuteError(task, fmt.Sprintf("%v", err))
+		} else {
+			controller.HandlePermanentError(task, fmt.Sprintf("%v", err))
+		}
+	} else if workerResponse.Error != nil {
+		log.Println("Got worker response error", task.Id, workerResponse.Error)
+		if workerResponse.Retryable == nil || *workerResponse.Retryable {
+			controller.HandleExecuteError(task, fmt.Sprintf("%v", workerResponse.Error))
+		} else {
+			controller.HandlePermanentError(task, fmt.Sprintf("%v", workerResponse.Error))
+		}
+	} else {
+		// No error!
+		controller.transition(task, TaskStatusSucceeded)
+
+		// Build children
+		createdChildren := make([]*Task, 0)
+		for _, childTask := range workerResponse.Children {
+			child := NewTask()
+			child.Id = childTask.Id
+			child.TaskGroupId = task.TaskGroupId
+			child.Name = childTask.Name
+			child.Worker = childTask.Worker
+			child.Workgroup = childTask.Workgroup
+			child.Key = childTask.Key
+			child.RemainingAttempts = childTask.RemainingAttempts
+			if child.RemainingAttempts == 0 {
+				child.RemainingAttempts = 5
 			}
+			child.IsPaused = childTask.IsPaused
+			child.IsComplete = false
+			child.RunAfter = childTask.RunAfter
+			child.ErrorDelayInSeconds = childTask.ErrorDelayInSeconds
+			if child.ErrorDelayInSeconds == 0 {
+				child.ErrorDelayInSeconds = 60
+			}
+			child.Priority = task.Priority
+			if childTask.Priority != nil {
+				child.Priority = *childTask.Priority
+			}
+			child.TimeoutInSeconds = childTask.TimeoutInSeconds
+			child.RetryPolicy = childTask.RetryPolicy
+			child.Input = childTask.Input
+			child.ParentIds = childTask.ParentIds
 
-			// Apply child delays
-			// Note that child delays are done here instead of above because task may have a mix of pre-populated children and children created from its output.
-			if workerResponse.ChildrenDelayInSeconds > 0 {
-				// This can happen in the background
-				go func() {
-					allChildren, getChildrenError := controller.Storage.GetTaskChildren(task.Id)
-					if getChildrenError != nil {
-						for _, child := range allChildren {
-							child.RunAfter = time.Now().Add(time.Duration(workerResponse.ChildrenDelayInSeconds * int(time.Second)))
-							controller.Storage.SaveTask(child, false)
-							controller.EmitTaskFeedEvent("update", child)
-							// No evaluate sent here, is sent below if parent complete
-						}
-					}
-					// else {
-					// 	// TODO What should we do here? (failed to fetch children)
-					// }
-				}()
+			// NOTE - current task is always added as a parent so that children won't begin exec until we are done creating them all
+			// This allows children to be created in any order.
+			child.ParentIds = append(child.ParentIds, task.Id)
+
+			createdChildren = append(createdChildren, child)
+		}
+
+		// Task completion and all of its children are committed together or not at all
+		errorCreatingChildren := controller.Storage.SaveTasksAtomically([]*Task{task}, createdChildren)
+		if errorCreatingChildren != nil {
+			// Because children failed we have to fail the task so that users will know something went wrong.
+			// The completion was never committed so roll it back rather than transitioning out of succeeded.
+			task.Status = TaskStatusRunning
+			task.IsComplete = false
+			log.Println("Got child creation error", task.Id, errorCreatingChildren)
+			controller.HandleExecuteError(task, fmt.Sprintf("Child create failure : %v", errorCreatingChildren))
+			attempt.Error = fmt.Sprintf("Child create failure : %v", errorCreatingChildren)
+		} else {
+			for _, child := range createdChildren {
+				controller.EmitTaskFeedEvent("create", child)
 			}
+		}
+	}
 
-			// TODO - apply workgroup delays
-			if workerResponse.WorkgroupDelayInSeconds > 0 {
-				// This can happen in the background
-				go func() {
-					workgroupTasks, workgroupTasksError := controller.Storage.GetTasksInWorkgroup(task.Workgroup)
-					if workgroupTasksError != nil {
-						for _, workgroupTask := range workgroupTasks {
-							workgroupTask.RunAfter = time.Now().Add(time.Duration(workerResponse.WorkgroupDelayInSeconds * int(time.Second)))
-							controller.Storage.SaveTask(workgroupTask, false)
-							controller.EmitTaskFeedEvent("update", workgroupTask)
-							// No evaluate sent here, is sent below if parent complete
-						}
-					}
-				}()
+	// Apply child delays
+	// Note that child delays are done here instead of above because task may have a mix of pre-populated children and children created from its output.
+	if workerResponse.ChildrenDelayInSeconds > 0 {
+		// This can happen in the background
+		go func() {
+			allChildren, getChildrenError := controller.Storage.GetTaskChildren(task.Id)
+			if getChildrenError == nil {
+				for _, child := range allChildren {
+					child.RunAfter = time.Now().Add(time.Duration(workerResponse.ChildrenDelayInSeconds * int(time.Second)))
+					controller.Storage.SaveTask(child, false)
+					controller.EmitTaskFeedEvent("update", child)
+					// No evaluate sent here, is sent below if parent complete
+				}
 			}
+			// else {
+			// 	// TODO What should we do here? (failed to fetch children)
+			// }
+		}()
+	}
 
-			controller.Storage.SaveTask(task, false)
-			controller.EmitTaskFeedEvent("update", task)
+	// Apply workgroup delays
+	workgroupDelay := time.Duration(workerResponse.WorkgroupDelayInSeconds) * time.Second
+	if isRateLimited && rateLimitErr.RetryAfter > workgroupDelay {
+		workgroupDelay = rateLimitErr.RetryAfter
+	}
+	if workgroupDelay > 0 && task.Workgroup != "" {
+		// Tasks in the workgroup (including ones created later) check the delay before they start
+		if delayErr := controller.DelayWorkgroup(task.Workgroup, workgroupDelay); delayErr != nil {
+			log.Println("Error delaying workgroup", task.Workgroup, delayErr)
+		}
+	}
 
-			if !task.IsComplete {
-				controller.TriggerTaskEvaluate(task.Id)
-			} else {
-				// Notify children that parent is complete (via an evaluate)
-				go func() {
-					allChildren, getChildrenError := controller.Storage.GetTaskChildren(task.Id)
-					if getChildrenError == nil {
-						for _, child := range allChildren {
-							controller.TriggerTaskEvaluate(child.Id)
-						}
-					}
-				}()
-
-				// Apply de-duplication (and notify the children of duplicates!)
-				if task.Key != "" {
-					go func() {
-						keyMatches, keyMatchesError := controller.Storage.GetTasksWithKey(task.Key)
-						if (keyMatchesError == nil) && (len(keyMatches) > 1) {
-							for _, keyMatch := range keyMatches {
-								if keyMatch.Id != task.Id {
-									keyMatch.IsComplete = true
-									keyMatch.Output = task.Output
-									controller.Storage.SaveTask(keyMatch, false)
-									controller.EmitTaskFeedEvent("update", keyMatch)
-
-									// Notify children that parent is complete (via an evaluate)
-									keyMatchChildren, keyMatchChildrenError := controller.Storage.GetTaskChildren(keyMatch.Id)
-									if keyMatchChildrenError != nil {
-										for _, child := range keyMatchChildren {
-											controller.TriggerTaskEvaluate(child.Id)
-										}
-									}
+	controller.Storage.SaveAttempt(attempt)
+	controller.Storage.SaveTask(task, false)
+	controller.EmitTaskFeedEvent("update", task)
+
+	if !task.IsComplete {
+		controller.TriggerTaskEvaluate(task.Id)
+	} else {
+		// Notify children that parent is complete (via an evaluate)
+		go controller.EvaluateChildren(task.Id)
+
+		// Apply de-duplication (and notify the children of duplicates!)
+		if task.Key != "" {
+			go func() {
+				keyMatches, keyMatchesError := controller.Storage.GetTasksWithKey(task.Key)
+				if (keyMatchesError == nil) && (len(keyMatches) > 1) {
+					for _, keyMatch := range keyMatches {
+						if keyMatch.Id != task.Id && !keyMatch.IsComplete {
+							if !controller.transition(keyMatch, TaskStatusSucceeded) {
+								continue
+							}
+							keyMatch.Output = task.Output
+							controller.Storage.SaveTask(keyMatch, false)
+							controller.EmitTaskFeedEvent("update", keyMatch)
+
+							// Notify children that parent is complete (via an evaluate)
+							keyMatchChildren, keyMatchChildrenError := controller.Storage.GetTaskChildren(keyMatch.Id)
+							if keyMatchChildrenError == nil {
+								for _, child := range keyMatchChildren {
+									controller.TriggerTaskEvaluate(child.Id)
 								}
 							}
 						}
-					}()
+					}
 				}
+			}()
+		}
+	}
+}
+
+// ReclaimTask recovers a task whose execution lease has expired (for example because the instance executing it crashed).
+// The lost execution counts as a failed attempt and the task is re-queued.
+func (controller *TaskController) ReclaimTask(id string) (reclaimed bool, err error) {
+	// Executions on this instance are still alive, even if they have outlasted their lease
+	controller.RunningMutex.Lock()
+	_, running := controller.Running[id]
+	controller.RunningMutex.Unlock()
+	if running {
+		return false, nil
+	}
+
+	// A lock that is still held means the execution is still alive somewhere
+	unlocker, err := controller.Storage.TryLockTask(id)
+	if err != nil {
+		return false, err
+	}
+	defer unlocker()
+
+	task, err := controller.Storage.FindTask(id)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if !task.LeaseExpired(now) {
+		return false, nil
+	}
+
+	message := fmt.Sprintf("Execution lease expired (owner: %v)", task.LeaseOwner)
+	errorType := AttemptErrorLeaseExpired
+	if task.AwaitingCompletion {
+		// For async tasks the lease is the worker's deadline
+		message = "Worker did not report completion before its deadline"
+		errorType = AttemptErrorTimeout
+	}
+	log.Println("Reclaiming task", task.Id, message)
+
+	// Close out the attempt that never finished
+	if attempt := controller.openAttempt(task.Id); attempt != nil {
+		attempt.EndedAt = now
+		attempt.DurationMs = now.Sub(attempt.StartedAt).Milliseconds()
+		attempt.Error = message
+		attempt.ErrorType = errorType
+		controller.Storage.SaveAttempt(attempt)
+	}
+	controller.releaseQueuedSlot(task.Id)
+
+	task.RemainingAttempts--
+	controller.HandleExecuteError(task, message)
+	// Tasks left busy in a status that can't be retried from still need to be released
+	task.BusyExecuting = false
+	task.ReleaseLease()
+
+	err = controller.Storage.SaveTask(task, false)
+	if err != nil {
+		return false, err
+	}
+	controller.EmitTaskFeedEvent("update", task)
+	if task.Status != TaskStatusFailed {
+		controller.TriggerTaskEvaluate(task.Id)
+	}
+	return true, nil
+}
+
+// openAttempt returns the task's latest attempt if it hasn't ended yet.
+func (controller *TaskController) openAttempt(taskId string) *Attempt {
+	attempts, _ := controller.Storage.GetTaskAttempts(taskId)
+	if len(attempts) > 0 && attempts[len(attempts)-1].EndedAt.IsZero() {
+		return attempts[len(attempts)-1]
+	}
+	return nil
+}
+
+// awaitCompletion leaves a task running after its worker accepted it (202) so that the worker can report the result later.
+func (controller *TaskController) awaitCompletion(task *Task, attempt *Attempt, ack WorkerResponse) {
+	deadline := controller.AsyncDeadline
+	if ack.DeadlineInSeconds > 0 {
+		deadline = time.Duration(ack.DeadlineInSeconds) * time.Second
+	}
+	log.Println("Task accepted by worker, awaiting completion", task.Id, deadline)
+
+	attempt.WorkerUrl = ack.WorkerUrl
+	attempt.StatusCode = ack.StatusCode
+	controller.Storage.SaveAttempt(attempt)
+
+	// The lease now runs until the deadline, once it expires the task is reclaimed like an abandoned execution
+	task.AwaitingCompletion = true
+	task.AwaitingLease = ack.Queued
+	task.LeaseExpiresAt = time.Now().Add(deadline)
+	controller.Storage.SaveTask(task, false)
+	controller.EmitTaskFeedEvent("update", task)
+
+	// The abandoned task scan would catch a missed deadline too, but possibly long after it passed
+	controller.reclaimAtDeadline(task.Id, task.LeaseExpiresAt)
+}
+
+// releaseQueuedSlot gives back the throttler slot that a task queued by this instance holds, if it holds one.  It is
+// called when the queued attempt completes, is reclaimed, canceled or deleted, or (when that happened on another
+// instance) when the deadline timer of this instance finds the attempt over.
+func (controller *TaskController) releaseQueuedSlot(taskId string) {
+	// The pop is sent under the lock so that it reaches the throttler before the task can be pushed again
+	controller.queuedSlotsMutex.Lock()
+	defer controller.queuedSlotsMutex.Unlock()
+	query, held := controller.queuedSlots[taskId]
+	if held {
+		delete(controller.queuedSlots, taskId)
+		controller.Throttler.Pop <- query
+	}
+}
+
+// reclaimAtDeadline reclaims an async task once its deadline has passed, following the deadline if heartbeats extend it.
+func (controller *TaskController) reclaimAtDeadline(taskId string, deadline time.Time) {
+	time.AfterFunc(time.Until(deadline), func() {
+		reclaimed, reclaimErr := controller.ReclaimTask(taskId)
+		if reclaimErr != nil {
+			log.Println("Error reclaiming task after async deadline", taskId, reclaimErr)
+			return
+		}
+		if !reclaimed {
+			task, findErr := controller.Storage.FindTask(taskId)
+			if findErr == nil && task.AwaitingCompletion && task.LeaseExpiresAt.After(deadline) {
+				controller.reclaimAtDeadline(taskId, task.LeaseExpiresAt)
+				return
+			}
+			// The attempt ended on another instance
+			if findErr != nil || !task.AwaitingCompletion {
+				controller.releaseQueuedSlot(taskId)
 			}
 		}
-	}()
+	})
+}
+
+// ErrInvalidCompletionToken is returned by CompleteTask and Heartbeat when the token doesn't belong to the task's current attempt.
+var ErrInvalidCompletionToken = errors.New("invalid completion token")
+
+// ErrTaskNotAwaitingCompletion is returned by CompleteTask when the task isn't waiting on an asynchronous worker.
+var ErrTaskNotAwaitingCompletion = errors.New("task is not awaiting completion")
 
+// ErrTaskNotRunning is returned by Heartbeat when the task isn't being worked on.
+var ErrTaskNotRunning = errors.New("task is not running")
+
+// ErrLeaseNotSupported is returned by LeaseTasks when the controller's client doesn't hand tasks out to workers.
+var ErrLeaseNotSupported = errors.New("task client does not support leasing tasks")
+
+// CompleteTask records the result of a task that its worker accepted asynchronously.  token is the completionToken
+// that was sent to the worker with the task.
+func (controller *TaskController) CompleteTask(id string, token string, response WorkerResponse) (task *Task, err error) {
+	unlocker, err := controller.Storage.TryLockTask(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlocker()
+
+	task, err = controller.Storage.FindTask(id)
+	if err != nil {
+		return nil, err
+	}
+	if task.Status != TaskStatusRunning || !task.AwaitingCompletion {
+		return nil, ErrTaskNotAwaitingCompletion
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(task.LeaseToken)) != 1 {
+		return nil, ErrInvalidCompletionToken
+	}
+	log.Println("Task completed by worker", task.Id)
+
+	attempt := controller.openAttempt(task.Id)
+	if attempt == nil {
+		previousAttempts, _ := controller.Storage.GetTaskAttempts(task.Id)
+		attempt = NewAttempt(task, len(previousAttempts)+1)
+	}
+	response.WorkerUrl = attempt.WorkerUrl
+	response.StatusCode = attempt.StatusCode
+	attempt.Finish(response, nil)
+	controller.releaseQueuedSlot(task.Id)
+
+	task.AwaitingCompletion = false
+	controller.handleWorkerResponse(task, attempt, response, nil)
+	return task, nil
+}
+
+// VerifyCallback checks the signature of a worker's call to the complete or heartbeat endpoint of a task.  Calls can
+// be signed with CallbackSigningSecrets or with the signing secret of the task's worker route (see WorkerRoute), they
+// are not checked when neither is set.
+func (controller *TaskController) VerifyCallback(taskId string, header http.Header, body []byte) error {
+	worker := ""
+	if task, findErr := controller.Storage.FindTask(taskId); findErr == nil {
+		worker = task.Worker
+	}
+	return controller.verifyWorkerSignature(worker, taskId, header, body)
+}
+
+// VerifyLease checks the signature of a pull worker's call to the lease endpoint, which is signed like a callback
+// with LeaseSignatureId(query) in place of the task id.  query is the raw query string of the call.
+func (controller *TaskController) VerifyLease(worker string, query string, header http.Header, body []byte) error {
+	return controller.verifyWorkerSignature(worker, LeaseSignatureId(query), header, body)
+}
+
+// verifyWorkerSignature checks that a worker's call was signed for signedId with one of the worker's signing secrets.
+func (controller *TaskController) verifyWorkerSignature(worker string, signedId string, header http.Header, body []byte) error {
+	secrets := controller.workerSigningSecrets(worker)
+	if len(secrets) == 0 {
+		return nil
+	}
+	signedTaskId, err := VerifySignature(header, body, time.Now(), controller.SignatureWindow, secrets...)
+	if err != nil {
+		return err
+	}
+	// Signatures for one task (or worker) can't be used for another
+	if signedTaskId != signedId {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// workerSigningSecrets returns CallbackSigningSecrets along with the signing secret of the worker's route, if the
+// controller's client routes workers.
+func (controller *TaskController) workerSigningSecrets(worker string) []string {
+	secrets := append([]string{}, controller.CallbackSigningSecrets...)
+	client, ok := controller.Client.(*HttpPostClient)
+	if !ok || client.Routes == nil || worker == "" {
+		return secrets
+	}
+	if route, findErr := client.Routes.Find(worker); findErr == nil && route.SigningSecret != "" {
+		secrets = append(secrets, route.SigningSecret)
+	}
+	return secrets
+}
+
+// Heartbeat records a worker's progress (a percentage) and status message for a running task and extends the task's
+// execution lease.  Either may be nil to leave it unchanged.  token is the completionToken that was sent to the worker with the task.
+func (controller *TaskController) Heartbeat(id string, token string, progress *float64, message *string) (task *Task, err error) {
+	// No lock here, the execution holds it while the worker is working
+	task, err = controller.Storage.FindTask(id)
+	if err != nil {
+		return nil, err
+	}
+	if task.Status != TaskStatusRunning || task.LeaseToken == "" {
+		return nil, ErrTaskNotRunning
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(task.LeaseToken)) != 1 {
+		return nil, ErrInvalidCompletionToken
+	}
+
+	// The attempt can finish between the find and the save, the update is skipped if it did so that the heartbeat
+	// doesn't put the task back to running
+	task, err = controller.Storage.UpdateTaskIf(id, TaskStatusRunning, task.LeaseToken, func(task *Task) {
+		if progress != nil {
+			task.Progress = *progress
+		}
+		if message != nil {
+			task.ProgressMessage = *message
+		}
+		// Live workers keep their lease (or async deadline) from running out
+		leaseExpiresAt := time.Now().Add(controller.ExecutionLeaseDuration)
+		if leaseExpiresAt.After(task.LeaseExpiresAt) {
+			task.LeaseExpiresAt = leaseExpiresAt
+		}
+	})
+	if errors.Is(err, ErrTaskChanged) {
+		return nil, ErrTaskNotRunning
+	}
+	if err != nil {
+		return nil, err
+	}
+	controller.EmitTaskFeedEvent("update", task)
+	return task, nil
+}
+
+// LeaseTasks hands up to max of a worker's queued tasks to the worker (see PullTaskClient).  Each task's async
+// deadline restarts when it is leased, the worker reports results via CompleteTask.
+func (controller *TaskController) LeaseTasks(worker string, max int) (payloads []WorkerPayload, err error) {
+	if _, ok := controller.Client.(*PullTaskClient); !ok {
+		return nil, ErrLeaseNotSupported
+	}
+
+	queued, err := controller.Storage.GetTasksAwaitingLease(worker)
+	if err != nil {
+		return nil, err
+	}
+	// Higher priorities are leased first, equal priorities in the order they were queued (which is their deadline order)
+	sort.SliceStable(queued, func(i, j int) bool {
+		if queued[i].Priority != queued[j].Priority {
+			return queued[i].Priority > queued[j].Priority
+		}
+		return queued[i].LeaseExpiresAt.Before(queued[j].LeaseExpiresAt)
+	})
+
+	payloads = make([]WorkerPayload, 0)
+	for _, task := range queued {
+		if len(payloads) >= max {
+			break
+		}
+		// The claim only goes through if nobody (another lease on any instance, a cancel or a reclaim) got to the
+		// task first.  The worker gets a new token so that only it can complete the task.
+		leased, claimErr := controller.Storage.UpdateTaskIf(task.Id, TaskStatusRunning, task.LeaseToken, func(task *Task) {
+			task.LeaseToken = uuid.New().String()
+			task.AwaitingLease = false
+			leaseExpiresAt := time.Now().Add(controller.AsyncDeadline)
+			if leaseExpiresAt.After(task.LeaseExpiresAt) {
+				task.LeaseExpiresAt = leaseExpiresAt
+			}
+		})
+		if claimErr != nil {
+			if !errors.Is(claimErr, ErrTaskChanged) {
+				log.Println("Error leasing task", task.Id, claimErr)
+			}
+			continue
+		}
+		parents, _ := controller.Storage.GetTaskParents(leased.Id)
+		controller.EmitTaskFeedEvent("update", leased)
+		payloads = append(payloads, newWorkerPayload(leased, parents))
+	}
+	log.Println("Leased tasks", worker, len(payloads))
+	return payloads, nil
+}
+
+// TaskTimeout returns how long each attempt of a task may take, its timeoutInSeconds or DefaultTaskTimeout (0 = no limit).
+func (controller *TaskController) TaskTimeout(task *Task) time.Duration {
+	if task.TimeoutInSeconds > 0 {
+		return time.Duration(task.TimeoutInSeconds) * time.Second
+	}
+	return controller.DefaultTaskTimeout
+}
+
+// HandleCancel marks a task canceled after its execution was aborted.
+func (controller *TaskController) HandleCancel(task *Task) {
+	log.Println("Task canceled", task.Id)
+	if !controller.transition(task, TaskStatusCanceled) {
+		return
+	}
+	controller.Storage.SaveTask(task, false)
+	controller.EmitTaskFeedEvent("update", task)
+}
+
+func (controller *TaskController) HandleExecuteError(task *Task, message string) {
+	task.Errors = append(task.Errors, message)
 	now := time.Now()
-	if now.Before(taskToExecute.RunAfter) {
-		// Task's run after has not passed
-		timer.Reset(taskToExecute.RunAfter.Sub(now))
+	if task.FirstFailureAt.IsZero() {
+		task.FirstFailureAt = now
+	}
+	task.RunAfter = now.Add(task.RetryDelay())
+
+	if task.RetryPolicy != nil && task.RetryPolicy.WindowExceeded(task.FirstFailureAt, task.RunAfter) {
+		// Out of time, do not retry again
+		log.Println("Retry window exceeded", task.Id)
+		task.RemainingAttempts = 0
+	}
+
+	if task.RemainingAttempts > 0 {
+		controller.transition(task, TaskStatusScheduled)
 	} else {
-		// Task's run after has already passed or was not set
-		timer.Reset(time.Millisecond)
+		controller.transition(task, TaskStatusFailed)
 	}
 }
 
-func (controller *TaskController) HandleExecuteError(task *Task, message string) {
+// minRateLimitDelay is the shortest time a rate limited task waits before it is retried.
+const minRateLimitDelay = time.Second
+
+// HandleRateLimit re-schedules a task that a worker asked to back off, without counting the attempt.
+func (controller *TaskController) HandleRateLimit(task *Task, rateLimitErr *RateLimitError) {
+	// Retry-After: 0 (or a date in the past) would otherwise retry the task immediately, forever
+	delay := rateLimitErr.RetryAfter
+	if delay <= 0 {
+		delay = task.RetryDelay()
+	}
+	if delay < minRateLimitDelay {
+		delay = minRateLimitDelay
+	}
+	task.RunAfter = time.Now().Add(delay)
+	controller.transition(task, TaskStatusScheduled)
+}
+
+// DelayWorkgroup keeps tasks in a workgroup from starting until the delay has passed.
+func (controller *TaskController) DelayWorkgroup(name string, delay time.Duration) (err error) {
+	workgroup, err := controller.Storage.FindWorkgroup(name)
+	if err != nil {
+		return err
+	}
+	workgroup.Delay(delay)
+	workgroup.UpdatedAt = time.Now()
+	return controller.Storage.SaveWorkgroup(workgroup)
+}
+
+// HandlePermanentError fails a task without retrying it.
+func (controller *TaskController) HandlePermanentError(task *Task, message string) {
 	task.Errors = append(task.Errors, message)
-	errorDelay := time.Duration(task.ErrorDelayInSeconds * int(time.Second))
-	task.RunAfter = time.Now().Add(errorDelay)
+	if task.FirstFailureAt.IsZero() {
+		task.FirstFailureAt = time.Now()
+	}
+	task.RemainingAttempts = 0
+	controller.transition(task, TaskStatusFailed)
 }
@@ -0,0 +1,1603 @@
+package crew
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubTaskClient returns canned worker responses without making any http calls.
+type stubTaskClient struct {
+	post   func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error)
+	cancel func(ctx context.Context, task *Task) error
+}
+
+func (client *stubTaskClient) Post(ctx context.Context, task *Task, parents []*Task) (response WorkerResponse, err error) {
+	return client.post(ctx, task, parents)
+}
+
+func (client *stubTaskClient) Cancel(ctx context.Context, task *Task) (err error) {
+	if client.cancel != nil {
+		return client.cancel(ctx, task)
+	}
+	return nil
+}
+
+func TestExecuteCreatesChildren(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		return WorkerResponse{
+			Output: "done",
+			Children: []*ChildTask{
+				{Id: "task40", Name: "task40", Worker: "worker-b"},
+				{Id: "task41", Name: "task41", Worker: "worker-b", ParentIds: []string{"task40"}},
+			},
+		}, nil
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+
+	task := NewTask()
+	task.Id = "task39"
+	task.Name = "task39"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+
+	controller.Execute(context.Background(), task)
+	controller.Pending.Wait()
+
+	found, _ := storage.FindTask("task39")
+	if !found.IsComplete {
+		t.Fatal("Expected task to be complete")
+	}
+	children, _ := storage.GetTaskChildren("task39")
+	if len(children) != 2 {
+		t.Fatalf("Expected 2 children, got %v", len(children))
+	}
+}
+
+func TestExecuteDelaysChildren(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		return WorkerResponse{Output: "done", ChildrenDelayInSeconds: 60}, nil
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+	// Keep the children from being executed
+	controller.Dispatcher = &recordingDispatcher{}
+
+	task := NewTask()
+	task.Id = "task207"
+	task.TaskGroupId = "group26"
+	task.Name = "task207"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+
+	child := NewTask()
+	child.Id = "task208"
+	child.TaskGroupId = "group26"
+	child.Name = "task208"
+	child.Worker = "worker-b"
+	child.ParentIds = []string{"task207"}
+	storage.SaveTask(child, true)
+
+	controller.Execute(context.Background(), task)
+	controller.Pending.Wait()
+
+	// Delays are applied in the background
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		found, _ := storage.FindTask("task208")
+		if found.RunAfter.After(time.Now().Add(30 * time.Second)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected child to be delayed, got runAfter %v", found.RunAfter)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestExecuteCompletesTasksWithSameKey(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		return WorkerResponse{Output: "shared"}, nil
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+	dispatcher := &recordingDispatcher{}
+	controller.Dispatcher = dispatcher
+
+	task := NewTask()
+	task.Id = "task209"
+	task.TaskGroupId = "group26"
+	task.Name = "task209"
+	task.Worker = "worker-a"
+	task.Key = "key-b"
+	storage.SaveTask(task, true)
+
+	duplicate := NewTask()
+	duplicate.Id = "task210"
+	duplicate.TaskGroupId = "group26"
+	duplicate.Name = "task210"
+	duplicate.Worker = "worker-a"
+	duplicate.Key = "key-b"
+	storage.SaveTask(duplicate, true)
+
+	child := NewTask()
+	child.Id = "task211"
+	child.TaskGroupId = "group26"
+	child.Name = "task211"
+	child.Worker = "worker-b"
+	child.ParentIds = []string{"task210"}
+	storage.SaveTask(child, true)
+
+	controller.Execute(context.Background(), task)
+	controller.Pending.Wait()
+
+	// De-duplication happens in the background, the duplicate's children are evaluated once it is complete
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		evaluated := false
+		dispatcher.mutex.Lock()
+		dispatched := append([]string{}, dispatcher.dispatched...)
+		dispatcher.mutex.Unlock()
+		for _, id := range dispatched {
+			evaluated = evaluated || id == "task211"
+		}
+		if evaluated {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the duplicate's child to be evaluated, dispatched %v", dispatched)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	found, _ := storage.FindTask("task210")
+	if found.Status != TaskStatusSucceeded || found.Output != "shared" {
+		t.Fatalf("Expected duplicate to succeed with the task's output, got %v %v", found.Status, found.Output)
+	}
+}
+
+func TestExecuteChildrenInheritPriority(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	urgent := 10
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		if task.Id != "task128" {
+			return WorkerResponse{Output: "done"}, nil
+		}
+		return WorkerResponse{
+			Output: "done",
+			Children: []*ChildTask{
+				{Id: "task129", Name: "task129", Worker: "worker-b", IsPaused: true},
+				{Id: "task130", Name: "task130", Worker: "worker-b", IsPaused: true, Priority: &urgent},
+			},
+		}, nil
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+
+	task := NewTask()
+	task.Id = "task128"
+	task.Name = "task128"
+	task.Worker = "worker-a"
+	task.Priority = 5
+	storage.SaveTask(task, true)
+
+	controller.Execute(context.Background(), task)
+	controller.Pending.Wait()
+
+	inherited, _ := storage.FindTask("task129")
+	if inherited.Priority != 5 {
+		t.Fatalf("Expected child to inherit priority 5, got %v", inherited.Priority)
+	}
+	overridden, _ := storage.FindTask("task130")
+	if overridden.Priority != 10 {
+		t.Fatalf("Expected child priority 10, got %v", overridden.Priority)
+	}
+
+	sorted := byPriority([]*Task{task, inherited, overridden})
+	if sorted[0].Id != "task130" || sorted[1].Id != "task128" || sorted[2].Id != "task129" {
+		t.Fatalf("Expected tasks sorted by priority, got %v %v %v", sorted[0].Id, sorted[1].Id, sorted[2].Id)
+	}
+}
+
+func TestExecuteChildCreationFailure(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		return WorkerResponse{
+			Output: "done",
+			Children: []*ChildTask{
+				{Id: "task43", Name: "task43", Worker: "worker-b"},
+				// Duplicates an existing task
+				{Id: "task44", Name: "task44", Worker: "worker-b"},
+			},
+		}, nil
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+
+	task := NewTask()
+	task.Id = "task42"
+	task.Name = "task42"
+	task.Worker = "worker-a"
+	// Only one attempt so that the failure isn't retried
+	task.RemainingAttempts = 1
+	storage.SaveTask(task, true)
+
+	existing := NewTask()
+	existing.Id = "task44"
+	existing.Name = "task44"
+	existing.Worker = "worker-b"
+	existing.IsPaused = true
+	storage.SaveTask(existing, true)
+
+	controller.Execute(context.Background(), task)
+	controller.Pending.Wait()
+
+	found, _ := storage.FindTask("task42")
+	if found.IsComplete {
+		t.Fatal("Expected task to be incomplete after child creation failure")
+	}
+	if len(found.Errors) != 1 {
+		t.Fatalf("Expected 1 error, got %v", len(found.Errors))
+	}
+	_, err := storage.FindTask("task43")
+	if err == nil {
+		t.Fatal("Expected no children to be created")
+	}
+}
+
+func TestExecutePermanentErrorIsNotRetried(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	calls := 0
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		calls++
+		return WorkerResponse{}, &WorkerError{Message: "invalid input", StatusCode: 400, Retryable: false}
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+
+	task := NewTask()
+	task.Id = "task49"
+	task.Name = "task49"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+
+	controller.Execute(context.Background(), task)
+	controller.Pending.Wait()
+
+	found, _ := storage.FindTask("task49")
+	if found.RemainingAttempts != 0 {
+		t.Fatalf("Expected 0 remaining attempts, got %v", found.RemainingAttempts)
+	}
+	if len(found.Errors) != 1 {
+		t.Fatalf("Expected 1 error, got %v", len(found.Errors))
+	}
+	if calls != 1 {
+		t.Fatalf("Expected 1 worker call, got %v", calls)
+	}
+}
+
+func TestExecuteNonRetryableWorkerResponse(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	retryable := false
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		return WorkerResponse{Error: "bad input", Retryable: &retryable}, nil
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+
+	task := NewTask()
+	task.Id = "task50"
+	task.Name = "task50"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+
+	controller.Execute(context.Background(), task)
+	controller.Pending.Wait()
+
+	found, _ := storage.FindTask("task50")
+	if found.RemainingAttempts != 0 {
+		t.Fatalf("Expected 0 remaining attempts, got %v", found.RemainingAttempts)
+	}
+}
+
+func TestExecuteStatusTransitions(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		if task.Status != TaskStatusRunning {
+			t.Errorf("Expected task to be running during worker call, got %v", task.Status)
+		}
+		if task.LeaseOwner == "" || !task.LeaseExpiresAt.After(time.Now()) {
+			t.Errorf("Expected task to hold an execution lease during worker call")
+		}
+		if task.Input == "fail" {
+			return WorkerResponse{Error: "oops"}, nil
+		}
+		return WorkerResponse{Output: "done"}, nil
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+
+	succeeds := NewTask()
+	succeeds.Id = "task56"
+	succeeds.TaskGroupId = "group5"
+	succeeds.Name = "task56"
+	succeeds.Worker = "worker-a"
+	storage.SaveTask(succeeds, true)
+
+	fails := NewTask()
+	fails.Id = "task57"
+	fails.TaskGroupId = "group5"
+	fails.Name = "task57"
+	fails.Worker = "worker-a"
+	fails.Input = "fail"
+	fails.RemainingAttempts = 1
+	storage.SaveTask(fails, true)
+
+	controller.Execute(context.Background(), succeeds)
+	controller.Execute(context.Background(), fails)
+	controller.Pending.Wait()
+
+	if succeeds.Status != TaskStatusSucceeded {
+		t.Fatalf("Expected %v, got %v", TaskStatusSucceeded, succeeds.Status)
+	}
+	if succeeds.LeaseOwner != "" {
+		t.Fatal("Expected execution lease to be released")
+	}
+	if fails.Status != TaskStatusFailed {
+		t.Fatalf("Expected %v, got %v", TaskStatusFailed, fails.Status)
+	}
+
+	found, _, _ := controller.GetTasksInGroup("group5", 1, 20, "", false, []TaskStatus{TaskStatusFailed})
+	if len(found) != 1 || found[0].Id != "task57" {
+		t.Fatalf("Expected only task57 to be failed, got %v tasks", len(found))
+	}
+}
+
+func TestEvaluateMarksBlockedTasks(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	controller := NewTaskController(storage, nil, nil)
+	controller.Feed = nil
+
+	parent := NewTask()
+	parent.Id = "task58"
+	parent.Name = "task58"
+	parent.Worker = "worker-a"
+	parent.IsPaused = true
+	storage.SaveTask(parent, true)
+
+	child := NewTask()
+	child.Id = "task59"
+	child.Name = "task59"
+	child.Worker = "worker-a"
+	child.ParentIds = []string{"task58"}
+	storage.SaveTask(child, true)
+
+	controller.Evaluate(context.Background(), child)
+	if child.Status != TaskStatusBlocked {
+		t.Fatalf("Expected %v, got %v", TaskStatusBlocked, child.Status)
+	}
+}
+
+func TestUpdateTaskRejectsInvalidStatus(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	controller := NewTaskController(storage, nil, nil)
+	controller.Feed = nil
+
+	task := NewTask()
+	task.Id = "task60"
+	task.Name = "task60"
+	task.Worker = "worker-a"
+	task.IsPaused = true
+	storage.SaveTask(task, true)
+
+	_, err := controller.UpdateTask("task60", map[string]interface{}{"status": "skipped"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !task.IsComplete {
+		t.Fatal("Expected skipped task to be complete")
+	}
+
+	_, err = controller.UpdateTask("task60", map[string]interface{}{"status": "running"})
+	if err == nil {
+		t.Fatal("Expected skipped -> running to be rejected")
+	}
+
+	// Statuses that crew manages can't be set by users, even when the transition is valid
+	_, err = controller.UpdateTask("task60", map[string]interface{}{"status": "pending"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []string{"running", "succeeded", "scheduled", "unknown"} {
+		_, err = controller.UpdateTask("task60", map[string]interface{}{"status": status})
+		if !errors.Is(err, ErrInvalidTaskUpdate) {
+			t.Fatalf("Expected %v to be rejected with %v, got %v", status, ErrInvalidTaskUpdate, err)
+		}
+	}
+	if task.Status != TaskStatusPending || task.BusyExecuting {
+		t.Fatalf("Expected task to stay pending, got %v", task.Status)
+	}
+}
+
+func TestUpdateRunningTaskStatus(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	started := make(chan string, 2)
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		started <- task.Id
+		if task.Id == "task204" {
+			return WorkerResponse{Async: true}, nil
+		}
+		<-ctx.Done()
+		return WorkerResponse{}, ctx.Err()
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+
+	for _, id := range []string{"task203", "task204"} {
+		task := NewTask()
+		task.Id = id
+		task.TaskGroupId = "group25"
+		task.Name = id
+		task.Worker = "worker-a"
+		storage.SaveTask(task, true)
+		controller.Execute(context.Background(), task)
+		<-started
+	}
+	// Wait for the async worker's response to be recorded
+	for {
+		found, _ := storage.FindTask("task204")
+		if found.AwaitingCompletion {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, id := range []string{"task203", "task204"} {
+		for _, status := range []string{"pending", "skipped"} {
+			_, err := controller.UpdateTask(id, map[string]interface{}{"status": status})
+			if !errors.Is(err, ErrInvalidTaskUpdate) {
+				t.Fatalf("Expected running %v to reject %v with %v, got %v", id, status, ErrInvalidTaskUpdate, err)
+			}
+		}
+		if found, _ := storage.FindTask(id); found.Status != TaskStatusRunning {
+			t.Fatalf("Expected %v to keep running, got %v", id, found.Status)
+		}
+
+		if _, err := controller.UpdateTask(id, map[string]interface{}{"status": "canceled"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	controller.Pending.Wait()
+
+	for _, id := range []string{"task203", "task204"} {
+		found, _ := storage.FindTask(id)
+		if found.Status != TaskStatusCanceled {
+			t.Fatalf("Expected %v to be canceled, got %v", id, found.Status)
+		}
+		attempts, _ := storage.GetTaskAttempts(id)
+		if len(attempts) != 1 || attempts[0].ErrorType != AttemptErrorCanceled {
+			t.Fatalf("Expected %v's attempt to be closed as canceled, got %+v", id, attempts)
+		}
+	}
+}
+
+func TestExecuteRecordsAttempts(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		return WorkerResponse{WorkerUrl: "http://localhost/worker-a", StatusCode: 500}, &WorkerError{Message: "boom", StatusCode: 500, Retryable: true}
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+
+	task := NewTask()
+	task.Id = "task65"
+	task.TaskGroupId = "group6"
+	task.Name = "task65"
+	task.Worker = "worker-a"
+	task.RemainingAttempts = 1
+	storage.SaveTask(task, true)
+
+	controller.Execute(context.Background(), task)
+	controller.Pending.Wait()
+
+	attempts, err := controller.GetTaskAttempts("task65")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 1 {
+		t.Fatalf("Expected 1 attempt, got %v", len(attempts))
+	}
+	attempt := attempts[0]
+	if attempt.Number != 1 || attempt.StatusCode != 500 || attempt.Error != "boom" || attempt.WorkerUrl != "http://localhost/worker-a" {
+		t.Fatalf("Unexpected attempt %+v", attempt)
+	}
+	if attempt.EndedAt.IsZero() {
+		t.Fatal("Expected attempt to be finished")
+	}
+
+	_, err = controller.GetTaskAttempts("missing")
+	if err == nil {
+		t.Fatal("Expected missing task to fail")
+	}
+}
+
+func TestRateLimitWithoutDelay(t *testing.T) {
+	controller := NewTaskController(NewMemoryTaskStorage(), &stubTaskClient{}, nil)
+	controller.Feed = nil
+
+	// Retry-After: 0 falls back to the task's error delay
+	task := NewTask()
+	task.Id = "task179"
+	task.SetStatus(TaskStatusScheduled)
+	task.SetStatus(TaskStatusRunning)
+	task.ErrorDelayInSeconds = 30
+	controller.HandleRateLimit(task, &RateLimitError{Message: "slow down", StatusCode: 429})
+	if task.Status != TaskStatusScheduled || task.RunAfter.Before(time.Now().Add(25*time.Second)) {
+		t.Fatalf("Expected task to wait out its error delay, got %v %v", task.Status, task.RunAfter)
+	}
+
+	// And never retries right away
+	task.SetStatus(TaskStatusRunning)
+	task.ErrorDelayInSeconds = 0
+	controller.HandleRateLimit(task, &RateLimitError{Message: "slow down", StatusCode: 429})
+	if !task.RunAfter.After(time.Now().Add(minRateLimitDelay / 2)) {
+		t.Fatalf("Expected task to wait at least %v, runAfter is %v", minRateLimitDelay, task.RunAfter)
+	}
+}
+
+func TestExecuteRateLimitDelaysWorkgroup(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		return WorkerResponse{StatusCode: 429}, &RateLimitError{Message: "slow down", StatusCode: 429, RetryAfter: time.Minute}
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+	// Keep the retry from being executed while the test waits on Pending
+	controller.Dispatcher = &recordingDispatcher{}
+
+	task := NewTask()
+	task.Id = "task120"
+	task.TaskGroupId = "group13"
+	task.Name = "task120"
+	task.Worker = "worker-a"
+	task.Workgroup = "api-key-a"
+	task.RemainingAttempts = 1
+	storage.SaveTask(task, true)
+
+	sibling := NewTask()
+	sibling.Id = "task121"
+	sibling.TaskGroupId = "group13"
+	sibling.Name = "task121"
+	sibling.Worker = "worker-a"
+	sibling.Workgroup = "api-key-a"
+	storage.SaveTask(sibling, true)
+
+	other := NewTask()
+	other.Id = "task122"
+	other.TaskGroupId = "group13"
+	other.Name = "task122"
+	other.Worker = "worker-a"
+	other.Workgroup = "api-key-b"
+	storage.SaveTask(other, true)
+
+	controller.Execute(context.Background(), task)
+	controller.Pending.Wait()
+
+	// The attempt doesn't count and the task waits out the Retry-After
+	saved, _ := storage.FindTask("task120")
+	if saved.Status != TaskStatusScheduled || saved.RemainingAttempts != 1 {
+		t.Fatalf("Expected task to be rescheduled without using an attempt, got %v %v", saved.Status, saved.RemainingAttempts)
+	}
+	if saved.RunAfter.Before(time.Now().Add(50 * time.Second)) {
+		t.Fatalf("Expected task to wait for Retry-After, runAfter is %v", saved.RunAfter)
+	}
+	attempts, _ := storage.GetTaskAttempts("task120")
+	if len(attempts) != 1 || attempts[0].Error != "slow down" {
+		t.Fatalf("Expected rate limited attempt in history, got %+v", attempts)
+	}
+
+	// The rest of the workgroup waits as well (including tasks that are created later)
+	workgroup, _ := controller.GetWorkgroup("api-key-a")
+	if workgroup.PausedUntil.Before(time.Now().Add(50 * time.Second)) {
+		t.Fatalf("Expected workgroup to be delayed, pausedUntil is %v", workgroup.PausedUntil)
+	}
+	if !sibling.StartAfter(workgroup).Equal(workgroup.PausedUntil) {
+		t.Fatal("Expected sibling to wait for the workgroup delay")
+	}
+	otherWorkgroup, _ := controller.GetWorkgroup("api-key-b")
+	if !otherWorkgroup.IsAvailable(time.Now()) {
+		t.Fatal("Expected other workgroups not to be delayed")
+	}
+}
+
+func TestPauseAndResumeWorkgroup(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	calls := make(chan string, 1)
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		calls <- task.Id
+		return WorkerResponse{Output: "done"}, nil
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+
+	_, err := controller.PauseWorkgroup("api-key-c", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task := NewTask()
+	task.Id = "task123"
+	task.TaskGroupId = "group14"
+	task.Name = "task123"
+	task.Worker = "worker-a"
+	task.Workgroup = "api-key-c"
+	storage.SaveTask(task, true)
+
+	controller.Evaluate(context.Background(), task)
+	controller.Pending.Wait()
+	select {
+	case <-calls:
+		t.Fatal("Expected task in paused workgroup not to execute")
+	default:
+	}
+
+	workgroups, _ := controller.GetWorkgroups()
+	if len(workgroups) != 1 || workgroups[0].Name != "api-key-c" || !workgroups[0].IsPaused {
+		t.Fatalf("Expected paused workgroup to be listed, got %+v", workgroups)
+	}
+
+	// Resuming evaluates the tasks that were waiting
+	workgroup, err := controller.ResumeWorkgroup("api-key-c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !workgroup.IsAvailable(time.Now()) {
+		t.Fatal("Expected workgroup to be available after resume")
+	}
+	select {
+	case taskId := <-calls:
+		if taskId != "task123" {
+			t.Fatalf("Expected task123 to execute, got %v", taskId)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected task to execute after workgroup resumed")
+	}
+	controller.Pending.Wait()
+}
+
+func TestUpdateWorkgroup(t *testing.T) {
+	controller := NewTaskController(NewMemoryTaskStorage(), nil, nil)
+	controller.Feed = nil
+
+	workgroup, err := controller.UpdateWorkgroup("api-key-d", map[string]interface{}{
+		"maxConcurrency":             float64(2),
+		"rateLimit":                  float64(60),
+		"rateLimitIntervalInSeconds": float64(60),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workgroup.MaxConcurrency != 2 || workgroup.GetRateLimit() != (RateLimit{Tokens: 60, Interval: time.Minute}) {
+		t.Fatalf("Unexpected workgroup %+v", workgroup)
+	}
+
+	_, err = controller.UpdateWorkgroup("api-key-d", map[string]interface{}{"maxConcurrency": "lots"})
+	if !errors.Is(err, ErrInvalidWorkgroupUpdate) {
+		t.Fatalf("Expected invalid maxConcurrency to be rejected with %v, got %v", ErrInvalidWorkgroupUpdate, err)
+	}
+	_, err = controller.UpdateWorkgroup("api-key-d", map[string]interface{}{"rateLimit": float64(-1)})
+	if !errors.Is(err, ErrInvalidWorkgroupUpdate) {
+		t.Fatalf("Expected negative rateLimit to be rejected with %v, got %v", ErrInvalidWorkgroupUpdate, err)
+	}
+	_, err = controller.UpdateWorkgroup(" ", map[string]interface{}{"maxConcurrency": float64(1)})
+	if !errors.Is(err, ErrInvalidWorkgroupUpdate) {
+		t.Fatalf("Expected blank name to be rejected with %v, got %v", ErrInvalidWorkgroupUpdate, err)
+	}
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		<-ctx.Done()
+		return WorkerResponse{}, ctx.Err()
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+	controller.DefaultTaskTimeout = 50 * time.Millisecond
+	// Keep the retry from being executed while the test waits on Pending
+	controller.Dispatcher = &recordingDispatcher{}
+
+	task := NewTask()
+	task.Id = "task135"
+	task.TaskGroupId = "group15"
+	task.Name = "task135"
+	task.Worker = "worker-a"
+	task.RemainingAttempts = 2
+	storage.SaveTask(task, true)
+
+	if controller.TaskTimeout(task) != 50*time.Millisecond {
+		t.Fatalf("Expected default timeout, got %v", controller.TaskTimeout(task))
+	}
+
+	controller.Execute(context.Background(), task)
+	controller.Pending.Wait()
+
+	// A timeout counts as a failed attempt and is retried
+	saved, _ := storage.FindTask("task135")
+	if saved.Status != TaskStatusScheduled || saved.RemainingAttempts != 1 {
+		t.Fatalf("Expected task to be rescheduled, got %v %v", saved.Status, saved.RemainingAttempts)
+	}
+	attempts, _ := storage.GetTaskAttempts("task135")
+	if len(attempts) != 1 || attempts[0].ErrorType != AttemptErrorTimeout || attempts[0].Error != "Worker did not respond within 50ms" {
+		t.Fatalf("Expected a timeout attempt, got %+v", attempts)
+	}
+
+	saved.TimeoutInSeconds = 90
+	if controller.TaskTimeout(saved) != 90*time.Second {
+		t.Fatalf("Expected task timeout to override the default, got %v", controller.TaskTimeout(saved))
+	}
+}
+
+func TestCompleteAsyncTask(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		return WorkerResponse{Async: true, StatusCode: 202, WorkerUrl: "http://worker-a"}, nil
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+
+	task := NewTask()
+	task.Id = "task137"
+	task.TaskGroupId = "group16"
+	task.Name = "task137"
+	task.Worker = "worker-a"
+	task.RemainingAttempts = 2
+	storage.SaveTask(task, true)
+
+	controller.Execute(context.Background(), task)
+	controller.Pending.Wait()
+
+	// The task keeps running until the worker reports back
+	accepted, _ := storage.FindTask("task137")
+	if accepted.Status != TaskStatusRunning || !accepted.AwaitingCompletion || accepted.LeaseToken == "" {
+		t.Fatalf("Expected task to await completion, got %v %v", accepted.Status, accepted.AwaitingCompletion)
+	}
+	if time.Until(accepted.LeaseExpiresAt) < 59*time.Minute {
+		t.Fatalf("Expected lease to last until the async deadline, got %v", accepted.LeaseExpiresAt)
+	}
+	attempts, _ := storage.GetTaskAttempts("task137")
+	if len(attempts) != 1 || !attempts[0].EndedAt.IsZero() || attempts[0].StatusCode != 202 {
+		t.Fatalf("Expected an open attempt, got %+v", attempts)
+	}
+
+	_, err := controller.CompleteTask("task137", "wrong-token", WorkerResponse{Output: "done"})
+	if err != ErrInvalidCompletionToken {
+		t.Fatalf("Expected %v, got %v", ErrInvalidCompletionToken, err)
+	}
+
+	response := WorkerResponse{
+		Output: "done",
+		Children: []*ChildTask{
+			{Id: "task138", Name: "task138", Worker: "worker-b"},
+		},
+	}
+	completed, err := controller.CompleteTask("task137", accepted.LeaseToken, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if completed.Status != TaskStatusSucceeded || completed.Output != "done" || completed.AwaitingCompletion {
+		t.Fatalf("Expected task to succeed, got %v %v", completed.Status, completed.Output)
+	}
+	if _, findErr := storage.FindTask("task138"); findErr != nil {
+		t.Fatal("Expected child to be created", findErr)
+	}
+	attempts, _ = storage.GetTaskAttempts("task137")
+	if attempts[0].EndedAt.IsZero() || attempts[0].Error != "" || attempts[0].WorkerUrl != "http://worker-a" {
+		t.Fatalf("Expected attempt to be finished, got %+v", attempts[0])
+	}
+
+	// Only the first report counts
+	_, err = controller.CompleteTask("task137", accepted.LeaseToken, response)
+	if err != ErrTaskNotAwaitingCompletion {
+		t.Fatalf("Expected %v, got %v", ErrTaskNotAwaitingCompletion, err)
+	}
+}
+
+func TestAsyncDeadline(t *testing.T) {
+	// Sql storage hands out copies, so the test can poll the task while the deadline updates it
+	storage := newTestSqlTaskStorage(t)
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		return WorkerResponse{Async: true, StatusCode: 202}, nil
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+	controller.AsyncDeadline = 50 * time.Millisecond
+	controller.Dispatcher = &recordingDispatcher{}
+
+	task := NewTask()
+	task.Id = "task139"
+	task.TaskGroupId = "group16"
+	task.Name = "task139"
+	task.Worker = "worker-a"
+	task.RemainingAttempts = 2
+	storage.SaveTask(task, true)
+
+	controller.Execute(context.Background(), task)
+	controller.Pending.Wait()
+	accepted, _ := storage.FindTask("task139")
+	token := accepted.LeaseToken
+
+	// A missed deadline counts as a failed attempt and is retried
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		found, _ := storage.FindTask("task139")
+		if found.Status == TaskStatusScheduled {
+			if found.RemainingAttempts != 1 || found.AwaitingCompletion {
+				t.Fatalf("Unexpected task after deadline %v %v", found.RemainingAttempts, found.AwaitingCompletion)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected task to be rescheduled, got %v", found.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	attempts, _ := storage.GetTaskAttempts("task139")
+	if len(attempts) != 1 || attempts[0].ErrorType != AttemptErrorTimeout || attempts[0].EndedAt.IsZero() {
+		t.Fatalf("Expected a timed out attempt, got %+v", attempts)
+	}
+
+	// Reports that arrive after the deadline are rejected
+	_, err := controller.CompleteTask("task139", token, WorkerResponse{Output: "late"})
+	if err != ErrTaskNotAwaitingCompletion {
+		t.Fatalf("Expected %v, got %v", ErrTaskNotAwaitingCompletion, err)
+	}
+}
+
+func TestReevaluatingAcceptedAsyncTask(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	posts := 0
+	var postsMutex sync.Mutex
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		postsMutex.Lock()
+		defer postsMutex.Unlock()
+		posts++
+		return WorkerResponse{Async: true, StatusCode: 202}, nil
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+	dispatcher := &recordingDispatcher{}
+	controller.Dispatcher = dispatcher
+
+	task := NewTask()
+	task.Id = "task199"
+	task.TaskGroupId = "group22"
+	task.Name = "task199"
+	task.Worker = "worker-a"
+	task.Workgroup = "group-f"
+	storage.SaveTask(task, true)
+
+	controller.Execute(context.Background(), task)
+	controller.Pending.Wait()
+	accepted, _ := storage.FindTask("task199")
+	token := accepted.LeaseToken
+
+	// Everything that re-evaluates tasks while the worker has the task
+	if _, err := controller.UpdateTask("task199", map[string]interface{}{"isPaused": false}); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.RetryTaskGroup("group22", 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := controller.ResumeWorkgroup("group-f"); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher.mutex.Lock()
+	dispatched := append([]string{}, dispatcher.dispatched...)
+	dispatcher.mutex.Unlock()
+	if len(dispatched) == 0 {
+		t.Fatal("Expected the task to be re-evaluated")
+	}
+	for _, id := range dispatched {
+		controller.EvaluateTaskById(id)
+	}
+	running, _ := storage.FindTask("task199")
+	controller.Execute(context.Background(), running)
+	controller.Pending.Wait()
+
+	postsMutex.Lock()
+	defer postsMutex.Unlock()
+	if posts != 1 {
+		t.Fatalf("Expected the worker to be posted once, got %v", posts)
+	}
+	found, _ := storage.FindTask("task199")
+	if found.Status != TaskStatusRunning || found.LeaseToken != token {
+		t.Fatalf("Expected the accepted attempt to be left alone, got %v %q", found.Status, found.LeaseToken)
+	}
+	if _, err := controller.CompleteTask("task199", token, WorkerResponse{Output: "done"}); err != nil {
+		t.Fatalf("Expected the worker's report to be accepted, got %v", err)
+	}
+}
+
+func TestLongCallOutlastingTaskLock(t *testing.T) {
+	// The task lock expires while the worker is still working on the task
+	t.Setenv("CREW_TASK_LOCK_EXPIRATION", "100ms")
+	storage := newTestSqlTaskStorage(t)
+
+	started := make(chan bool)
+	release := make(chan bool)
+	slowNode := NewTaskController(storage, &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		close(started)
+		<-release
+		return WorkerResponse{Output: "done"}, nil
+	}}, nil)
+	slowNode.Feed = nil
+	slowNode.Dispatcher = &recordingDispatcher{}
+
+	otherPosts := 0
+	otherNode := NewTaskController(storage, &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		otherPosts++
+		return WorkerResponse{Output: "again"}, nil
+	}}, nil)
+	otherNode.Feed = nil
+	otherNode.Dispatcher = &recordingDispatcher{}
+
+	task := NewTask()
+	task.Id = "task202"
+	task.TaskGroupId = "group24"
+	task.Name = "Slow"
+	task.Worker = "worker-a"
+	task.TimeoutInSeconds = 60
+	storage.SaveTask(task, true)
+
+	slowNode.Execute(context.Background(), task)
+	<-started
+	time.Sleep(200 * time.Millisecond)
+
+	otherNode.Execute(context.Background(), task)
+	otherNode.Pending.Wait()
+	if otherPosts != 0 {
+		t.Fatalf("Expected the running task not to be executed again, posted %v times", otherPosts)
+	}
+
+	close(release)
+	slowNode.Pending.Wait()
+	found, _ := storage.FindTask("task202")
+	if found.Status != TaskStatusSucceeded || found.Output != "done" {
+		t.Fatalf("Expected the first call's result, got %v %v", found.Status, found.Output)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	tokens := make(chan string, 1)
+	finish := make(chan bool)
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		tokens <- task.LeaseToken
+		<-finish
+		return WorkerResponse{Output: "done"}, nil
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+
+	task := NewTask()
+	task.Id = "task140"
+	task.TaskGroupId = "group17"
+	task.Name = "task140"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+
+	controller.Execute(context.Background(), task)
+	token := <-tokens
+	running, _ := storage.FindTask("task140")
+	leaseExpiresAt := running.LeaseExpiresAt
+
+	progress := 50.0
+	message := "halfway"
+	_, err := controller.Heartbeat("task140", "wrong-token", &progress, &message)
+	if err != ErrInvalidCompletionToken {
+		t.Fatalf("Expected %v, got %v", ErrInvalidCompletionToken, err)
+	}
+	updated, err := controller.Heartbeat("task140", token, &progress, &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Progress != 50 || updated.ProgressMessage != "halfway" {
+		t.Fatalf("Expected progress to be recorded, got %v %v", updated.Progress, updated.ProgressMessage)
+	}
+	if !updated.LeaseExpiresAt.After(leaseExpiresAt) {
+		t.Fatalf("Expected lease to be extended past %v, got %v", leaseExpiresAt, updated.LeaseExpiresAt)
+	}
+
+	// Omitted values are left alone
+	updated, _ = controller.Heartbeat("task140", token, nil, nil)
+	if updated.Progress != 50 || updated.ProgressMessage != "halfway" {
+		t.Fatalf("Expected progress to be unchanged, got %v %v", updated.Progress, updated.ProgressMessage)
+	}
+
+	close(finish)
+	controller.Pending.Wait()
+
+	// Progress belongs to the execution
+	found, _ := storage.FindTask("task140")
+	if found.Status != TaskStatusSucceeded || found.Progress != 0 || found.ProgressMessage != "" {
+		t.Fatalf("Expected progress to be cleared, got %v %v %v", found.Status, found.Progress, found.ProgressMessage)
+	}
+	_, err = controller.Heartbeat("task140", token, &progress, &message)
+	if err != ErrTaskNotRunning {
+		t.Fatalf("Expected %v, got %v", ErrTaskNotRunning, err)
+	}
+}
+
+// racingTaskStorage runs beforeUpdate once, right before the next UpdateTaskIf, to land a write between a read and a conditional update.
+type racingTaskStorage struct {
+	TaskStorage
+	beforeUpdate func()
+}
+
+func (storage *racingTaskStorage) UpdateTaskIf(taskId string, status TaskStatus, leaseToken string, update func(task *Task)) (task *Task, err error) {
+	if storage.beforeUpdate != nil {
+		beforeUpdate := storage.beforeUpdate
+		storage.beforeUpdate = nil
+		beforeUpdate()
+	}
+	return storage.TaskStorage.UpdateTaskIf(taskId, status, leaseToken, update)
+}
+
+func TestHeartbeatRacingCompletion(t *testing.T) {
+	server, _ := newTestRedis(t)
+	storages := map[string]TaskStorage{
+		"memory": NewMemoryTaskStorage(),
+		"sql":    newTestSqlTaskStorage(t),
+		"redis":  NewRedisTaskStorage(server.Addr(), "", 0),
+	}
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			racing := &racingTaskStorage{TaskStorage: storage}
+			controller := NewTaskController(racing, nil, nil)
+			controller.Feed = nil
+			controller.Dispatcher = &recordingDispatcher{}
+
+			task := NewTask()
+			task.Id = "task183"
+			task.TaskGroupId = "group20"
+			task.Name = "task183"
+			task.Worker = "worker-a"
+			task.Status = TaskStatusRunning
+			task.AwaitingCompletion = true
+			task.LeaseToken = "token-a"
+			task.LeaseExpiresAt = time.Now().Add(time.Minute)
+			if err := storage.SaveTask(task, true); err != nil {
+				t.Fatal(err)
+			}
+
+			// The worker's result arrives after the heartbeat has read the task but before it saves
+			racing.beforeUpdate = func() {
+				if _, err := controller.CompleteTask("task183", "token-a", WorkerResponse{Output: "done"}); err != nil {
+					t.Error(err)
+				}
+			}
+			progress := 90.0
+			_, err := controller.Heartbeat("task183", "token-a", &progress, nil)
+			if err != ErrTaskNotRunning {
+				t.Fatalf("Expected %v, got %v", ErrTaskNotRunning, err)
+			}
+
+			found, _ := storage.FindTask("task183")
+			if found.Status != TaskStatusSucceeded || found.LeaseToken != "" || found.Progress != 0 {
+				t.Fatalf("Expected the completion to be kept, got %v %q %v", found.Status, found.LeaseToken, found.Progress)
+			}
+		})
+	}
+}
+
+func TestHeartbeatExtendsAsyncDeadline(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		return WorkerResponse{Async: true, StatusCode: 202}, nil
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+	// Keep the retry from being executed while the test waits on Pending
+	controller.Dispatcher = &recordingDispatcher{}
+	controller.AsyncDeadline = 100 * time.Millisecond
+	controller.ExecutionLeaseDuration = 300 * time.Millisecond
+
+	task := NewTask()
+	task.Id = "task141"
+	task.TaskGroupId = "group17"
+	task.Name = "task141"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+
+	controller.Execute(context.Background(), task)
+	controller.Pending.Wait()
+	accepted, _ := storage.FindTask("task141")
+	_, err := controller.Heartbeat("task141", accepted.LeaseToken, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Still running after the original deadline
+	time.Sleep(200 * time.Millisecond)
+	found, _ := storage.FindTask("task141")
+	if found.Status != TaskStatusRunning {
+		t.Fatalf("Expected heartbeat to extend the deadline, got %v", found.Status)
+	}
+
+	// But reclaimed once the extended deadline passes
+	deadline := time.Now().Add(2 * time.Second)
+	for found.Status == TaskStatusRunning {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected task to be reclaimed after the extended deadline")
+		}
+		time.Sleep(10 * time.Millisecond)
+		found, _ = storage.FindTask("task141")
+	}
+	if found.Status != TaskStatusScheduled {
+		t.Fatalf("Expected task to be rescheduled, got %v", found.Status)
+	}
+}
+
+func TestLeaseTasks(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	// Tasks are queued by one instance and leased from another
+	instanceA := NewTaskController(storage, NewPullTaskClient(), nil)
+	instanceA.Feed = nil
+	instanceA.Dispatcher = &recordingDispatcher{}
+	instanceB := NewTaskController(storage, NewPullTaskClient(), nil)
+	instanceB.Feed = nil
+	instanceB.Dispatcher = &recordingDispatcher{}
+
+	for _, id := range []string{"task145", "task146", "task147"} {
+		task := NewTask()
+		task.Id = id
+		task.TaskGroupId = "group18"
+		task.Name = id
+		task.Worker = "worker-a"
+		if id == "task147" {
+			task.Priority = 5
+		}
+		storage.SaveTask(task, true)
+		instanceA.Execute(context.Background(), task)
+	}
+	instanceA.Pending.Wait()
+
+	// Queued tasks wait for the worker
+	queued, _ := storage.FindTask("task145")
+	if queued.Status != TaskStatusRunning || !queued.AwaitingCompletion || !queued.AwaitingLease {
+		t.Fatalf("Expected task to await a worker, got %v %v %v", queued.Status, queued.AwaitingCompletion, queued.AwaitingLease)
+	}
+
+	_, err := instanceA.CancelTask("task146")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if payloads, _ := instanceB.LeaseTasks("worker-b", 5); len(payloads) != 0 {
+		t.Fatalf("Expected no tasks for worker-b, got %+v", payloads)
+	}
+	urgent, _ := storage.FindTask("task147")
+	payloads, err := instanceB.LeaseTasks("worker-a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payloads) != 1 || payloads[0].TaskId != "task147" {
+		t.Fatalf("Expected higher priority task first, got %+v", payloads)
+	}
+	if payloads[0].CompletionToken == "" || payloads[0].CompletionToken == urgent.LeaseToken {
+		t.Fatalf("Expected leased task to get a new completion token, got %q", payloads[0].CompletionToken)
+	}
+	leased, _ := storage.FindTask("task147")
+	if leased.AwaitingLease || leased.LeaseToken != payloads[0].CompletionToken {
+		t.Fatalf("Expected task to be claimed, got %v %q", leased.AwaitingLease, leased.LeaseToken)
+	}
+
+	more, err := instanceA.LeaseTasks("worker-a", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(more) != 1 || more[0].TaskId != "task145" {
+		t.Fatalf("Expected remaining task without the canceled one, got %+v", more)
+	}
+	if rest, _ := instanceA.LeaseTasks("worker-a", 5); len(rest) != 0 {
+		t.Fatalf("Expected queue to be empty, got %+v", rest)
+	}
+
+	for _, payload := range append(payloads, more...) {
+		if _, err = instanceB.CompleteTask(payload.TaskId, payload.CompletionToken, WorkerResponse{Output: "done"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	completed, _ := storage.FindTask("task145")
+	if completed.Status != TaskStatusSucceeded || completed.Output != "done" || completed.AwaitingLease {
+		t.Fatalf("Expected leased task to succeed, got %v %v %v", completed.Status, completed.Output, completed.AwaitingLease)
+	}
+
+	push := NewTaskController(storage, &stubTaskClient{}, nil)
+	push.Feed = nil
+	if _, err = push.LeaseTasks("worker-a", 1); err != ErrLeaseNotSupported {
+		t.Fatalf("Expected %v, got %v", ErrLeaseNotSupported, err)
+	}
+}
+
+func TestLeaseTasksClaimsEachTaskOnce(t *testing.T) {
+	server, _ := newTestRedis(t)
+	storages := map[string]TaskStorage{
+		"memory": NewMemoryTaskStorage(),
+		"sql":    newTestSqlTaskStorage(t),
+		"redis":  NewRedisTaskStorage(server.Addr(), "", 0),
+	}
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			ids := []string{}
+			for i := 184; i < 194; i++ {
+				task := NewTask()
+				task.Id = fmt.Sprintf("task%d", i)
+				task.TaskGroupId = "group21"
+				task.Name = task.Id
+				task.Worker = "worker-a"
+				task.Status = TaskStatusRunning
+				task.AwaitingCompletion = true
+				task.AwaitingLease = true
+				task.LeaseToken = "queued-" + task.Id
+				task.LeaseExpiresAt = time.Now().Add(time.Minute)
+				if err := storage.SaveTask(task, true); err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, task.Id)
+			}
+
+			// Workers lease from two instances at once
+			controllers := []*TaskController{}
+			for i := 0; i < 2; i++ {
+				controller := NewTaskController(storage, NewPullTaskClient(), nil)
+				controller.Feed = nil
+				controllers = append(controllers, controller)
+			}
+			leased := make(chan string, len(ids)*2)
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func(controller *TaskController) {
+					defer wg.Done()
+					for {
+						payloads, err := controller.LeaseTasks("worker-a", 1)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if len(payloads) == 0 {
+							return
+						}
+						for _, payload := range payloads {
+							leased <- payload.TaskId
+						}
+					}
+				}(controllers[i%2])
+			}
+			wg.Wait()
+			close(leased)
+
+			counts := map[string]int{}
+			for id := range leased {
+				counts[id]++
+			}
+			for _, id := range ids {
+				if counts[id] != 1 {
+					t.Fatalf("Expected %v to be leased once, got %v", id, counts[id])
+				}
+			}
+		})
+	}
+}
+
+func TestQueuedTasksHoldThrottlerSlots(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	controller := NewTaskController(storage, NewPullTaskClient(), NewWorkerThrottler(map[string]int{"worker-a": 1}))
+	controller.Feed = nil
+	controller.Dispatcher = &recordingDispatcher{}
+
+	waitForQueued := func(id string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			found, _ := storage.FindTask(id)
+			if found != nil && found.AwaitingLease {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %v to be queued", id)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	leaseAndComplete := func(id string) {
+		t.Helper()
+		payloads, err := controller.LeaseTasks("worker-a", 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(payloads) != 1 || payloads[0].TaskId != id {
+			t.Fatalf("Expected to lease %v, got %+v", id, payloads)
+		}
+		if _, err = controller.CompleteTask(id, payloads[0].CompletionToken, WorkerResponse{Output: "done"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, id := range []string{"task194", "task195"} {
+		task := NewTask()
+		task.Id = id
+		task.TaskGroupId = "group21"
+		task.Name = id
+		task.Worker = "worker-a"
+		storage.SaveTask(task, true)
+		controller.Execute(context.Background(), task)
+		if id == "task194" {
+			waitForQueued(id)
+		}
+	}
+
+	// The first task holds the worker's only slot until its worker is done with it
+	time.Sleep(100 * time.Millisecond)
+	if waiting, _ := storage.FindTask("task195"); waiting.Status == TaskStatusRunning {
+		t.Fatal("Expected second task to wait for the throttler while the first is queued")
+	}
+	leaseAndComplete("task194")
+
+	waitForQueued("task195")
+	leaseAndComplete("task195")
+	controller.Pending.Wait()
+}
+
+func TestCancelRunningTask(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	started := make(chan bool)
+	notified := make(chan string, 1)
+	client := &stubTaskClient{
+		post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+			close(started)
+			<-ctx.Done()
+			return WorkerResponse{}, ctx.Err()
+		},
+		cancel: func(ctx context.Context, task *Task) error {
+			notified <- task.Id
+			return nil
+		},
+	}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+
+	task := NewTask()
+	task.Id = "task66"
+	task.TaskGroupId = "group7"
+	task.Name = "task66"
+	task.Worker = "worker-a"
+	task.RemainingAttempts = 3
+	storage.SaveTask(task, true)
+
+	controller.Execute(context.Background(), task)
+	<-started
+	_, err := controller.CancelTask("task66")
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller.Pending.Wait()
+
+	found, _ := storage.FindTask("task66")
+	if found.Status != TaskStatusCanceled {
+		t.Fatalf("Expected %v, got %v", TaskStatusCanceled, found.Status)
+	}
+	if found.BusyExecuting || found.IsComplete {
+		t.Fatal("Expected canceled task to be neither executing nor complete")
+	}
+	if found.RemainingAttempts != 3 {
+		t.Fatalf("Expected cancel not to use an attempt, got %v remaining", found.RemainingAttempts)
+	}
+	if notifiedId := <-notified; notifiedId != "task66" {
+		t.Fatalf("Expected worker to be notified for task66, got %v", notifiedId)
+	}
+	attempts, _ := storage.GetTaskAttempts("task66")
+	if len(attempts) != 1 || attempts[0].Error != "canceled" {
+		t.Fatal("Expected a canceled attempt")
+	}
+}
+
+func TestCancelTaskGroup(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		t.Error("Canceled task should not be executed")
+		return WorkerResponse{}, nil
+	}}
+	controller := NewTaskController(storage, client, nil)
+	controller.Feed = nil
+
+	done := NewTask()
+	done.Id = "task67"
+	done.TaskGroupId = "group8"
+	done.Name = "task67"
+	done.Worker = "worker-a"
+	done.SetStatus(TaskStatusSucceeded)
+	storage.SaveTask(done, true)
+
+	waiting := NewTask()
+	waiting.Id = "task68"
+	waiting.TaskGroupId = "group8"
+	waiting.Name = "task68"
+	waiting.Worker = "worker-a"
+	storage.SaveTask(waiting, true)
+
+	err := controller.CancelTaskGroup("group8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done.Status != TaskStatusSucceeded {
+		t.Fatalf("Expected completed task to be left alone, got %v", done.Status)
+	}
+	if waiting.Status != TaskStatusCanceled {
+		t.Fatalf("Expected %v, got %v", TaskStatusCanceled, waiting.Status)
+	}
+
+	controller.Evaluate(context.Background(), waiting)
+	controller.Pending.Wait()
+	if waiting.Status != TaskStatusCanceled {
+		t.Fatalf("Expected %v, got %v", TaskStatusCanceled, waiting.Status)
+	}
+}
+
+func TestScanReclaimsAbandonedTasks(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	controller := NewTaskController(storage, &stubTaskClient{}, nil)
+	controller.Feed = nil
+	controller.AbandonedCheckTaskPause = 0
+	controller.AbandonedCheckGroupPause = 0
+	dispatcher := &recordingDispatcher{}
+	controller.Dispatcher = dispatcher
+
+	group := NewTaskGroup("group11", "group11")
+	storage.SaveTaskGroup(group, true)
+
+	// Simulate a node that crashed in the middle of executing a task
+	crashed := NewTask()
+	crashed.Id = "task76"
+	crashed.TaskGroupId = "group11"
+	crashed.Name = "task76"
+	crashed.Worker = "worker-a"
+	crashed.RemainingAttempts = 3
+	crashed.SetStatus(TaskStatusScheduled)
+	crashed.SetStatus(TaskStatusRunning)
+	crashed.AcquireLease("dead-node", -time.Minute)
+	storage.SaveTask(crashed, true)
+	storage.SaveAttempt(NewAttempt(crashed, 1))
+
+	// A task that is executing on a live node is left alone
+	live := NewTask()
+	live.Id = "task77"
+	live.TaskGroupId = "group11"
+	live.Name = "task77"
+	live.Worker = "worker-a"
+	live.SetStatus(TaskStatusScheduled)
+	live.SetStatus(TaskStatusRunning)
+	live.AcquireLease("live-node", time.Hour)
+	storage.SaveTask(live, true)
+
+	// A task whose runAfter has passed but nobody picked up
+	due := NewTask()
+	due.Id = "task78"
+	due.TaskGroupId = "group11"
+	due.Name = "task78"
+	due.Worker = "worker-a"
+	due.RunAfter = time.Now().Add(-time.Minute)
+	storage.SaveTask(due, true)
+
+	// A task that isn't due yet
+	future := NewTask()
+	future.Id = "task79"
+	future.TaskGroupId = "group11"
+	future.Name = "task79"
+	future.Worker = "worker-a"
+	future.RunAfter = time.Now().Add(time.Hour)
+	storage.SaveTask(future, true)
+
+	controller.ScanForAbandonedTasks()
+
+	found, _ := storage.FindTask("task76")
+	if found.Status != TaskStatusScheduled || found.BusyExecuting {
+		t.Fatalf("Expected crashed task to be re-queued, got %v (busy %v)", found.Status, found.BusyExecuting)
+	}
+	if found.RemainingAttempts != 2 {
+		t.Fatalf("Expected lost execution to use an attempt, got %v remaining", found.RemainingAttempts)
+	}
+	if len(found.Errors) != 1 || found.LeaseOwner != "" {
+		t.Fatalf("Expected lease to be released with an error, got %v %v", found.Errors, found.LeaseOwner)
+	}
+	attempts, _ := storage.GetTaskAttempts("task76")
+	if attempts[0].EndedAt.IsZero() || attempts[0].Error == "" {
+		t.Fatal("Expected the unfinished attempt to be closed out")
+	}
+
+	found, _ = storage.FindTask("task77")
+	if found.Status != TaskStatusRunning || found.LeaseOwner != "live-node" {
+		t.Fatal("Expected live task to be left alone")
+	}
+
+	expected := map[string]bool{"task76": true, "task78": true}
+	if len(dispatcher.dispatched) != len(expected) {
+		t.Fatalf("Expected %v evaluations, got %v", len(expected), dispatcher.dispatched)
+	}
+	for _, taskId := range dispatcher.dispatched {
+		if !expected[taskId] {
+			t.Fatalf("Unexpected evaluation of %v", taskId)
+		}
+	}
+}
+
+func TestCancelTaskLockedByAnotherInstance(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	controller := NewTaskController(storage, &stubTaskClient{}, nil)
+	controller.Feed = nil
+
+	task := NewTask()
+	task.Id = "task165"
+	task.TaskGroupId = "group11"
+	task.Name = "task165"
+	task.Worker = "worker-a"
+	task.SetStatus(TaskStatusScheduled)
+	task.SetStatus(TaskStatusRunning)
+	storage.SaveTask(task, true)
+
+	// Another instance is executing the task
+	unlocker, _ := storage.TryLockTask("task165")
+	_, err := controller.CancelTask("task165")
+	if !errors.Is(err, ErrTaskLocked) {
+		t.Fatalf("Expected %v, got %v", ErrTaskLocked, err)
+	}
+	unlocker()
+
+	canceled, err := controller.CancelTask("task165")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canceled.Status != TaskStatusCanceled {
+		t.Fatalf("Expected %v, got %v", TaskStatusCanceled, canceled.Status)
+	}
+}
+
+func TestReclaimSkipsLockedTasks(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	controller := NewTaskController(storage, &stubTaskClient{}, nil)
+	controller.Feed = nil
+
+	task := NewTask()
+	task.Id = "task80"
+	task.TaskGroupId = "group11"
+	task.Name = "task80"
+	task.Worker = "worker-a"
+	task.SetStatus(TaskStatusScheduled)
+	task.SetStatus(TaskStatusRunning)
+	task.AcquireLease("slow-node", -time.Minute)
+	storage.SaveTask(task, true)
+
+	// The executing node still holds the task lock
+	unlocker, _ := storage.TryLockTask("task80")
+	reclaimed, _ := controller.ReclaimTask("task80")
+	if reclaimed {
+		t.Fatal("Expected locked task not to be reclaimed")
+	}
+	unlocker()
+
+	reclaimed, err := controller.ReclaimTask("task80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reclaimed {
+		t.Fatal("Expected task to be reclaimed once unlocked")
+	}
+}
@@ -0,0 +1,101 @@
+package crew
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TaskStatus is the lifecycle state of a task.
+type TaskStatus string
+
+const (
+	// TaskStatusPending tasks have not been evaluated yet (new, reset or paused tasks).
+	TaskStatusPending TaskStatus = "pending"
+	// TaskStatusBlocked tasks are waiting on incomplete parents.
+	TaskStatusBlocked TaskStatus = "blocked"
+	// TaskStatusScheduled tasks are waiting for their runAfter time (or a retry) before executing.
+	TaskStatusScheduled TaskStatus = "scheduled"
+	// TaskStatusRunning tasks have been sent to a worker.
+	TaskStatusRunning TaskStatus = "running"
+	// TaskStatusSucceeded tasks completed successfully.
+	TaskStatusSucceeded TaskStatus = "succeeded"
+	// TaskStatusFailed tasks failed permanently or ran out of attempts.
+	TaskStatusFailed TaskStatus = "failed"
+	// TaskStatusCanceled tasks were canceled by a user.
+	TaskStatusCanceled TaskStatus = "canceled"
+	// TaskStatusSkipped tasks were skipped by a user, children treat them as complete.
+	TaskStatusSkipped TaskStatus = "skipped"
+)
+
+// taskStatusTransitions lists the statuses that each status may move to.
+// Only scheduled tasks can start running (see TaskController.Execute), pending and blocked tasks can still succeed
+// without running when a task with the same key completes.
+var taskStatusTransitions = map[TaskStatus][]TaskStatus{
+	TaskStatusPending:   {TaskStatusBlocked, TaskStatusScheduled, TaskStatusSucceeded, TaskStatusFailed, TaskStatusCanceled, TaskStatusSkipped},
+	TaskStatusBlocked:   {TaskStatusPending, TaskStatusScheduled, TaskStatusSucceeded, TaskStatusFailed, TaskStatusCanceled, TaskStatusSkipped},
+	TaskStatusScheduled: {TaskStatusPending, TaskStatusBlocked, TaskStatusRunning, TaskStatusSucceeded, TaskStatusFailed, TaskStatusCanceled, TaskStatusSkipped},
+	TaskStatusRunning:   {TaskStatusPending, TaskStatusScheduled, TaskStatusSucceeded, TaskStatusFailed, TaskStatusCanceled},
+	TaskStatusSucceeded: {TaskStatusPending},
+	TaskStatusFailed:    {TaskStatusPending, TaskStatusScheduled},
+	TaskStatusCanceled:  {TaskStatusPending},
+	TaskStatusSkipped:   {TaskStatusPending},
+}
+
+// userTaskStatuses are the statuses that can be set with a task update.
+var userTaskStatuses = []TaskStatus{TaskStatusPending, TaskStatusCanceled, TaskStatusSkipped}
+
+// ParseTaskStatus converts a string into a TaskStatus.
+func ParseTaskStatus(value string) (status TaskStatus, err error) {
+	status = TaskStatus(value)
+	if _, known := taskStatusTransitions[status]; !known {
+		return "", errors.New("unknown task status: " + value)
+	}
+	return status, nil
+}
+
+// CanTransitionTo returns true if a task may move from this status to next.  Staying in a status is allowed, except for
+// running since running again would start a second attempt.
+func (status TaskStatus) CanTransitionTo(next TaskStatus) bool {
+	if status == next {
+		return status != TaskStatusRunning
+	}
+	for _, allowed := range taskStatusTransitions[status] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUserSettable returns true for statuses that can be set with a task update, the others are managed by crew.
+func (status TaskStatus) IsUserSettable() bool {
+	for _, settable := range userTaskStatuses {
+		if status == settable {
+			return true
+		}
+	}
+	return false
+}
+
+// IsComplete returns true for statuses that satisfy a child's dependency on its parent.
+func (status TaskStatus) IsComplete() bool {
+	return status == TaskStatusSucceeded || status == TaskStatusSkipped
+}
+
+// SetStatus moves a task to a new status, keeping IsComplete, BusyExecuting and the execution lease in sync.
+func (task *Task) SetStatus(next TaskStatus) (err error) {
+	current := task.Status
+	if current == "" {
+		current = TaskStatusPending
+	}
+	if !current.CanTransitionTo(next) {
+		return fmt.Errorf("task %v cannot transition from %v to %v", task.Id, current, next)
+	}
+	task.Status = next
+	task.IsComplete = next.IsComplete()
+	task.BusyExecuting = next == TaskStatusRunning
+	if !task.BusyExecuting {
+		task.ReleaseLease()
+	}
+	return nil
+}
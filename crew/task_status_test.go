@@ -0,0 +1,114 @@
+package crew
+
+import (
+	"testing"
+)
+
+func TestNewTaskIsPending(t *testing.T) {
+	task := NewTask()
+	if task.Status != TaskStatusPending {
+		t.Fatalf(`Status = %v, want %v`, task.Status, TaskStatusPending)
+	}
+}
+
+func TestValidStatusTransitions(t *testing.T) {
+	task := NewTask()
+	task.Id = "task51"
+
+	for _, status := range []TaskStatus{TaskStatusBlocked, TaskStatusScheduled, TaskStatusRunning} {
+		if err := task.SetStatus(status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !task.BusyExecuting {
+		t.Fatal("Expected running task to be busy executing")
+	}
+
+	if err := task.SetStatus(TaskStatusSucceeded); err != nil {
+		t.Fatal(err)
+	}
+	if !task.IsComplete || task.BusyExecuting {
+		t.Fatal("Expected succeeded task to be complete and not busy executing")
+	}
+
+	if err := task.SetStatus(TaskStatusPending); err != nil {
+		t.Fatal(err)
+	}
+	if task.IsComplete {
+		t.Fatal("Expected reset task to be incomplete")
+	}
+}
+
+func TestInvalidStatusTransitions(t *testing.T) {
+	task := NewTask()
+	task.Id = "task52"
+	task.SetStatus(TaskStatusSucceeded)
+
+	if err := task.SetStatus(TaskStatusRunning); err == nil {
+		t.Fatal("Expected succeeded -> running to be rejected")
+	}
+	if task.Status != TaskStatusSucceeded {
+		t.Fatalf(`Status = %v, want %v`, task.Status, TaskStatusSucceeded)
+	}
+
+	task.SetStatus(TaskStatusPending)
+	if err := task.SetStatus(TaskStatusRunning); err == nil {
+		t.Fatal("Expected pending -> running to be rejected")
+	}
+	task.SetStatus(TaskStatusBlocked)
+	if err := task.SetStatus(TaskStatusRunning); err == nil {
+		t.Fatal("Expected blocked -> running to be rejected")
+	}
+
+	task.SetStatus(TaskStatusCanceled)
+	if err := task.SetStatus(TaskStatusScheduled); err == nil {
+		t.Fatal("Expected canceled -> scheduled to be rejected")
+	}
+
+	task.SetStatus(TaskStatusPending)
+	task.SetStatus(TaskStatusScheduled)
+	task.SetStatus(TaskStatusRunning)
+	if err := task.SetStatus(TaskStatusRunning); err == nil {
+		t.Fatal("Expected running -> running to be rejected")
+	}
+}
+
+func TestSkippedTaskSatisfiesChildren(t *testing.T) {
+	parent := NewTask()
+	parent.Id = "task53"
+	parent.SetStatus(TaskStatusSkipped)
+
+	child := NewTask()
+	child.Id = "task54"
+	child.Worker = "worker-a"
+	child.ParentIds = []string{"task53"}
+
+	if !child.CanExecute([]*Task{parent}, nil) {
+		t.Fatal(`CanExecute() = false, want true (parent skipped)`)
+	}
+	if parent.CanExecute(make([]*Task, 0), nil) {
+		t.Fatal(`CanExecute() = true, want false (task skipped)`)
+	}
+}
+
+func TestCannotExecuteIfCanceled(t *testing.T) {
+	task := NewTask()
+	task.Id = "task55"
+	task.Worker = "worker-a"
+	task.SetStatus(TaskStatusCanceled)
+
+	if task.CanExecute(make([]*Task, 0), nil) {
+		t.Fatal(`CanExecute() = true, want false (task canceled)`)
+	}
+}
+
+func TestParseTaskStatus(t *testing.T) {
+	status, err := ParseTaskStatus("failed")
+	if err != nil || status != TaskStatusFailed {
+		t.Fatalf(`ParseTaskStatus("failed") = %v, %v`, status, err)
+	}
+	_, err = ParseTaskStatus("exploded")
+	if err == nil {
+		t.Fatal("Expected unknown status to be rejected")
+	}
+}
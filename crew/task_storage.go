@@ -5,7 +5,10 @@ package crew
 
 import (
 	"errors"
+	"os"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"golang.org/x/sync/semaphore"
@@ -14,7 +17,12 @@ import (
 // TaskStorage defines the methods required for implementing crew's task storage interface.
 type TaskStorage interface {
 	SaveTask(task *Task, create bool) (err error)
+	SaveTasksAtomically(updated []*Task, created []*Task) (err error)
 	FindTask(taskId string) (task *Task, err error)
+	// UpdateTaskIf applies update to a task and saves it, but only while the task still has the given status and
+	// lease token.  ErrTaskChanged is returned and nothing is saved otherwise.  The check and the save are atomic so
+	// that running tasks can be updated without holding their lock.
+	UpdateTaskIf(taskId string, status TaskStatus, leaseToken string, update func(task *Task)) (task *Task, err error)
 	TryLockTask(taskId string) (unlocker func() error, err error)
 	// UnlockTask(taskId string) (err error)
 	DeleteTask(taskId string) (err error)
@@ -22,12 +30,45 @@ type TaskStorage interface {
 	GetTaskParents(taskId string) (tasks []*Task, err error)
 	GetTasksInWorkgroup(workgroup string) (tasks []*Task, err error)
 	GetTasksWithKey(key string) (tasks []*Task, err error)
+	// GetTasksAwaitingLease returns a worker's running tasks that are waiting for the worker to lease them (see PullTaskClient).
+	GetTasksAwaitingLease(worker string) (tasks []*Task, err error)
 
 	SaveTaskGroup(taskGroup *TaskGroup, create bool) (err error)
 	AllTaskGroups() (taskGroups []*TaskGroup, err error)
 	AllTasksInGroup(taskGroupId string) (tasks []*Task, err error)
 	FindTaskGroup(taskGroupId string) (taskGroup *TaskGroup, err error)
 	DeleteTaskGroup(taskGroupId string) (err error)
+
+	SaveAttempt(attempt *Attempt) (err error)
+	GetTaskAttempts(taskId string) (attempts []*Attempt, err error)
+
+	SaveWorkgroup(workgroup *Workgroup) (err error)
+	// FindWorkgroup returns a workgroup with default settings if the workgroup has never been saved.
+	FindWorkgroup(name string) (workgroup *Workgroup, err error)
+	AllWorkgroups() (workgroups []*Workgroup, err error)
+}
+
+// ErrTaskLocked is returned by TryLockTask when the task's lock is held by someone else, such as an execution on another instance.
+var ErrTaskLocked = errors.New("task is locked")
+
+// ErrTaskChanged is returned by UpdateTaskIf when the task's status or lease token no longer match.
+var ErrTaskChanged = errors.New("task was changed")
+
+// lockExpirationFromEnv returns the task lock expiration used by storages that support lock expiry (CREW_TASK_LOCK_EXPIRATION, defaults to 10m).
+func lockExpirationFromEnv() time.Duration {
+	return durationFromEnv("CREW_TASK_LOCK_EXPIRATION", 10*time.Minute)
+}
+
+// durationFromEnv parses an env var with time.ParseDuration, fallback is returned if it is missing or invalid.
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value != "" {
+		parsed, parseErr := time.ParseDuration(value)
+		if parseErr == nil {
+			return parsed
+		}
+	}
+	return fallback
 }
 
 // MemoryTaskStorage is a task storage that only stores state in memory.
@@ -44,6 +85,10 @@ type MemoryTaskStorage struct {
 	idxKeysMutex       sync.RWMutex
 	idxGroups          map[string][]*Task
 	idxGroupsMutex     sync.RWMutex
+	attempts           map[string][]*Attempt
+	attemptsMutex      sync.RWMutex
+	workgroups         map[string]Workgroup
+	workgroupsMutex    sync.RWMutex
 }
 
 // NewMemoryTaskStorage creates a new MemoryTaskStorage.
@@ -55,6 +100,8 @@ func NewMemoryTaskStorage() *MemoryTaskStorage {
 		idxWorkgroups: make(map[string][]*Task),
 		idxKeys:       make(map[string][]*Task),
 		idxGroups:     make(map[string][]*Task),
+		attempts:      make(map[string][]*Attempt),
+		workgroups:    make(map[string]Workgroup),
 	}
 	return &storage
 }
@@ -78,26 +125,69 @@ func (storage *MemoryTaskStorage) SaveTask(task *Task, create bool) (err error)
 	}
 	_, exists := storage.tasks[task.Id]
 	if !exists && create {
-		storage.tasks[task.Id] = task
-		storage.taskLocks[task.Id] = semaphore.NewWeighted(1)
+		storage.insertTask(task)
+	}
+	// Nothing to do for memory storage if already exists
+	return nil
+}
 
-		// Add to indexes
-		if _, idxWorkgroupsExists := storage.idxWorkgroups[task.Workgroup]; !idxWorkgroupsExists {
-			storage.idxWorkgroups[task.Workgroup] = make([]*Task, 0)
-		}
-		storage.idxWorkgroups[task.Workgroup] = append(storage.idxWorkgroups[task.Workgroup], task)
+// insertTask adds a task and its indexes, callers must hold all storage locks.
+func (storage *MemoryTaskStorage) insertTask(task *Task) {
+	storage.tasks[task.Id] = task
+	storage.taskLocks[task.Id] = semaphore.NewWeighted(1)
 
-		if _, idxKeysExists := storage.idxKeys[task.Key]; !idxKeysExists {
-			storage.idxKeys[task.Key] = make([]*Task, 0)
-		}
-		storage.idxKeys[task.Key] = append(storage.idxKeys[task.Key], task)
+	// Add to indexes
+	if _, idxWorkgroupsExists := storage.idxWorkgroups[task.Workgroup]; !idxWorkgroupsExists {
+		storage.idxWorkgroups[task.Workgroup] = make([]*Task, 0)
+	}
+	storage.idxWorkgroups[task.Workgroup] = append(storage.idxWorkgroups[task.Workgroup], task)
+
+	if _, idxKeysExists := storage.idxKeys[task.Key]; !idxKeysExists {
+		storage.idxKeys[task.Key] = make([]*Task, 0)
+	}
+	storage.idxKeys[task.Key] = append(storage.idxKeys[task.Key], task)
+
+	if _, idxGroupsExists := storage.idxGroups[task.TaskGroupId]; !idxGroupsExists {
+		storage.idxGroups[task.TaskGroupId] = make([]*Task, 0)
+	}
+	storage.idxGroups[task.TaskGroupId] = append(storage.idxGroups[task.TaskGroupId], task)
+}
 
-		if _, idxGroupsExists := storage.idxGroups[task.TaskGroupId]; !idxGroupsExists {
-			storage.idxGroups[task.TaskGroupId] = make([]*Task, 0)
+// SaveTasksAtomically saves existing tasks and creates new tasks.  Either every task is saved or none are.
+func (storage *MemoryTaskStorage) SaveTasksAtomically(updated []*Task, created []*Task) (err error) {
+	// We need several locks for this!
+	storage.tasksMutex.Lock()
+	defer storage.tasksMutex.Unlock()
+	storage.idxWorkgroupsMutex.Lock()
+	defer storage.idxWorkgroupsMutex.Unlock()
+	storage.idxKeysMutex.Lock()
+	defer storage.idxKeysMutex.Unlock()
+	storage.idxGroupsMutex.Lock()
+	defer storage.idxGroupsMutex.Unlock()
+	storage.taskLocksMutex.Lock()
+	defer storage.taskLocksMutex.Unlock()
+
+	// Validate everything before changing anything
+	for _, task := range updated {
+		if _, exists := storage.tasks[task.Id]; !exists {
+			return errors.New("task not found: " + task.Id)
 		}
-		storage.idxGroups[task.TaskGroupId] = append(storage.idxGroups[task.TaskGroupId], task)
 	}
-	// Nothing to do for memory storage if already exists
+	createdIds := make(map[string]bool)
+	for _, task := range created {
+		if task.Id == "" {
+			task.Id = uuid.New().String()
+		}
+		if _, exists := storage.tasks[task.Id]; exists || createdIds[task.Id] {
+			return errors.New("task already exists: " + task.Id)
+		}
+		createdIds[task.Id] = true
+	}
+
+	// Nothing to do for memory storage with updated tasks
+	for _, task := range created {
+		storage.insertTask(task)
+	}
 	return nil
 }
 
@@ -112,15 +202,30 @@ func (storage *MemoryTaskStorage) FindTask(taskId string) (task *Task, err error
 	return task, nil
 }
 
+// UpdateTaskIf applies update to a task while it still has the given status and lease token.
+func (storage *MemoryTaskStorage) UpdateTaskIf(taskId string, status TaskStatus, leaseToken string, update func(task *Task)) (task *Task, err error) {
+	storage.tasksMutex.Lock()
+	defer storage.tasksMutex.Unlock()
+	task, found := storage.tasks[taskId]
+	if !found {
+		return nil, errors.New("task not found")
+	}
+	if task.Status != status || task.LeaseToken != leaseToken {
+		return nil, ErrTaskChanged
+	}
+	update(task)
+	return task, nil
+}
+
 func (storage *MemoryTaskStorage) TryLockTask(taskId string) (unlocker func() error, err error) {
 	storage.taskLocksMutex.RLock()
 	defer storage.taskLocksMutex.RUnlock()
 	lock, found := storage.taskLocks[taskId]
 	if !found {
-		err = errors.New("task not found")
+		return nil, errors.New("task not found")
 	}
 	if !lock.TryAcquire(1) {
-		err = errors.New("task is locked")
+		return nil, ErrTaskLocked
 	}
 
 	unlocker = func() error {
@@ -206,6 +311,11 @@ func (storage *MemoryTaskStorage) DeleteTask(taskId string) (err error) {
 
 		// Remove semaphore
 		defer delete(storage.taskLocks, taskId)
+
+		// Remove attempt history
+		storage.attemptsMutex.Lock()
+		delete(storage.attempts, taskId)
+		storage.attemptsMutex.Unlock()
 	}
 	return nil
 }
@@ -317,6 +427,20 @@ func (storage *MemoryTaskStorage) GetTasksWithKey(key string) (tasks []*Task, er
 	return tasks, nil
 }
 
+// GetTasksAwaitingLease returns a worker's running tasks that are waiting for the worker to lease them.
+func (storage *MemoryTaskStorage) GetTasksAwaitingLease(worker string) (tasks []*Task, err error) {
+	storage.tasksMutex.RLock()
+	defer storage.tasksMutex.RUnlock()
+
+	tasks = make([]*Task, 0)
+	for _, task := range storage.tasks {
+		if task.Worker == worker && task.Status == TaskStatusRunning && task.AwaitingLease {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, nil
+}
+
 // DeleteTaskGroup deletes a task group by task group id.
 func (storage *MemoryTaskStorage) DeleteTaskGroup(taskGroupId string) (err error) {
 	// Get all tasks in the group (in own lock)
@@ -343,3 +467,67 @@ func (storage *MemoryTaskStorage) DeleteTaskGroup(taskGroupId string) (err error
 	delete(storage.idxGroups, taskGroupId)
 	return nil
 }
+
+// SaveAttempt saves an attempt, replacing any previously saved attempt with the same id.
+func (storage *MemoryTaskStorage) SaveAttempt(attempt *Attempt) (err error) {
+	storage.attemptsMutex.Lock()
+	defer storage.attemptsMutex.Unlock()
+
+	taskAttempts := storage.attempts[attempt.TaskId]
+	for i, existing := range taskAttempts {
+		if existing.Id == attempt.Id {
+			taskAttempts[i] = attempt
+			return nil
+		}
+	}
+	storage.attempts[attempt.TaskId] = append(taskAttempts, attempt)
+	return nil
+}
+
+// GetTaskAttempts returns a task's attempts, oldest first.
+func (storage *MemoryTaskStorage) GetTaskAttempts(taskId string) (attempts []*Attempt, err error) {
+	storage.attemptsMutex.RLock()
+	defer storage.attemptsMutex.RUnlock()
+
+	attempts = make([]*Attempt, len(storage.attempts[taskId]))
+	copy(attempts, storage.attempts[taskId])
+	return attempts, nil
+}
+
+// SaveWorkgroup saves a workgroup, replacing any previously saved workgroup with the same name.
+func (storage *MemoryTaskStorage) SaveWorkgroup(workgroup *Workgroup) (err error) {
+	storage.workgroupsMutex.Lock()
+	defer storage.workgroupsMutex.Unlock()
+
+	// Workgroups are stored by value so that callers can't change them without saving
+	storage.workgroups[workgroup.Name] = *workgroup
+	return nil
+}
+
+// FindWorkgroup returns a workgroup with default settings if the workgroup has never been saved.
+func (storage *MemoryTaskStorage) FindWorkgroup(name string) (workgroup *Workgroup, err error) {
+	storage.workgroupsMutex.RLock()
+	defer storage.workgroupsMutex.RUnlock()
+
+	saved, found := storage.workgroups[name]
+	if !found {
+		return NewWorkgroup(name), nil
+	}
+	return &saved, nil
+}
+
+// AllWorkgroups returns all saved workgroups, sorted by name.
+func (storage *MemoryTaskStorage) AllWorkgroups() (workgroups []*Workgroup, err error) {
+	storage.workgroupsMutex.RLock()
+	defer storage.workgroupsMutex.RUnlock()
+
+	workgroups = make([]*Workgroup, 0, len(storage.workgroups))
+	for _, saved := range storage.workgroups {
+		workgroup := saved
+		workgroups = append(workgroups, &workgroup)
+	}
+	sort.Slice(workgroups, func(i, j int) bool {
+		return workgroups[i].Name < workgroups[j].Name
+	})
+	return workgroups, nil
+}
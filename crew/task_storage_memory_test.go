@@ -2,6 +2,7 @@ package crew
 
 import (
 	"testing"
+	"time"
 )
 
 func TestCreateTaskGroup(t *testing.T) {
@@ -199,3 +200,158 @@ func TestGetTaskChildrenAndParents(t *testing.T) {
 		t.Fatalf("Expected task8, got %v", task9Parents[0].Id)
 	}
 }
+
+func TestSaveTasksAtomically(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	parent := NewTask()
+	parent.Id = "task29"
+	parent.Name = "task29"
+	parent.Worker = "worker-a"
+	storage.SaveTask(parent, true)
+
+	child1 := NewTask()
+	child1.Id = "task30"
+	child1.Name = "task30"
+	child1.Worker = "worker-a"
+	child1.Workgroup = "group-b"
+	child1.ParentIds = []string{"task29"}
+
+	child2 := NewTask()
+	child2.Id = "task31"
+	child2.Name = "task31"
+	child2.Worker = "worker-a"
+	child2.ParentIds = []string{"task29"}
+
+	parent.IsComplete = true
+	err := storage.SaveTasksAtomically([]*Task{parent}, []*Task{child1, child2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	children, _ := storage.GetTaskChildren("task29")
+	if len(children) != 2 {
+		t.Fatalf("Expected 2 children, got %v", len(children))
+	}
+	found, _ := storage.GetTasksInWorkgroup("group-b")
+	if len(found) != 1 {
+		t.Fatalf("Expected 1 task in workgroup, got %v", len(found))
+	}
+}
+
+func TestSaveTasksAtomicallyPartialFailure(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	parent := NewTask()
+	parent.Id = "task32"
+	parent.Name = "task32"
+	parent.Worker = "worker-a"
+	storage.SaveTask(parent, true)
+
+	existing := NewTask()
+	existing.Id = "task33"
+	existing.Name = "task33"
+	existing.Worker = "worker-a"
+	storage.SaveTask(existing, true)
+
+	child1 := NewTask()
+	child1.Id = "task34"
+	child1.Name = "task34"
+	child1.Worker = "worker-a"
+	child1.Workgroup = "group-c"
+	child1.ParentIds = []string{"task32"}
+
+	// Conflicts with an existing task
+	child2 := NewTask()
+	child2.Id = "task33"
+	child2.Name = "task33 duplicate"
+	child2.Worker = "worker-a"
+	child2.ParentIds = []string{"task32"}
+
+	err := storage.SaveTasksAtomically([]*Task{parent}, []*Task{child1, child2})
+	if err == nil {
+		t.Fatal("Expected duplicate child to fail")
+	}
+
+	_, err = storage.FindTask("task34")
+	if err == nil {
+		t.Fatal("Expected no children to be created")
+	}
+	children, _ := storage.GetTaskChildren("task32")
+	if len(children) != 0 {
+		t.Fatalf("Expected 0 children, got %v", len(children))
+	}
+	found, _ := storage.GetTasksInWorkgroup("group-c")
+	if len(found) != 0 {
+		t.Fatalf("Expected 0 tasks in workgroup, got %v", len(found))
+	}
+
+	// Updating a task that no longer exists fails the whole batch too
+	deleted := NewTask()
+	deleted.Id = "task35"
+	err = storage.SaveTasksAtomically([]*Task{deleted}, []*Task{child1})
+	if err == nil {
+		t.Fatal("Expected missing task update to fail")
+	}
+	_, err = storage.FindTask("task34")
+	if err == nil {
+		t.Fatal("Expected no children to be created")
+	}
+}
+
+func TestTaskAttempts(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	task := NewTask()
+	task.Id = "task63"
+	task.Name = "task63"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+
+	first := NewAttempt(task, 1)
+	storage.SaveAttempt(first)
+	second := NewAttempt(task, 2)
+	storage.SaveAttempt(second)
+
+	// Saving again replaces the attempt
+	first.Error = "oops"
+	storage.SaveAttempt(first)
+
+	attempts, err := storage.GetTaskAttempts("task63")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("Expected 2 attempts, got %v", len(attempts))
+	}
+	if attempts[0].Number != 1 || attempts[0].Error != "oops" || attempts[1].Number != 2 {
+		t.Fatal("Unexpected attempts")
+	}
+
+	storage.DeleteTask("task63")
+	attempts, _ = storage.GetTaskAttempts("task63")
+	if len(attempts) != 0 {
+		t.Fatalf("Expected attempts to be deleted with task, got %v", len(attempts))
+	}
+}
+
+func TestWorkgroups(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+
+	workgroup, _ := storage.FindWorkgroup("api-key-f")
+	if workgroup.Name != "api-key-f" || !workgroup.IsAvailable(time.Now()) {
+		t.Fatalf("Expected default workgroup, got %+v", workgroup)
+	}
+
+	workgroup.Delay(time.Minute)
+	storage.SaveWorkgroup(workgroup)
+
+	// Changes aren't visible until saved
+	workgroup.IsPaused = true
+	found, _ := storage.FindWorkgroup("api-key-f")
+	if found.IsPaused || found.IsAvailable(time.Now()) {
+		t.Fatalf("Expected saved workgroup to be delayed but not paused, got %+v", found)
+	}
+
+	workgroups, _ := storage.AllWorkgroups()
+	if len(workgroups) != 1 || workgroups[0].Name != "api-key-f" {
+		t.Fatalf("Unexpected workgroups %+v", workgroups)
+	}
+}
@@ -0,0 +1,488 @@
+package crew
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestSqlTaskStorage(t *testing.T) *SqlTaskStorage {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "crew.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	storage, err := NewSqlTaskStorage(db, SqlDialectSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func TestSqlCreateTaskGroup(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	taskGroup := NewTaskGroup("group1", "group1")
+
+	storage.SaveTaskGroup(taskGroup, true)
+	found, err := storage.FindTaskGroup("group1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Id != "group1" {
+		t.Fatal("TaskGroup not found")
+	}
+}
+
+func TestSqlUpdateTaskGroup(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	taskGroup := NewTaskGroup("group2", "group2")
+	storage.SaveTaskGroup(taskGroup, true)
+
+	taskGroup.Name = "group2 edited"
+	storage.SaveTaskGroup(taskGroup, false)
+
+	found, err := storage.FindTaskGroup("group2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Name != "group2 edited" {
+		t.Fatalf("TaskGroup update failed, exepected 'group2 edited', got %v", found.Name)
+	}
+}
+
+func TestSqlDeleteTaskGroup(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	taskGroup := NewTaskGroup("group3", "group3")
+	storage.SaveTaskGroup(taskGroup, true)
+
+	storage.DeleteTaskGroup("group3")
+
+	_, err := storage.FindTaskGroup("group3")
+	if err == nil {
+		t.Fatal("TaskGroup not deleted")
+	}
+}
+
+func TestSqlCreateTask(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	task := NewTask()
+	task.Id = "task1"
+	task.Name = "task1"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+
+	found, err := storage.FindTask("task1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Id != "task1" {
+		t.Fatal("TaskGroup not found")
+	}
+}
+
+func TestSqlUpdateTask(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	task := NewTask()
+	task.Id = "task2"
+	task.Name = "task2"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+
+	task.Name = "task2 edited"
+	storage.SaveTask(task, false)
+
+	found, err := storage.FindTask("task2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Name != "task2 edited" {
+		t.Fatalf("Task update failed, exepected 'task2 edited', got %v", found.Name)
+	}
+}
+
+func TestSqlDeleteTask(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	task := NewTask()
+	task.Id = "task3"
+	task.Name = "task3"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+
+	storage.DeleteTask("task3")
+
+	_, err := storage.FindTask("task3")
+	if err == nil {
+		t.Fatal("Task not deleted")
+	}
+}
+
+func TestSqlFindTasksByWorkgroup(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	task4 := NewTask()
+	task4.Id = "task4"
+	task4.Name = "task4"
+	task4.Worker = "worker-a"
+	task4.Workgroup = "group-a"
+	storage.SaveTask(task4, true)
+
+	task5 := NewTask()
+	task5.Id = "task5"
+	task5.Name = "task5"
+	task5.Worker = "worker-a"
+	task5.Workgroup = "group-a"
+	storage.SaveTask(task5, true)
+
+	found, _ := storage.GetTasksInWorkgroup("group-a")
+	if len(found) != 2 {
+		t.Fatalf("Expected 2 tasks, got %v", len(found))
+	}
+
+	storage.DeleteTask("task4")
+
+	found, _ = storage.GetTasksInWorkgroup("group-a")
+	if len(found) != 1 {
+		t.Fatalf("Expected 1 task, got %v", len(found))
+	}
+}
+
+func TestSqlFindTasksWithKey(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	task6 := NewTask()
+	task6.Id = "task6"
+	task6.Name = "task6"
+	task6.Worker = "worker-a"
+	task6.Workgroup = "group-a"
+	task6.Key = "key-a"
+	storage.SaveTask(task6, true)
+
+	task7 := NewTask()
+	task7.Id = "task7"
+	task7.Name = "task7"
+	task7.Worker = "worker-a"
+	task7.Workgroup = "group-a"
+	task7.Key = "key-a"
+	storage.SaveTask(task7, true)
+
+	found, _ := storage.GetTasksWithKey("key-a")
+	if len(found) != 2 {
+		t.Fatalf("Expected 2 tasks, got %v", len(found))
+	}
+
+	storage.DeleteTask("task6")
+
+	found, _ = storage.GetTasksWithKey("key-a")
+	if len(found) != 1 {
+		t.Fatalf("Expected 1 task, got %v", len(found))
+	}
+}
+
+func TestSqlGetTaskChildrenAndParents(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	task8 := NewTask()
+	task8.Id = "task8"
+	task8.Name = "task8"
+	task8.Worker = "worker-a"
+	storage.SaveTask(task8, true)
+
+	task9 := NewTask()
+	task9.Id = "task9"
+	task9.Name = "task9"
+	task9.Worker = "worker-a"
+	task9.ParentIds = []string{"task8"}
+	storage.SaveTask(task9, true)
+
+	task10 := NewTask()
+	task10.Id = "task10"
+	task10.Name = "task10"
+	task10.Worker = "worker-a"
+	task10.ParentIds = []string{"task8"}
+	storage.SaveTask(task10, true)
+
+	task8Children, _ := storage.GetTaskChildren("task8")
+	if len(task8Children) != 2 {
+		t.Fatalf("Expected 2 children, got %v", len(task8Children))
+	}
+	if task8Children[0].Id != "task9" {
+		t.Fatalf("Expected task9, got %v", task8Children[0].Id)
+	}
+
+	task9Parents, _ := storage.GetTaskParents("task9")
+	if len(task9Parents) != 1 {
+		t.Fatalf("Expected 1 parent, got %v", len(task9Parents))
+	}
+	if task9Parents[0].Id != "task8" {
+		t.Fatalf("Expected task8, got %v", task9Parents[0].Id)
+	}
+}
+
+func TestSqlTaskLock(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	task := NewTask()
+	task.Id = "task24"
+	task.Name = "task24"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+
+	unlocker, err := storage.TryLockTask("task24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.TryLockTask("task24")
+	if err == nil {
+		t.Fatal("Expected second lock to fail")
+	}
+
+	// Saving a task must not clear its lock
+	task.Name = "task24 edited"
+	storage.SaveTask(task, false)
+	_, err = storage.TryLockTask("task24")
+	if err == nil {
+		t.Fatal("Expected lock to survive save")
+	}
+
+	unlocker()
+	unlocker, err = storage.TryLockTask("task24")
+	if err != nil {
+		t.Fatal("Expected lock to succeed after unlock", err)
+	}
+	unlocker()
+
+	_, err = storage.TryLockTask("missing-task")
+	if err == nil {
+		t.Fatal("Expected lock of missing task to fail")
+	}
+}
+
+func TestSqlTaskLockExpires(t *testing.T) {
+	t.Setenv("CREW_TASK_LOCK_EXPIRATION", "-1s")
+	storage := newTestSqlTaskStorage(t)
+	task := NewTask()
+	task.Id = "task25"
+	task.Name = "task25"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+
+	_, err := storage.TryLockTask("task25")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lease is already expired, a crashed lock holder should not block others
+	_, err = storage.TryLockTask("task25")
+	if err != nil {
+		t.Fatal("Expected expired lock to be reclaimed", err)
+	}
+}
+
+func TestSqlSaveDeletedTask(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	task := NewTask()
+	task.Id = "task26"
+	task.Name = "task26"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+	storage.DeleteTask("task26")
+
+	err := storage.SaveTask(task, false)
+	if err == nil {
+		t.Fatal("Expected save of deleted task to fail")
+	}
+	_, err = storage.FindTask("task26")
+	if err == nil {
+		t.Fatal("Deleted task was re-created")
+	}
+}
+
+func TestSqlDeleteTaskGroupDeletesTasks(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	taskGroup := NewTaskGroup("group4", "group4")
+	storage.SaveTaskGroup(taskGroup, true)
+
+	task := NewTask()
+	task.Id = "task27"
+	task.TaskGroupId = "group4"
+	task.Name = "task27"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+
+	child := NewTask()
+	child.Id = "task28"
+	child.TaskGroupId = "group4"
+	child.Name = "task28"
+	child.Worker = "worker-a"
+	child.ParentIds = []string{"task27"}
+	storage.SaveTask(child, true)
+
+	found, _ := storage.AllTasksInGroup("group4")
+	if len(found) != 2 {
+		t.Fatalf("Expected 2 tasks, got %v", len(found))
+	}
+
+	storage.DeleteTaskGroup("group4")
+
+	found, _ = storage.AllTasksInGroup("group4")
+	if len(found) != 0 {
+		t.Fatalf("Expected 0 tasks, got %v", len(found))
+	}
+	groups, _ := storage.AllTaskGroups()
+	if len(groups) != 0 {
+		t.Fatalf("Expected 0 task groups, got %v", len(groups))
+	}
+}
+
+func TestSqlSaveTasksAtomicallyPartialFailure(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	parent := NewTask()
+	parent.Id = "task36"
+	parent.Name = "task36"
+	parent.Worker = "worker-a"
+	storage.SaveTask(parent, true)
+
+	existing := NewTask()
+	existing.Id = "task37"
+	existing.Name = "task37"
+	existing.Worker = "worker-a"
+	storage.SaveTask(existing, true)
+
+	child1 := NewTask()
+	child1.Id = "task38"
+	child1.Name = "task38"
+	child1.Worker = "worker-a"
+	child1.ParentIds = []string{"task36"}
+
+	// Conflicts with an existing task
+	child2 := NewTask()
+	child2.Id = "task37"
+	child2.Name = "task37 duplicate"
+	child2.Worker = "worker-a"
+	child2.ParentIds = []string{"task36"}
+
+	parent.IsComplete = true
+	err := storage.SaveTasksAtomically([]*Task{parent}, []*Task{child1, child2})
+	if err == nil {
+		t.Fatal("Expected duplicate child to fail")
+	}
+
+	// Neither the parent's completion nor any child should have been written
+	found, _ := storage.FindTask("task36")
+	if found.IsComplete {
+		t.Fatal("Expected parent completion to be rolled back")
+	}
+	children, _ := storage.GetTaskChildren("task36")
+	if len(children) != 0 {
+		t.Fatalf("Expected 0 children, got %v", len(children))
+	}
+
+	err = storage.SaveTasksAtomically([]*Task{parent}, []*Task{child1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, _ = storage.FindTask("task36")
+	if !found.IsComplete {
+		t.Fatal("Expected parent to be complete")
+	}
+	children, _ = storage.GetTaskChildren("task36")
+	if len(children) != 1 {
+		t.Fatalf("Expected 1 child, got %v", len(children))
+	}
+}
+
+func TestSqlTaskAttempts(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	task := NewTask()
+	task.Id = "task64"
+	task.TaskGroupId = "group6"
+	task.Name = "task64"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+
+	second := NewAttempt(task, 2)
+	storage.SaveAttempt(second)
+	first := NewAttempt(task, 1)
+	storage.SaveAttempt(first)
+
+	// Saving again replaces the attempt
+	first.Error = "oops"
+	err := storage.SaveAttempt(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attempts, err := storage.GetTaskAttempts("task64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("Expected 2 attempts, got %v", len(attempts))
+	}
+	if attempts[0].Number != 1 || attempts[0].Error != "oops" || attempts[1].Number != 2 {
+		t.Fatal("Unexpected attempts")
+	}
+
+	storage.DeleteTaskGroup("group6")
+	attempts, _ = storage.GetTaskAttempts("task64")
+	if len(attempts) != 0 {
+		t.Fatalf("Expected attempts to be deleted with task, got %v", len(attempts))
+	}
+}
+
+func TestSqlWorkgroups(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+
+	// Workgroups that were never saved have default settings
+	workgroup, err := storage.FindWorkgroup("api-key-e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workgroup.Name != "api-key-e" || workgroup.IsPaused || workgroup.MaxConcurrency != 0 {
+		t.Fatalf("Expected default workgroup, got %+v", workgroup)
+	}
+
+	workgroup.IsPaused = true
+	workgroup.MaxConcurrency = 3
+	storage.SaveWorkgroup(workgroup)
+	// Saving again replaces the workgroup
+	workgroup.MaxConcurrency = 4
+	err = storage.SaveWorkgroup(workgroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.SaveWorkgroup(NewWorkgroup("api-key-a"))
+
+	found, _ := storage.FindWorkgroup("api-key-e")
+	if !found.IsPaused || found.MaxConcurrency != 4 {
+		t.Fatalf("Unexpected workgroup %+v", found)
+	}
+	workgroups, err := storage.AllWorkgroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(workgroups) != 2 || workgroups[0].Name != "api-key-a" || workgroups[1].Name != "api-key-e" {
+		t.Fatalf("Unexpected workgroups %+v", workgroups)
+	}
+}
+
+func TestSqlLeaseTokenIsStored(t *testing.T) {
+	storage := newTestSqlTaskStorage(t)
+	task := NewTask()
+	task.Id = "task181"
+	task.Name = "task181"
+	task.Worker = "worker-a"
+	task.SetStatus(TaskStatusScheduled)
+	task.SetStatus(TaskStatusRunning)
+	task.AcquireLease("node-a", time.Minute)
+	storage.SaveTask(task, true)
+
+	found, err := storage.FindTask("task181")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.LeaseToken == "" || found.LeaseToken != task.LeaseToken {
+		t.Fatalf("Expected lease token to be stored, got %q", found.LeaseToken)
+	}
+}
@@ -1,7 +1,10 @@
 package crew
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCanExecute(t *testing.T) {
@@ -11,7 +14,7 @@ func TestCanExecute(t *testing.T) {
 	task.Worker = "worker-a"
 	parents := make([]*Task, 0)
 
-	canExecute := task.CanExecute(parents)
+	canExecute := task.CanExecute(parents, nil)
 	if !canExecute {
 		t.Fatalf(`CanExecute() = false, want true`)
 	}
@@ -25,7 +28,7 @@ func TestCannotExecuteIfTaskIsPaused(t *testing.T) {
 	task.IsPaused = true
 	parents := make([]*Task, 0)
 
-	canExecute := task.CanExecute(parents)
+	canExecute := task.CanExecute(parents, nil)
 	if canExecute {
 		t.Fatalf(`CanExecute() = true, want false (task is paused)`)
 	}
@@ -49,7 +52,7 @@ func TestCannotExecuteIfParentsIncomplete(t *testing.T) {
 	parents := make([]*Task, 0)
 	parents = append(parents, task)
 
-	canExecute := child.CanExecute(parents)
+	canExecute := child.CanExecute(parents, nil)
 	if canExecute {
 		t.Fatalf(`CanExecute() = true, want false (parent not complete)`)
 	}
@@ -73,8 +76,63 @@ func TestCanExecuteIfParentsComplete(t *testing.T) {
 	parents := make([]*Task, 0)
 	parents = append(parents, task)
 
-	canExecute := child.CanExecute(parents)
+	canExecute := child.CanExecute(parents, nil)
 	if !canExecute {
 		t.Fatalf(`CanExecute() = false, want true (parents are complete)`)
 	}
 }
+
+func TestTaskLease(t *testing.T) {
+	task := NewTask()
+	task.Id = "task75"
+	task.Name = "task75"
+	task.Worker = "worker-a"
+
+	if task.LeaseExpired(time.Now()) {
+		t.Fatal("Expected tasks that aren't executing to never have an expired lease")
+	}
+
+	task.SetStatus(TaskStatusScheduled)
+	task.SetStatus(TaskStatusRunning)
+	task.AcquireLease("node-a", time.Minute)
+	if task.LeaseOwner != "node-a" || task.LeaseToken == "" {
+		t.Fatal("Expected lease to be recorded")
+	}
+	if task.LeaseExpired(time.Now()) {
+		t.Fatal("Expected lease to be live")
+	}
+	if !task.LeaseExpired(time.Now().Add(2 * time.Minute)) {
+		t.Fatal("Expected lease to expire")
+	}
+
+	task.SetStatus(TaskStatusSucceeded)
+	if task.LeaseOwner != "" || !task.LeaseExpiresAt.IsZero() {
+		t.Fatal("Expected lease to be released when the task stops running")
+	}
+}
+
+func TestLeaseTokenIsOnlyStored(t *testing.T) {
+	task := NewTask()
+	task.Id = "task180"
+	task.SetStatus(TaskStatusScheduled)
+	task.SetStatus(TaskStatusRunning)
+	task.AcquireLease("node-a", time.Minute)
+
+	// Api responses and feed events don't give the token away
+	apiJson, _ := json.Marshal(task)
+	if strings.Contains(string(apiJson), task.LeaseToken) {
+		t.Fatalf("Expected lease token to be left out of %s", apiJson)
+	}
+
+	storedJson, err := marshalStoredTask(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := unmarshalStoredTask(storedJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.LeaseToken != task.LeaseToken || stored.Id != "task180" || stored.Status != TaskStatusRunning {
+		t.Fatalf("Expected stored task to keep its lease, got %+v", stored)
+	}
+}
@@ -0,0 +1,277 @@
+package crew
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultConcurrencyLimitKey is the key in a concurrency limits map that applies to workers/workgroups that aren't listed.
+const DefaultConcurrencyLimitKey = "*"
+
+// NewUnlimitedThrottler creates a throttler that lets every task execute immediately.
+func NewUnlimitedThrottler() *Throttler {
+	throttler := &Throttler{
+		Push: make(chan ThrottlePushQuery, 8),
+		Pop:  make(chan ThrottlePopQuery, 8),
+	}
+	go func() {
+		for {
+			select {
+			case pushQuery := <-throttler.Push:
+				pushQuery.Resp <- true
+			case <-throttler.Pop:
+			}
+		}
+	}()
+	return throttler
+}
+
+// NewWorkerThrottler creates a throttler that limits how many tasks execute at once for each worker.
+// Workers that aren't in limits use limits["*"], a limit of 0 (or no limit at all) means unlimited.
+func NewWorkerThrottler(limits map[string]int) *Throttler {
+	return NewConcurrencyThrottler(func(taskId string, worker string, workgroup string) string {
+		return worker
+	}, limitLookup(limits))
+}
+
+// NewWorkgroupThrottler creates a throttler that limits how many tasks execute at once for each workgroup.
+// Workgroups that aren't in limits use limits["*"], a limit of 0 (or no limit at all) means unlimited.
+// Tasks without a workgroup are not throttled.
+func NewWorkgroupThrottler(limits map[string]int) *Throttler {
+	lookup := limitLookup(limits)
+	return NewConcurrencyThrottler(func(taskId string, worker string, workgroup string) string {
+		return workgroup
+	}, func(key string) int {
+		if key == "" {
+			return 0
+		}
+		return lookup(key)
+	})
+}
+
+// NewGlobalThrottler creates a throttler that limits how many tasks execute at once across all workers.
+func NewGlobalThrottler(limit int) *Throttler {
+	return NewConcurrencyThrottler(func(taskId string, worker string, workgroup string) string {
+		return ""
+	}, func(key string) int {
+		return limit
+	})
+}
+
+// NewConcurrencyThrottler creates a throttler that groups tasks with keyFor and lets at most limitFor(key) tasks
+// in each group execute at once (0 = unlimited).  Tasks that have to wait are released highest priority first, then
+// in the order they arrived.
+func NewConcurrencyThrottler(keyFor func(taskId string, worker string, workgroup string) string, limitFor func(key string) int) *Throttler {
+	throttler := &Throttler{
+		Push: make(chan ThrottlePushQuery, 8),
+		Pop:  make(chan ThrottlePopQuery, 8),
+	}
+
+	go func() {
+		executing := make(map[string]map[string]bool)
+		pending := make(map[string][]ThrottlePushQuery)
+
+		for {
+			select {
+			case pushQuery := <-throttler.Push:
+				key := keyFor(pushQuery.TaskId, pushQuery.Worker, pushQuery.Workgroup)
+				limit := limitFor(key)
+				if limit <= 0 || (len(executing[key]) < limit && len(pending[key]) == 0) {
+					if executing[key] == nil {
+						executing[key] = make(map[string]bool)
+					}
+					executing[key][pushQuery.TaskId] = true
+					pushQuery.Resp <- true
+				} else {
+					pending[key] = enqueueByPriority(pending[key], pushQuery)
+				}
+
+			case popQuery := <-throttler.Pop:
+				key := keyFor(popQuery.TaskId, popQuery.Worker, popQuery.Workgroup)
+
+				// Tasks that gave up while waiting (canceled or deleted) are removed from the queue
+				queue := pending[key]
+				for i, queued := range queue {
+					if queued.TaskId == popQuery.TaskId {
+						queue = append(queue[:i:i], queue[i+1:]...)
+						break
+					}
+				}
+
+				delete(executing[key], popQuery.TaskId)
+
+				// Let waiting tasks run in queue order, which is highest priority first (see enqueueByPriority)
+				limit := limitFor(key)
+				for len(queue) > 0 && (limit <= 0 || len(executing[key]) < limit) {
+					next := queue[0]
+					queue = queue[1:]
+					if executing[key] == nil {
+						executing[key] = make(map[string]bool)
+					}
+					executing[key][next.TaskId] = true
+					next.Resp <- true
+				}
+
+				if len(queue) == 0 {
+					delete(pending, key)
+				} else {
+					pending[key] = queue
+				}
+				if len(executing[key]) == 0 {
+					delete(executing, key)
+				}
+			}
+		}
+	}()
+
+	return throttler
+}
+
+// ChainThrottlers combines throttlers so that a task only executes once every one of them allows it, for example
+// a concurrency limit and a rate limit.  Throttlers are asked in order.
+func ChainThrottlers(throttlers ...*Throttler) *Throttler {
+	if len(throttlers) == 0 {
+		return NewUnlimitedThrottler()
+	}
+
+	chain := &Throttler{
+		Push: make(chan ThrottlePushQuery, 8),
+		Pop:  make(chan ThrottlePopQuery, 8),
+	}
+
+	// Tasks still working their way through the chain, closed if the task gives up while waiting
+	waiting := make(map[string]chan bool)
+	waitingMutex := &sync.Mutex{}
+
+	go func() {
+		for {
+			select {
+			case pushQuery := <-chain.Push:
+				giveUp := make(chan bool)
+				waitingMutex.Lock()
+				waiting[pushQuery.TaskId] = giveUp
+				waitingMutex.Unlock()
+
+				// Ask the first throttler here so that tasks reach it in the order they arrived
+				popQuery := ThrottlePopQuery{
+					TaskId:    pushQuery.TaskId,
+					Worker:    pushQuery.Worker,
+					Workgroup: pushQuery.Workgroup}
+				push := func(throttler *Throttler) chan bool {
+					resp := make(chan bool, 1)
+					throttler.Push <- ThrottlePushQuery{
+						TaskId:    pushQuery.TaskId,
+						Worker:    pushQuery.Worker,
+						Workgroup: pushQuery.Workgroup,
+						Priority:  pushQuery.Priority,
+						Resp:      resp}
+					return resp
+				}
+				resp := push(throttlers[0])
+
+				go func(pushQuery ThrottlePushQuery) {
+					for i := range throttlers {
+						if i > 0 {
+							resp = push(throttlers[i])
+						}
+						select {
+						case <-resp:
+						case <-giveUp:
+							// Let go of the throttlers that already allowed the task and the one it is waiting on
+							for _, acquired := range throttlers[:i+1] {
+								acquired.Pop <- popQuery
+							}
+							return
+						}
+					}
+
+					waitingMutex.Lock()
+					_, stillWaiting := waiting[pushQuery.TaskId]
+					delete(waiting, pushQuery.TaskId)
+					waitingMutex.Unlock()
+					if !stillWaiting {
+						// Gave up just as the last throttler allowed it
+						for _, acquired := range throttlers {
+							acquired.Pop <- popQuery
+						}
+						return
+					}
+					pushQuery.Resp <- true
+				}(pushQuery)
+
+			case popQuery := <-chain.Pop:
+				waitingMutex.Lock()
+				giveUp, isWaiting := waiting[popQuery.TaskId]
+				delete(waiting, popQuery.TaskId)
+				waitingMutex.Unlock()
+				if isWaiting {
+					close(giveUp)
+				} else {
+					for _, throttler := range throttlers {
+						throttler.Pop <- popQuery
+					}
+				}
+			}
+		}
+	}()
+
+	return chain
+}
+
+// enqueueByPriority adds a query to a throttler's queue behind every query with the same or higher priority.
+func enqueueByPriority(queue []ThrottlePushQuery, query ThrottlePushQuery) []ThrottlePushQuery {
+	position := len(queue)
+	for position > 0 && queue[position-1].Priority < query.Priority {
+		position--
+	}
+	queue = append(queue, ThrottlePushQuery{})
+	copy(queue[position+1:], queue[position:])
+	queue[position] = query
+	return queue
+}
+
+// limitLookup returns a function that finds the limit for a key, falling back to the "*" entry.
+func limitLookup(limits map[string]int) func(key string) int {
+	return func(key string) int {
+		if limit, found := limits[key]; found {
+			return limit
+		}
+		return limits[DefaultConcurrencyLimitKey]
+	}
+}
+
+// ParseConcurrencyLimits parses limits in the form "worker-a=3,worker-b=2,*=1".
+func ParseConcurrencyLimits(value string) (limits map[string]int, err error) {
+	limits = make(map[string]int)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, errors.New("invalid concurrency limit: " + entry)
+		}
+		limit, parseErr := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if parseErr != nil || limit < 0 {
+			return nil, errors.New("invalid concurrency limit: " + entry)
+		}
+		limits[strings.TrimSpace(parts[0])] = limit
+	}
+	return limits, nil
+}
+
+// ConcurrencyLimitsFromEnv parses the concurrency limits in an env var (see ParseConcurrencyLimits).
+// Invalid values are logged and ignored.
+func ConcurrencyLimitsFromEnv(name string) map[string]int {
+	limits, err := ParseConcurrencyLimits(os.Getenv(name))
+	if err != nil {
+		log.Println("Ignoring "+name, err)
+		return make(map[string]int)
+	}
+	return limits
+}
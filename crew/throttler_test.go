@@ -0,0 +1,208 @@
+package crew
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func pushThrottle(throttler *Throttler, taskId string, worker string, workgroup string) ThrottlePushQuery {
+	query := ThrottlePushQuery{
+		TaskId:    taskId,
+		Worker:    worker,
+		Workgroup: workgroup,
+		Resp:      make(chan bool, 1)}
+	throttler.Push <- query
+	return query
+}
+
+func popThrottle(throttler *Throttler, taskId string, worker string, workgroup string) {
+	throttler.Pop <- ThrottlePopQuery{
+		TaskId:    taskId,
+		Worker:    worker,
+		Workgroup: workgroup}
+}
+
+func expectGranted(t *testing.T, query ThrottlePushQuery) {
+	t.Helper()
+	select {
+	case <-query.Resp:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected %v to be allowed to run", query.TaskId)
+	}
+}
+
+func expectWaiting(t *testing.T, query ThrottlePushQuery) {
+	t.Helper()
+	select {
+	case <-query.Resp:
+		t.Fatalf("Expected %v to wait", query.TaskId)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestUnlimitedThrottler(t *testing.T) {
+	throttler := NewUnlimitedThrottler()
+	for _, taskId := range []string{"task81", "task82", "task83"} {
+		expectGranted(t, pushThrottle(throttler, taskId, "worker-a", ""))
+	}
+}
+
+func TestWorkerThrottler(t *testing.T) {
+	throttler := NewWorkerThrottler(map[string]int{"worker-a": 1})
+
+	first := pushThrottle(throttler, "task84", "worker-a", "")
+	second := pushThrottle(throttler, "task85", "worker-a", "")
+	third := pushThrottle(throttler, "task86", "worker-a", "")
+	other := pushThrottle(throttler, "task87", "worker-b", "")
+	expectGranted(t, first)
+	expectWaiting(t, second)
+	expectGranted(t, other)
+
+	// Waiting tasks with the same priority run in the order they arrived
+	popThrottle(throttler, "task84", "worker-a", "")
+	expectGranted(t, second)
+	expectWaiting(t, third)
+
+	// A task that gives up while waiting is removed from the queue
+	popThrottle(throttler, "task86", "worker-a", "")
+	popThrottle(throttler, "task85", "worker-a", "")
+	expectWaiting(t, third)
+	expectGranted(t, pushThrottle(throttler, "task88", "worker-a", ""))
+}
+
+func TestWorkerThrottlerDefaultLimit(t *testing.T) {
+	throttler := NewWorkerThrottler(map[string]int{"worker-a": 2, DefaultConcurrencyLimitKey: 1})
+
+	expectGranted(t, pushThrottle(throttler, "task89", "worker-a", ""))
+	expectGranted(t, pushThrottle(throttler, "task90", "worker-a", ""))
+	expectGranted(t, pushThrottle(throttler, "task91", "worker-b", ""))
+	expectWaiting(t, pushThrottle(throttler, "task92", "worker-b", ""))
+}
+
+func TestWorkgroupThrottler(t *testing.T) {
+	throttler := NewWorkgroupThrottler(map[string]int{DefaultConcurrencyLimitKey: 1})
+
+	first := pushThrottle(throttler, "task93", "worker-a", "group-a")
+	second := pushThrottle(throttler, "task94", "worker-b", "group-a")
+	expectGranted(t, first)
+	expectWaiting(t, second)
+	expectGranted(t, pushThrottle(throttler, "task95", "worker-a", "group-b"))
+
+	// Tasks without a workgroup are not throttled
+	expectGranted(t, pushThrottle(throttler, "task96", "worker-a", ""))
+	expectGranted(t, pushThrottle(throttler, "task97", "worker-a", ""))
+
+	popThrottle(throttler, "task93", "worker-a", "group-a")
+	expectGranted(t, second)
+}
+
+func TestGlobalThrottler(t *testing.T) {
+	throttler := NewGlobalThrottler(2)
+
+	expectGranted(t, pushThrottle(throttler, "task98", "worker-a", ""))
+	expectGranted(t, pushThrottle(throttler, "task99", "worker-b", ""))
+	third := pushThrottle(throttler, "task100", "worker-c", "")
+	expectWaiting(t, third)
+
+	popThrottle(throttler, "task99", "worker-b", "")
+	expectGranted(t, third)
+}
+
+func TestParseConcurrencyLimits(t *testing.T) {
+	limits, err := ParseConcurrencyLimits("worker-a=3, worker-b=2,*=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits["worker-a"] != 3 || limits["worker-b"] != 2 || limits[DefaultConcurrencyLimitKey] != 1 {
+		t.Fatalf("Unexpected limits %v", limits)
+	}
+
+	limits, err = ParseConcurrencyLimits("")
+	if err != nil || len(limits) != 0 {
+		t.Fatalf("Expected no limits, got %v %v", limits, err)
+	}
+
+	for _, invalid := range []string{"worker-a", "worker-a=x", "=3", "worker-a=-1"} {
+		_, err = ParseConcurrencyLimits(invalid)
+		if err == nil {
+			t.Fatalf("Expected %v to be invalid", invalid)
+		}
+	}
+}
+
+func TestCanceledTaskLeavesThrottlerQueue(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	throttler := NewWorkerThrottler(map[string]int{"worker-a": 1})
+	client := &stubTaskClient{post: func(ctx context.Context, task *Task, parents []*Task) (WorkerResponse, error) {
+		t.Error("Queued task should not be executed")
+		return WorkerResponse{}, nil
+	}}
+	controller := NewTaskController(storage, client, throttler)
+	controller.Feed = nil
+
+	// Occupy the only slot
+	busy := pushThrottle(throttler, "task101", "worker-a", "")
+	expectGranted(t, busy)
+
+	task := NewTask()
+	task.Id = "task102"
+	task.TaskGroupId = "group12"
+	task.Name = "task102"
+	task.Worker = "worker-a"
+	storage.SaveTask(task, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	controller.Execute(ctx, task)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	controller.Pending.Wait()
+
+	if task.Status != TaskStatusCanceled {
+		t.Fatalf("Expected %v, got %v", TaskStatusCanceled, task.Status)
+	}
+
+	// The canceled task must not take the slot when it frees up
+	popThrottle(throttler, "task101", "worker-a", "")
+	expectGranted(t, pushThrottle(throttler, "task103", "worker-a", ""))
+}
+
+func TestThrottlerServesHigherPriorityFirst(t *testing.T) {
+	throttler := NewWorkerThrottler(map[string]int{"worker-a": 1})
+
+	running := pushThrottle(throttler, "task131", "worker-a", "")
+	expectGranted(t, running)
+
+	backfill := ThrottlePushQuery{TaskId: "task132", Worker: "worker-a", Resp: make(chan bool, 1)}
+	throttler.Push <- backfill
+	urgent := ThrottlePushQuery{TaskId: "task133", Worker: "worker-a", Priority: 10, Resp: make(chan bool, 1)}
+	throttler.Push <- urgent
+	expectWaiting(t, backfill)
+	expectWaiting(t, urgent)
+
+	popThrottle(throttler, "task131", "worker-a", "")
+	expectGranted(t, urgent)
+	expectWaiting(t, backfill)
+	popThrottle(throttler, "task133", "worker-a", "")
+	expectGranted(t, backfill)
+}
+
+func TestEnqueueByPriority(t *testing.T) {
+	queue := make([]ThrottlePushQuery, 0)
+	for _, query := range []ThrottlePushQuery{
+		{TaskId: "a", Priority: 0},
+		{TaskId: "b", Priority: 5},
+		{TaskId: "c", Priority: 0},
+		{TaskId: "d", Priority: 5},
+		{TaskId: "e", Priority: -1},
+	} {
+		queue = enqueueByPriority(queue, query)
+	}
+	order := ""
+	for _, query := range queue {
+		order += query.TaskId
+	}
+	if order != "bdace" {
+		t.Fatalf("Expected queue order bdace, got %v", order)
+	}
+}
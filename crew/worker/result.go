@@ -0,0 +1,102 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/aaronblondeau/crew-go/crew"
+	"github.com/google/uuid"
+)
+
+// Result is what a handler returns, it becomes the worker's response.
+type Result struct {
+	Output interface{}
+	// Children are created when the task succeeds, see DAG.
+	Children []*crew.ChildTask
+	// WorkgroupDelay keeps the rest of the task's workgroup from starting for a while (rounded up to whole seconds).
+	WorkgroupDelay time.Duration
+	// ChildrenDelay delays the task's children (rounded up to whole seconds).
+	ChildrenDelay time.Duration
+}
+
+func (result Result) response() crew.WorkerResponse {
+	return crew.WorkerResponse{
+		Output:                  result.Output,
+		Children:                result.Children,
+		WorkgroupDelayInSeconds: seconds(result.WorkgroupDelay),
+		ChildrenDelayInSeconds:  seconds(result.ChildrenDelay),
+	}
+}
+
+// DAG builds child tasks that depend on each other.  Children always start after the current task is complete.
+type DAG struct {
+	children []*crew.ChildTask
+}
+
+// Add adds a child task for a worker that starts once the after children are complete.
+// The returned child can be modified (name, workgroup, etc) before the result is returned.
+func (dag *DAG) Add(worker string, input interface{}, after ...*crew.ChildTask) *crew.ChildTask {
+	child := &crew.ChildTask{
+		Id:        uuid.New().String(),
+		Name:      worker,
+		Worker:    worker,
+		Input:     input,
+		ParentIds: make([]string, 0, len(after)),
+	}
+	for _, parent := range after {
+		child.ParentIds = append(child.ParentIds, parent.Id)
+	}
+	dag.children = append(dag.children, child)
+	return child
+}
+
+// Children returns the children that have been added.
+func (dag *DAG) Children() []*crew.ChildTask {
+	return dag.children
+}
+
+// permanentError marks an error that should fail the task without retrying it.
+type permanentError struct {
+	err error
+}
+
+func (err *permanentError) Error() string {
+	return err.err.Error()
+}
+
+func (err *permanentError) Unwrap() error {
+	return err.err
+}
+
+// Permanent wraps an error so that crew fails the task instead of retrying it (invalid input for example).
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// retryAfterError asks crew to back off.
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (err *retryAfterError) Error() string {
+	return err.err.Error()
+}
+
+func (err *retryAfterError) Unwrap() error {
+	return err.err
+}
+
+// RetryAfter wraps an error (typically a rate limit from an api) so that crew retries the task after delay without
+// using up an attempt, and delays the rest of the task's workgroup as well.  delay is rounded up to whole seconds
+// and is at least one second.
+func RetryAfter(err error, delay time.Duration) error {
+	if delay < time.Second {
+		delay = time.Second
+	}
+	return &retryAfterError{err: err, delay: delay}
+}
+
+// seconds rounds a duration up to whole seconds.
+func seconds(duration time.Duration) int {
+	return int((duration + time.Second - 1) / time.Second)
+}
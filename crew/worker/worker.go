@@ -0,0 +1,223 @@
+// Package worker takes care of the plumbing for crew workers written in Go: decoding the worker payload,
+// checking CREW_WORKER_AUTHORIZATION_HEADER (and CREW_WORKER_SIGNING_SECRET signatures) and building the worker response.
+//
+//	worker.Handle("resize", func(ctx context.Context, in ResizeInput, parents []worker.Parent) (worker.Result, error) {
+//		...
+//		return worker.Result{Output: resized}, nil
+//	})
+//	http.ListenAndServe(":8091", worker.DefaultRegistry)
+//
+// Handlers are picked by the payload's worker name, so the registry can be mounted on any path (crew posts to
+// CREW_WORKER_BASE_URL + worker name).
+package worker
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aaronblondeau/crew-go/crew"
+	"github.com/labstack/echo/v4"
+)
+
+// Parent is the result of one of the task's parents.
+type Parent struct {
+	TaskId string          `json:"taskId"`
+	Worker string          `json:"worker"`
+	Input  json.RawMessage `json:"input"`
+	Output json.RawMessage `json:"output"`
+}
+
+// DecodeOutput decodes the parent's output into v.
+func (parent Parent) DecodeOutput(v interface{}) error {
+	return json.Unmarshal(parent.Output, v)
+}
+
+// Task identifies the task that a handler is working on, see TaskFromContext.
+type Task struct {
+	Id     string
+	Worker string
+	// CompletionToken authorizes heartbeats (and async completions) for this attempt.
+	CompletionToken string
+}
+
+type taskContextKey struct{}
+
+// TaskFromContext returns the task that is being handled.
+func TaskFromContext(ctx context.Context) (task Task, ok bool) {
+	task, ok = ctx.Value(taskContextKey{}).(Task)
+	return task, ok
+}
+
+// payload is crew.WorkerPayload with the input left raw so that it can be decoded into each handler's type.
+type payload struct {
+	Input           json.RawMessage `json:"input"`
+	Worker          string          `json:"worker"`
+	Parents         []Parent        `json:"parents"`
+	TaskId          string          `json:"taskId"`
+	CompletionToken string          `json:"completionToken"`
+}
+
+type handlerFunc func(ctx context.Context, task payload) (Result, error)
+
+// Registry routes tasks to handlers by worker name.
+type Registry struct {
+	// Authorization must match each request's Authorization header.  When empty CREW_WORKER_AUTHORIZATION_HEADER
+	// (which crew sends with every worker call) is used, requests aren't checked if neither is set.
+	Authorization string
+	// SigningSecrets verify the signature crew adds to each call (see crew.SignRequest).  When empty
+	// CREW_WORKER_SIGNING_SECRET is used, signatures aren't checked if neither is set.
+	SigningSecrets []string
+	// SignatureWindow is how far a signature's timestamp can be from now (defaults to crew.DefaultSignatureWindow).
+	SignatureWindow time.Duration
+	handlers        map[string]handlerFunc
+	mutex           sync.RWMutex
+}
+
+// NewRegistry creates a new Registry.
+func NewRegistry() *Registry {
+	registry := Registry{
+		handlers: make(map[string]handlerFunc),
+	}
+	return &registry
+}
+
+// DefaultRegistry is the registry used by Handle.
+var DefaultRegistry = NewRegistry()
+
+// Register adds a handler for a worker to a registry.  The task's input is decoded into In, input that can't be
+// decoded fails the task without retrying it.
+func Register[In any](registry *Registry, name string, handler func(ctx context.Context, input In, parents []Parent) (Result, error)) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.handlers[name] = func(ctx context.Context, task payload) (Result, error) {
+		var input In
+		if len(task.Input) > 0 {
+			if err := json.Unmarshal(task.Input, &input); err != nil {
+				return Result{}, Permanent(fmt.Errorf("invalid input: %w", err))
+			}
+		}
+		return handler(ctx, input, task.Parents)
+	}
+}
+
+// Handle adds a handler for a worker to DefaultRegistry.
+func Handle[In any](name string, handler func(ctx context.Context, input In, parents []Parent) (Result, error)) {
+	Register(DefaultRegistry, name, handler)
+}
+
+// ServeHTTP handles a worker call from crew.
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, crew.WorkerResponse{Error: "method not allowed"})
+		return
+	}
+
+	authorization := registry.Authorization
+	if authorization == "" {
+		authorization = os.Getenv("CREW_WORKER_AUTHORIZATION_HEADER")
+	}
+	if authorization != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(authorization)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, crew.WorkerResponse{Error: "unauthorized"})
+		return
+	}
+
+	body, readErr := io.ReadAll(r.Body)
+	if readErr != nil {
+		writeJSON(w, http.StatusBadRequest, crew.WorkerResponse{Error: readErr.Error()})
+		return
+	}
+	signedTaskId, verifyErr := registry.verify(r.Header, body)
+	if verifyErr != nil {
+		writeJSON(w, http.StatusUnauthorized, crew.WorkerResponse{Error: verifyErr.Error()})
+		return
+	}
+
+	task := payload{}
+	if err := json.Unmarshal(body, &task); err != nil {
+		writeError(w, Permanent(fmt.Errorf("invalid payload: %w", err)))
+		return
+	}
+	if signedTaskId != nil && *signedTaskId != task.TaskId {
+		writeJSON(w, http.StatusUnauthorized, crew.WorkerResponse{Error: crew.ErrInvalidSignature.Error()})
+		return
+	}
+
+	registry.mutex.RLock()
+	handler, found := registry.handlers[task.Worker]
+	registry.mutex.RUnlock()
+	if !found {
+		writeJSON(w, http.StatusNotFound, crew.WorkerResponse{Error: "unknown worker: " + task.Worker})
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), taskContextKey{}, Task{
+		Id:              task.TaskId,
+		Worker:          task.Worker,
+		CompletionToken: task.CompletionToken,
+	})
+	result, err := handler(ctx, task)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result.response())
+}
+
+// verify checks a call's signature and returns the task id that was signed, which is nil when signatures aren't checked.
+func (registry *Registry) verify(header http.Header, body []byte) (*string, error) {
+	secrets := registry.SigningSecrets
+	if len(secrets) == 0 {
+		secrets = crew.SigningSecretsFromEnv("CREW_WORKER_SIGNING_SECRET")
+	}
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+	window := registry.SignatureWindow
+	if window == 0 {
+		window = crew.DefaultSignatureWindow
+	}
+	taskId, err := crew.VerifySignature(header, body, time.Now(), window, secrets...)
+	if err != nil {
+		return nil, err
+	}
+	return &taskId, nil
+}
+
+// EchoHandler adapts the registry for use as an echo route, for example e.POST("/workers/:worker", registry.EchoHandler()).
+func (registry *Registry) EchoHandler() echo.HandlerFunc {
+	return echo.WrapHandler(registry)
+}
+
+// writeError responds with the status code that tells crew how to treat err.
+func writeError(w http.ResponseWriter, err error) {
+	response := crew.WorkerResponse{Error: err.Error()}
+
+	var permanentErr *permanentError
+	var retryAfterErr *retryAfterError
+	switch {
+	case errors.As(err, &permanentErr):
+		retryable := false
+		response.Retryable = &retryable
+		writeJSON(w, http.StatusBadRequest, response)
+	case errors.As(err, &retryAfterErr):
+		w.Header().Set("Retry-After", strconv.Itoa(seconds(retryAfterErr.delay)))
+		writeJSON(w, http.StatusTooManyRequests, response)
+	default:
+		writeJSON(w, http.StatusInternalServerError, response)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, response crew.WorkerResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,181 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aaronblondeau/crew-go/crew"
+)
+
+type resizeInput struct {
+	Url   string `json:"url"`
+	Width int    `json:"width"`
+}
+
+func newTestServer(t *testing.T) (*httptest.Server, *crew.HttpPostClient) {
+	registry := NewRegistry()
+	registry.Authorization = "secret"
+	Register(registry, "resize", func(ctx context.Context, input resizeInput, parents []Parent) (Result, error) {
+		task, _ := TaskFromContext(ctx)
+		if input.Width <= 0 {
+			return Result{}, Permanent(errors.New("width must be > 0"))
+		}
+		if input.Width > 1000 {
+			return Result{}, RetryAfter(errors.New("too big for now"), 1500*time.Millisecond)
+		}
+		parentOutput := ""
+		if len(parents) > 0 {
+			parents[0].DecodeOutput(&parentOutput)
+		}
+
+		dag := DAG{}
+		upload := dag.Add("upload", map[string]interface{}{"url": input.Url})
+		dag.Add("notify", nil, upload)
+		return Result{
+			Output:        map[string]interface{}{"width": input.Width, "taskId": task.Id, "parent": parentOutput},
+			Children:      dag.Children(),
+			ChildrenDelay: 2 * time.Second,
+		}, nil
+	})
+	Register(registry, "fail", func(ctx context.Context, input interface{}, parents []Parent) (Result, error) {
+		return Result{}, errors.New("oops")
+	})
+	server := httptest.NewServer(registry)
+
+	// Workers are called just like crew calls them
+	client := crew.NewHttpPostClient()
+	client.UrlForTask = func(task *crew.Task) (url string, err error) {
+		return server.URL + "/" + task.Worker, nil
+	}
+	t.Setenv("CREW_WORKER_AUTHORIZATION_HEADER", "secret")
+	return server, client
+}
+
+func TestHandle(t *testing.T) {
+	server, client := newTestServer(t)
+	defer server.Close()
+
+	parent := crew.NewTask()
+	parent.Id = "parent"
+	parent.Worker = "download"
+	parent.Output = "downloaded"
+
+	task := crew.NewTask()
+	task.Id = "resize-1"
+	task.Worker = "resize"
+	task.Input = map[string]interface{}{"url": "http://example.com/a.png", "width": 100}
+
+	response, err := client.Post(context.Background(), task, []*crew.Task{parent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := response.Output.(map[string]interface{})
+	if output["width"] != float64(100) || output["taskId"] != "resize-1" || output["parent"] != "downloaded" {
+		t.Fatalf("Unexpected output %v", output)
+	}
+	if len(response.Children) != 2 || response.ChildrenDelayInSeconds != 2 {
+		t.Fatalf("Unexpected children %+v", response)
+	}
+	if response.Children[1].ParentIds[0] != response.Children[0].Id || response.Children[1].Worker != "notify" {
+		t.Fatalf("Expected notify to depend on upload, got %+v", response.Children[1])
+	}
+}
+
+func TestHandleErrors(t *testing.T) {
+	server, client := newTestServer(t)
+	defer server.Close()
+
+	task := crew.NewTask()
+	task.Id = "resize-2"
+	task.Worker = "resize"
+	task.Input = map[string]interface{}{"width": 0}
+	_, err := client.Post(context.Background(), task, nil)
+	if err == nil || crew.IsRetryableError(err) {
+		t.Fatalf("Expected a permanent error, got %v", err)
+	}
+
+	// Input that doesn't decode is permanent too
+	task.Input = map[string]interface{}{"width": "wide"}
+	_, err = client.Post(context.Background(), task, nil)
+	if err == nil || crew.IsRetryableError(err) || !strings.Contains(err.Error(), "invalid input") {
+		t.Fatalf("Expected a permanent input error, got %v", err)
+	}
+
+	task.Input = map[string]interface{}{"width": 2000}
+	_, err = client.Post(context.Background(), task, nil)
+	rateLimitErr, ok := err.(*crew.RateLimitError)
+	if !ok || rateLimitErr.RetryAfter != 2*time.Second {
+		t.Fatalf("Expected a rate limit error, got %v", err)
+	}
+
+	task.Worker = "fail"
+	_, err = client.Post(context.Background(), task, nil)
+	if err == nil || !crew.IsRetryableError(err) {
+		t.Fatalf("Expected a retryable error, got %v", err)
+	}
+
+	task.Worker = "missing"
+	_, err = client.Post(context.Background(), task, nil)
+	workerErr, ok := err.(*crew.WorkerError)
+	if !ok || workerErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected unknown worker to be rejected, got %v", err)
+	}
+
+	t.Setenv("CREW_WORKER_AUTHORIZATION_HEADER", "wrong")
+	task.Worker = "resize"
+	_, err = client.Post(context.Background(), task, nil)
+	workerErr, ok = err.(*crew.WorkerError)
+	if !ok || workerErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected unauthorized call to be rejected, got %v", err)
+	}
+}
+
+func TestRetryAfterMinimum(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeError(recorder, RetryAfter(errors.New("rate limited"), 0))
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Expected a one second Retry-After, got %v %v", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+}
+
+func TestHandleSignatures(t *testing.T) {
+	server, client := newTestServer(t)
+	defer server.Close()
+	t.Setenv("CREW_WORKER_SIGNING_SECRET", "signing-secret")
+	client.SigningSecret = "signing-secret"
+
+	task := crew.NewTask()
+	task.Id = "resize-3"
+	task.Worker = "resize"
+	task.Input = map[string]interface{}{"width": 100}
+	if _, err := client.Post(context.Background(), task, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	client.SigningSecret = ""
+	_, err := client.Post(context.Background(), task, nil)
+	workerErr, ok := err.(*crew.WorkerError)
+	if !ok || workerErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected unsigned call to be rejected, got %v", err)
+	}
+
+	// A signature made for another task is rejected even though it matches the body
+	body := []byte(`{"worker":"resize","taskId":"resize-3","input":{"width":100}}`)
+	req, _ := http.NewRequest("POST", server.URL, bytes.NewReader(body))
+	req.Header.Set("Authorization", "secret")
+	crew.SignRequest(req, "signing-secret", "resize-4", body)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected signature for another task to be rejected, got %v", resp.StatusCode)
+	}
+}
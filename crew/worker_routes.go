@@ -0,0 +1,261 @@
+package crew
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WorkerRoute tells HttpPostClient how to reach the workers whose name matches Worker.
+type WorkerRoute struct {
+	// Worker is a worker name or a glob pattern such as "video-*" (see path.Match).
+	Worker string `json:"worker"`
+	// Url is where tasks are posted, "{worker}" is replaced with the task's worker.
+	Url string `json:"url"`
+	// Headers are added to every call, "${NAME}" is replaced with the NAME environment variable so secrets can stay out of the file.
+	Headers map[string]string `json:"headers"`
+	// SendDefaultAuthorization adds CREW_WORKER_AUTHORIZATION_HEADER to calls to these workers, which it is not by default.
+	SendDefaultAuthorization bool `json:"sendDefaultAuthorization"`
+	// TimeoutInSeconds limits calls to these workers on top of the task's own timeout (0 = no extra limit).
+	TimeoutInSeconds int             `json:"timeoutInSeconds"`
+	TLS              *WorkerRouteTLS `json:"tls"`
+	// SigningSecret replaces HttpPostClient.SigningSecret for these workers, "${NAME}" is read from the environment.
+	SigningSecret string `json:"signingSecret"`
+
+	httpClient *http.Client
+}
+
+// WorkerRouteTLS holds the tls settings used to call a route's workers.
+type WorkerRouteTLS struct {
+	// CAFile is a pem file of certificate authorities that are trusted in addition to the system's.
+	CAFile string `json:"caFile"`
+	// CertFile and KeyFile are the client certificate presented to workers that require mutual tls.
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
+	ServerName         string `json:"serverName"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+// UrlFor returns the url that tasks for the given worker are posted to.
+func (route *WorkerRoute) UrlFor(worker string) string {
+	return strings.ReplaceAll(route.Url, "{worker}", worker)
+}
+
+// Timeout returns the route's TimeoutInSeconds as a duration.
+func (route *WorkerRoute) Timeout() time.Duration {
+	return time.Duration(route.TimeoutInSeconds) * time.Second
+}
+
+// HttpClient returns the client used to call the route's workers.
+func (route *WorkerRoute) HttpClient() *http.Client {
+	if route.httpClient == nil {
+		return &http.Client{}
+	}
+	return route.httpClient
+}
+
+// UnknownWorkerError is returned when a task names a worker that no route matches.
+type UnknownWorkerError struct {
+	Worker string
+	Path   string
+}
+
+func (err *UnknownWorkerError) Error() string {
+	return fmt.Sprintf("Unknown worker %q, no route in %v matches it", err.Worker, err.Path)
+}
+
+// WorkerRoutes is a routing table, loaded from a json file, that maps worker names to urls, headers, timeouts and tls settings.
+// Workers are matched against routes with an exact name first and then against patterns in the order they appear in the file.
+type WorkerRoutes struct {
+	Path        string
+	routes      []*WorkerRoute
+	modTime     time.Time
+	mutex       sync.RWMutex
+	reloadMutex sync.Mutex
+}
+
+// workerRoutesFile defines the schema of a routes file.
+type workerRoutesFile struct {
+	Routes []*WorkerRoute `json:"routes"`
+}
+
+// LoadWorkerRoutes reads a routing table from a json file.
+func LoadWorkerRoutes(path string) (*WorkerRoutes, error) {
+	routes := &WorkerRoutes{
+		Path: path,
+	}
+	if err := routes.Reload(); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// Reload re-reads the routes file.  The current routes are kept when the file can't be read or is invalid.
+func (routes *WorkerRoutes) Reload() error {
+	routes.reloadMutex.Lock()
+	defer routes.reloadMutex.Unlock()
+
+	info, statErr := os.Stat(routes.Path)
+	if statErr != nil {
+		return statErr
+	}
+	data, readErr := os.ReadFile(routes.Path)
+	if readErr != nil {
+		return readErr
+	}
+	loaded, parseErr := parseWorkerRoutes(data)
+	if parseErr != nil {
+		return fmt.Errorf("Invalid worker routes in %v: %w", routes.Path, parseErr)
+	}
+
+	routes.mutex.Lock()
+	previous := routes.routes
+	routes.routes = loaded
+	routes.modTime = info.ModTime()
+	routes.mutex.Unlock()
+
+	// Let go of connections made with the old settings, calls that are in flight are not affected
+	for _, route := range previous {
+		if route.httpClient != nil {
+			route.httpClient.CloseIdleConnections()
+		}
+	}
+	return nil
+}
+
+// Watch reloads the routes whenever the file changes, checking every interval until ctx is canceled.
+func (routes *WorkerRoutes) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(routes.Path)
+			if err != nil {
+				log.Println("Error checking worker routes", routes.Path, err)
+				continue
+			}
+			routes.mutex.RLock()
+			changed := !info.ModTime().Equal(routes.modTime)
+			routes.mutex.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := routes.Reload(); err != nil {
+				log.Println("Error reloading worker routes, keeping the previous routes", err)
+				continue
+			}
+			log.Println("Reloaded worker routes from", routes.Path)
+		}
+	}
+}
+
+// Find returns the route for a worker, or an UnknownWorkerError when no route matches it.
+func (routes *WorkerRoutes) Find(worker string) (*WorkerRoute, error) {
+	routes.mutex.RLock()
+	defer routes.mutex.RUnlock()
+
+	for _, route := range routes.routes {
+		if route.Worker == worker {
+			return route, nil
+		}
+	}
+	for _, route := range routes.routes {
+		// Patterns are validated when the routes are loaded
+		if matched, _ := path.Match(route.Worker, worker); matched {
+			return route, nil
+		}
+	}
+	return nil, &UnknownWorkerError{Worker: worker, Path: routes.Path}
+}
+
+var routeEnvPattern = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// expandRouteEnv replaces "${NAME}" with the NAME environment variable.
+func expandRouteEnv(value string) string {
+	return routeEnvPattern.ReplaceAllStringFunc(value, func(match string) string {
+		return os.Getenv(routeEnvPattern.FindStringSubmatch(match)[1])
+	})
+}
+
+// parseWorkerRoutes parses and validates the contents of a routes file.
+func parseWorkerRoutes(data []byte) ([]*WorkerRoute, error) {
+	file := workerRoutesFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for i, route := range file.Routes {
+		if route == nil || route.Worker == "" {
+			return nil, fmt.Errorf("route %d has no worker", i)
+		}
+		if _, err := path.Match(route.Worker, ""); err != nil {
+			return nil, fmt.Errorf("route %v has an invalid pattern: %w", route.Worker, err)
+		}
+		if route.Url == "" {
+			return nil, fmt.Errorf("route %v has no url", route.Worker)
+		}
+		if route.TimeoutInSeconds < 0 {
+			return nil, fmt.Errorf("route %v has a negative timeoutInSeconds", route.Worker)
+		}
+		for name, value := range route.Headers {
+			route.Headers[name] = expandRouteEnv(value)
+		}
+		route.SigningSecret = expandRouteEnv(route.SigningSecret)
+		if route.TLS != nil {
+			tlsConfig, err := route.TLS.config()
+			if err != nil {
+				return nil, fmt.Errorf("route %v: %w", route.Worker, err)
+			}
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = tlsConfig
+			route.httpClient = &http.Client{Transport: transport}
+		}
+	}
+	return file.Routes, nil
+}
+
+// config builds a tls.Config from the route's tls settings.
+func (settings *WorkerRouteTLS) config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         settings.ServerName,
+		InsecureSkipVerify: settings.InsecureSkipVerify,
+	}
+	if settings.CAFile != "" {
+		pem, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", settings.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if settings.CertFile != "" || settings.KeyFile != "" {
+		if settings.CertFile == "" || settings.KeyFile == "" {
+			return nil, errors.New("certFile and keyFile must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
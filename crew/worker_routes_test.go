@@ -0,0 +1,242 @@
+package crew
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeRoutesFile(t *testing.T, path string, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkerRoutes(t *testing.T) {
+	t.Setenv("CREW_TEST_ROUTE_TOKEN", "secret")
+	path := filepath.Join(t.TempDir(), "routes.json")
+	writeRoutesFile(t, path, `{"routes": [
+		{"worker": "video-*", "url": "https://video.example.com/{worker}", "timeoutInSeconds": 30},
+		{"worker": "video-thumbnail", "url": "https://images.example.com/thumbnail", "headers": {"Authorization": "Bearer ${CREW_TEST_ROUTE_TOKEN}"}, "signingSecret": "${CREW_TEST_ROUTE_TOKEN}"}
+	]}`)
+
+	routes, err := LoadWorkerRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Exact names win over patterns that come before them
+	route, err := routes.Find("video-thumbnail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.UrlFor("video-thumbnail") != "https://images.example.com/thumbnail" {
+		t.Fatalf("Expected the exact route, got %v", route.Url)
+	}
+	if route.Headers["Authorization"] != "Bearer secret" {
+		t.Fatalf("Expected header to be read from the environment, got %v", route.Headers["Authorization"])
+	}
+	if route.SigningSecret != "secret" {
+		t.Fatalf("Expected signing secret to be read from the environment, got %v", route.SigningSecret)
+	}
+
+	route, err = routes.Find("video-transcode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.UrlFor("video-transcode") != "https://video.example.com/video-transcode" || route.Timeout() != 30*time.Second {
+		t.Fatalf("Unexpected route %+v", route)
+	}
+
+	_, err = routes.Find("resize")
+	var unknownErr *UnknownWorkerError
+	if !errors.As(err, &unknownErr) || unknownErr.Worker != "resize" {
+		t.Fatalf("Expected an UnknownWorkerError, got %v", err)
+	}
+
+	// Reloading picks up new routes
+	writeRoutesFile(t, path, `{"routes": [{"worker": "*", "url": "https://workers.example.com/{worker}"}]}`)
+	if err := routes.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	route, err = routes.Find("resize")
+	if err != nil || route.UrlFor("resize") != "https://workers.example.com/resize" {
+		t.Fatalf("Expected reloaded route, got %+v %v", route, err)
+	}
+
+	// An invalid file is rejected and the previous routes are kept
+	writeRoutesFile(t, path, `{"routes": [{"worker": "[", "url": "https://workers.example.com/{worker}"}]}`)
+	if err := routes.Reload(); err == nil {
+		t.Fatal("Expected invalid pattern to be rejected")
+	}
+	writeRoutesFile(t, path, `{"routes": [{"worker": "resize"}]}`)
+	if err := routes.Reload(); err == nil {
+		t.Fatal("Expected route without a url to be rejected")
+	}
+	if _, err := routes.Find("resize"); err != nil {
+		t.Fatalf("Expected previous routes to be kept, got %v", err)
+	}
+}
+
+func TestWorkerRoutesWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	writeRoutesFile(t, path, `{"routes": [{"worker": "worker-a", "url": "https://a.example.com"}]}`)
+	routes, err := LoadWorkerRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go routes.Watch(ctx, 10*time.Millisecond)
+
+	writeRoutesFile(t, path, `{"routes": [{"worker": "worker-b", "url": "https://b.example.com"}]}`)
+	// Make sure the change is seen even on file systems with coarse modification times
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := routes.Find("worker-b"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected routes to be reloaded when the file changed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRoutedHttpPostClient(t *testing.T) {
+	t.Setenv("CREW_WORKER_AUTHORIZATION_HEADER", "global")
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/workers/resize" {
+			t.Errorf("Expected to request '/workers/resize', got: %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "images-key" || r.Header.Get("X-Region") != "eu" {
+			t.Errorf("Expected route headers, got %v", r.Header)
+		}
+		w.Write([]byte(`{"output":"resized"}`))
+	}))
+	defer images.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "global" {
+			t.Errorf("Expected global authorization header for a route that opts in, got %v", r.Header.Get("Authorization"))
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	thirdParty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("Expected global authorization header not to be sent to a route, got %v", r.Header.Get("Authorization"))
+		}
+		w.Write([]byte(`{"output":"ok"}`))
+	}))
+	defer thirdParty.Close()
+
+	path := filepath.Join(t.TempDir(), "routes.json")
+	writeRoutesFile(t, path, `{"routes": [
+		{"worker": "resize", "url": "`+images.URL+`/workers/{worker}", "headers": {"Authorization": "images-key", "X-Region": "eu"}},
+		{"worker": "slow-*", "url": "`+slow.URL+`/{worker}", "timeoutInSeconds": 1, "sendDefaultAuthorization": true},
+		{"worker": "geocode", "url": "`+thirdParty.URL+`/{worker}"}
+	]}`)
+	routes, err := LoadWorkerRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewHttpPostClient()
+	client.Routes = routes
+
+	task := NewTask()
+	task.Id = "task152"
+	task.Worker = "resize"
+	response, err := client.Post(context.Background(), task, []*Task{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Output != "resized" || response.WorkerUrl != images.URL+"/workers/resize" {
+		t.Fatalf("Unexpected response %+v", response)
+	}
+
+	// Routes can time out sooner than the task
+	task.Id = "task153"
+	task.Worker = "slow-worker"
+	_, err = client.Post(context.Background(), task, []*Task{})
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Timeout != time.Second {
+		t.Fatalf("Expected a route timeout, got %v", err)
+	}
+
+	// The global authorization header stays with the default workers
+	task.Id = "task196"
+	task.Worker = "geocode"
+	response, err = client.Post(context.Background(), task, []*Task{})
+	if err != nil || response.Output != "ok" {
+		t.Fatalf("Unexpected response %+v %v", response, err)
+	}
+
+	// Unknown workers fail without being retried
+	task.Id = "task154"
+	task.Worker = "missing"
+	_, err = client.Post(context.Background(), task, []*Task{})
+	if err == nil || IsRetryableError(err) {
+		t.Fatalf("Expected a permanent error for an unknown worker, got %v", err)
+	}
+}
+
+func TestRoutedHttpPostClientTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"output":"secure"}`))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "routes.json")
+	writeRoutesFile(t, path, `{"routes": [
+		{"worker": "trusted", "url": "`+server.URL+`/{worker}", "tls": {"caFile": "`+filepath.ToSlash(caFile)+`"}},
+		{"worker": "untrusted", "url": "`+server.URL+`/{worker}"}
+	]}`)
+	routes, err := LoadWorkerRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewHttpPostClient()
+	client.Routes = routes
+
+	task := NewTask()
+	task.Id = "task155"
+	task.Worker = "trusted"
+	response, err := client.Post(context.Background(), task, []*Task{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Output != "secure" {
+		t.Fatalf("Unexpected response %+v", response)
+	}
+
+	task.Worker = "untrusted"
+	if _, err := client.Post(context.Background(), task, []*Task{}); err == nil {
+		t.Fatal("Expected the server's certificate to be rejected without its ca")
+	}
+
+	writeRoutesFile(t, path, `{"routes": [{"worker": "trusted", "url": "https://example.com", "tls": {"certFile": "cert.pem"}}]}`)
+	if err := routes.Reload(); err == nil {
+		t.Fatal("Expected certFile without keyFile to be rejected")
+	}
+}
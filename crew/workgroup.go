@@ -0,0 +1,111 @@
+package crew
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Workgroup holds state shared by all the tasks in a workgroup (typically the tasks that use the same api key).
+// Only workgroups that have been delayed, paused or configured are stored, every other workgroup uses the defaults.
+type Workgroup struct {
+	Name string `json:"name"`
+	// PausedUntil is set by workgroupDelayInSeconds / Retry-After responses, tasks in the workgroup don't start before it.
+	PausedUntil time.Time `json:"pausedUntil"`
+	// IsPaused stops tasks in the workgroup from starting until the workgroup is resumed.
+	IsPaused bool `json:"isPaused"`
+	// MaxConcurrency limits how many tasks in the workgroup execute at once (0 = unlimited).
+	MaxConcurrency int `json:"maxConcurrency"`
+	// RateLimit allows this many task starts per RateLimitIntervalInSeconds (0 = unlimited).
+	RateLimit                  int       `json:"rateLimit"`
+	RateLimitIntervalInSeconds int       `json:"rateLimitIntervalInSeconds"`
+	RateLimitBurst             int       `json:"rateLimitBurst"`
+	UpdatedAt                  time.Time `json:"updatedAt"`
+}
+
+// NewWorkgroup creates a new Workgroup with default settings.
+func NewWorkgroup(name string) *Workgroup {
+	workgroup := Workgroup{
+		Name: name,
+	}
+	return &workgroup
+}
+
+// IsAvailable returns true if tasks in the workgroup are allowed to start at the given time.
+func (workgroup *Workgroup) IsAvailable(now time.Time) bool {
+	return !workgroup.IsPaused && !workgroup.PausedUntil.After(now)
+}
+
+// Delay pauses the workgroup until now + delay, an existing longer delay is kept.
+func (workgroup *Workgroup) Delay(delay time.Duration) {
+	pausedUntil := time.Now().Add(delay)
+	if pausedUntil.After(workgroup.PausedUntil) {
+		workgroup.PausedUntil = pausedUntil
+	}
+}
+
+// GetRateLimit returns the workgroup's rate limit settings as a RateLimit.
+func (workgroup *Workgroup) GetRateLimit() RateLimit {
+	return RateLimit{
+		Tokens:   workgroup.RateLimit,
+		Interval: time.Duration(workgroup.RateLimitIntervalInSeconds) * time.Second,
+		Burst:    workgroup.RateLimitBurst,
+	}
+}
+
+// NewStoredWorkgroupThrottler creates a throttler that enforces the MaxConcurrency and rate limit stored on each
+// workgroup.  Settings are cached for a few seconds so changes take a moment to apply.
+func NewStoredWorkgroupThrottler(storage TaskStorage) *Throttler {
+	cache := &workgroupCache{
+		storage:   storage,
+		ttl:       5 * time.Second,
+		entries:   make(map[string]*Workgroup),
+		fetchedAt: make(map[string]time.Time),
+	}
+	keyFor := func(taskId string, worker string, workgroup string) string {
+		return workgroup
+	}
+	return ChainThrottlers(
+		NewConcurrencyThrottler(keyFor, func(key string) int {
+			if key == "" {
+				return 0
+			}
+			return cache.find(key).MaxConcurrency
+		}),
+		NewRateLimitThrottler(keyFor, func(key string) RateLimit {
+			if key == "" {
+				return RateLimit{}
+			}
+			return cache.find(key).GetRateLimit()
+		}),
+	)
+}
+
+// workgroupCache keeps recently read workgroups so that throttlers don't hit storage for every decision.
+type workgroupCache struct {
+	storage   TaskStorage
+	ttl       time.Duration
+	entries   map[string]*Workgroup
+	fetchedAt map[string]time.Time
+	mutex     sync.Mutex
+}
+
+func (cache *workgroupCache) find(name string) *Workgroup {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if workgroup, found := cache.entries[name]; found && time.Since(cache.fetchedAt[name]) < cache.ttl {
+		return workgroup
+	}
+	workgroup, err := cache.storage.FindWorkgroup(name)
+	if err != nil {
+		log.Println("Error reading workgroup", name, err)
+		if previous, found := cache.entries[name]; found {
+			return previous
+		}
+		return NewWorkgroup(name)
+	}
+	cache.entries[name] = workgroup
+	cache.fetchedAt[name] = time.Now()
+	return workgroup
+}
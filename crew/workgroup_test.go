@@ -0,0 +1,64 @@
+package crew
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkgroupDelay(t *testing.T) {
+	workgroup := NewWorkgroup("api-key-g")
+	workgroup.Delay(time.Hour)
+	pausedUntil := workgroup.PausedUntil
+
+	// A shorter delay doesn't cut an existing one short
+	workgroup.Delay(time.Minute)
+	if !workgroup.PausedUntil.Equal(pausedUntil) {
+		t.Fatal("Expected longer delay to be kept")
+	}
+	if workgroup.IsAvailable(time.Now()) || !workgroup.IsAvailable(time.Now().Add(2*time.Hour)) {
+		t.Fatal("Expected workgroup to be available only after the delay")
+	}
+
+	task := NewTask()
+	task.RunAfter = time.Now().Add(3 * time.Hour)
+	if !task.StartAfter(workgroup).Equal(task.RunAfter) {
+		t.Fatal("Expected later runAfter to win")
+	}
+	task.RunAfter = time.Time{}
+	if !task.StartAfter(workgroup).Equal(pausedUntil) || !task.StartAfter(nil).IsZero() {
+		t.Fatal("Expected workgroup delay to win")
+	}
+}
+
+func TestCanExecuteInPausedWorkgroup(t *testing.T) {
+	task := NewTask()
+	task.Worker = "worker-a"
+	task.Workgroup = "api-key-g"
+
+	workgroup := NewWorkgroup("api-key-g")
+	if !task.CanExecute(make([]*Task, 0), workgroup) {
+		t.Fatal(`CanExecute() = false, want true`)
+	}
+	workgroup.IsPaused = true
+	if task.CanExecute(make([]*Task, 0), workgroup) {
+		t.Fatal(`CanExecute() = true, want false (workgroup is paused)`)
+	}
+}
+
+func TestStoredWorkgroupThrottler(t *testing.T) {
+	storage := NewMemoryTaskStorage()
+	workgroup := NewWorkgroup("api-key-h")
+	workgroup.MaxConcurrency = 1
+	storage.SaveWorkgroup(workgroup)
+
+	throttler := NewStoredWorkgroupThrottler(storage)
+	first := pushThrottle(throttler, "task124", "worker-a", "api-key-h")
+	second := pushThrottle(throttler, "task125", "worker-a", "api-key-h")
+	expectGranted(t, first)
+	expectWaiting(t, second)
+	expectGranted(t, pushThrottle(throttler, "task126", "worker-a", "api-key-i"))
+	expectGranted(t, pushThrottle(throttler, "task127", "worker-a", ""))
+
+	popThrottle(throttler, "task124", "worker-a", "api-key-h")
+	expectGranted(t, second)
+}
@@ -3,11 +3,13 @@ module github.com/aaronblondeau/crew-go
 go 1.19
 
 require (
+	github.com/alicebob/miniredis/v2 v2.35.0
 	github.com/go-co-op/gocron v1.27.1
 	github.com/go-redsync/redsync/v4 v4.8.1
 	github.com/google/uuid v1.3.0
 	github.com/joho/godotenv v1.5.1
 	github.com/labstack/echo/v4 v4.10.2
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/redis/go-redis/v9 v9.0.4
 	golang.org/x/net v0.7.0
 	golang.org/x/sync v0.2.0
@@ -25,6 +27,7 @@ require (
 	github.com/robfig/cron/v3 v3.0.1 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.2 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
 	golang.org/x/crypto v0.6.0 // indirect
 	golang.org/x/sys v0.5.0 // indirect
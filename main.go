@@ -2,10 +2,9 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"sync"
@@ -13,10 +12,16 @@ import (
 	"time"
 
 	"github.com/aaronblondeau/crew-go/crew"
+	"github.com/aaronblondeau/crew-go/crew/worker"
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 )
 
+// DemoInput is the input of the demo worker below.
+type DemoInput struct {
+	Throw string `json:"throw"`
+}
+
 func main() {
 	godotenv.Load(".env")
 
@@ -30,28 +35,30 @@ func main() {
 
 	storage := crew.NewMemoryTaskStorage()
 
+	// Use crew.NewPullTaskClient() instead for workers that lease tasks with POST /api/v1/lease
 	client := crew.NewHttpPostClient()
 
-	throttlePush := make(chan crew.ThrottlePushQuery, 8)
-	throttlePop := make(chan crew.ThrottlePopQuery, 8)
-	throttler := &crew.Throttler{
-		Push: throttlePush,
-		Pop:  throttlePop,
+	// Route workers to their own hosts, credentials and tls settings with CREW_WORKER_ROUTES=routes.json (see README)
+	if routesPath := os.Getenv("CREW_WORKER_ROUTES"); routesPath != "" {
+		routes, routesErr := crew.LoadWorkerRoutes(routesPath)
+		if routesErr != nil {
+			panic(routesErr)
+		}
+		// Changes to the file are picked up without a restart
+		go routes.Watch(context.Background(), 10*time.Second)
+		client.Routes = routes
 	}
 
-	// No throttling
-	go func() {
-		for {
-			select {
-			case pushQuery := <-throttlePush:
-				// Default behavior = immediate response => no throttling
-				fmt.Println("~~ Would throttle", pushQuery.Worker, pushQuery.TaskId)
-				pushQuery.Resp <- true
-			case popQuery := <-throttlePop:
-				fmt.Println("~~ Would unthrottle", popQuery.Worker, popQuery.TaskId)
-			}
-		}
-	}()
+	// Limit how many tasks run at once for each worker, for example CREW_WORKER_CONCURRENCY=worker-a=3,*=1
+	// and how often they start for each worker/workgroup, for example CREW_WORKGROUP_RATE_LIMIT=*=60/1m
+	// Workers are not throttled when these aren't set.
+	throttler := crew.ChainThrottlers(
+		crew.NewWorkerThrottler(crew.ConcurrencyLimitsFromEnv("CREW_WORKER_CONCURRENCY")),
+		crew.NewWorkerRateLimitThrottler(crew.RateLimitsFromEnv("CREW_WORKER_RATE_LIMIT")),
+		crew.NewWorkgroupRateLimitThrottler(crew.RateLimitsFromEnv("CREW_WORKGROUP_RATE_LIMIT")),
+		// Settings saved on workgroups via the rest api (PUT /api/v1/workgroup/:workgroup)
+		crew.NewStoredWorkgroupThrottler(storage),
+	)
 
 	// Create the task controller (call to startup is further down)
 	controller := crew.NewTaskController(storage, client, throttler)
@@ -70,30 +77,24 @@ func main() {
 	// Create the rest api server
 	srv, e := crew.ServeRestApi(httpServerExitDone, controller, authMiddleware, nil)
 
-	// Example adding a new worker to the rest api
-	e.POST("/demo/worker-d", func(c echo.Context) error {
+	// Example adding a new worker to the rest api (see the crew/worker package)
+	workers := worker.NewRegistry()
+	worker.Register(workers, "worker-d", func(ctx context.Context, input DemoInput, parents []worker.Parent) (worker.Result, error) {
 		log.Println("Demo worker D has been called!")
 		time.Sleep(5 * time.Second)
 
-		payload := map[string]interface{}{}
-		json.NewDecoder(c.Request().Body).Decode(&payload)
-		throw := ""
-		if payload["input"] != nil && payload["input"].(map[string]interface{})["throw"] != nil {
-			throw = payload["input"].(map[string]interface{})["throw"].(string)
-		}
-		if throw != "" {
-			return c.JSON(http.StatusInternalServerError, map[string]interface{}{
-				"error": throw,
-			})
+		if input.Throw != "" {
+			return worker.Result{}, errors.New(input.Throw)
 		}
 
-		return c.JSON(http.StatusOK, map[string]interface{}{
-			"output": map[string]interface{}{
+		return worker.Result{
+			Output: map[string]interface{}{
 				"message": "Worker D was here!",
 				"at":      time.Now().Format(time.RFC3339),
 			},
-		})
+		}, nil
 	})
+	e.POST("/demo/worker-d", workers.EchoHandler())
 
 	// Controller startup is performed after rest api is launched
 	// This is in case we switch TaskController.TriggerEvaluate to happen via an http call in scaled environments.